@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/EncrypteDL/CryptFS/pkg/network/client"
+)
+
+// passwordEnv is the environment variable the password to authorize with the
+// metadata server is taken from, if no password file is given.
+const passwordEnv = "DINOFS_PASSWORD"
+
+// newMetadataClient returns a client for the metadata server at the given
+// address, authorizing as the given user, if any, with the password in the
+// given file or in passwordEnv, if any, and trusting the certificates in the
+// given CA file, if any, on top of the system ones.
+func newMetadataClient(address, user, passwordFile, caFile string) (*client.Client, error) {
+	opts := []client.Option{
+		client.WithAddress(address),
+		client.WithFallbackToPlainTCP(),
+	}
+	password, err := loadPassword(passwordFile)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		opts = append(opts, client.WithPassword(password))
+	}
+	if user != "" {
+		opts = append(opts, client.WithUser(user))
+	}
+	if caFile != "" {
+		b, err := os.ReadFile(os.ExpandEnv(caFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificate found in CA file")
+		}
+		opts = append(opts, client.WithTLSConfig(&tls.Config{RootCAs: pool}))
+	}
+	return client.New(opts...), nil
+}
+
+func loadPassword(passwordFile string) (string, error) {
+	if passwordFile == "" {
+		return os.Getenv(passwordEnv), nil
+	}
+	b, err := os.ReadFile(os.ExpandEnv(passwordFile))
+	if err != nil {
+		return "", fmt.Errorf("could not read password file: %w", err)
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
+
+// loadAuthHash returns the bcrypt hash of the password clients of the metadata
+// server have to authorize with, as output by genhash, or the empty string if
+// no file is given.
+func loadAuthHash(authHashFile string) (string, error) {
+	if authHashFile == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(os.ExpandEnv(authHashFile))
+	if err != nil {
+		return "", fmt.Errorf("could not read auth hash file: %w", err)
+	}
+	hash := strings.TrimSpace(string(b))
+	if hash == "" {
+		return "", errors.New("empty auth hash")
+	}
+	return hash, nil
+}
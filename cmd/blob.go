@@ -2,16 +2,20 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // blobCmd represents the blobserver command
@@ -24,8 +28,9 @@ var blobCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		dataPath := viper.GetString("data")
 		bindAddress := viper.GetString("blob-bind")
+		adminAuthHashFile := viper.GetString("blob-admin-auth-hash-file")
 
-		blobserver(bindAddress, dataPath)
+		blobserver(bindAddress, dataPath, adminAuthHashFile)
 	},
 }
 
@@ -42,23 +47,49 @@ func init() {
 		"Set the [interface]:<port> to listen on",
 	)
 
+	blobCmd.Flags().String(
+		"admin-auth-hash-file", "",
+		"Set the file holding the bcrypt hash of the password needed to delete and list blobs, as output by genhash (both are refused if unset)",
+	)
+
 	viper.BindPFlag("data", blobCmd.Flags().Lookup("data"))
 	viper.SetDefault("data", "./data")
 
 	viper.BindPFlag("blob-bind", blobCmd.Flags().Lookup("bind"))
 	viper.SetDefault("blob-bind", ":9000")
+
+	viper.BindPFlag("blob-admin-auth-hash-file", blobCmd.Flags().Lookup("admin-auth-hash-file"))
 }
 
-func blobserver(bindAddress, dataPath string) {
+func blobserver(bindAddress, dataPath, adminAuthHashFile string) {
+	adminAuthHash, err := loadAuthHash(adminAuthHashFile)
+	if err != nil {
+		log.Fatalf("Could not load admin auth hash: %v", err)
+	}
 	if err := os.MkdirAll(dataPath, 0700); err != nil {
 		log.Fatalf("Could not ensure directory %q exists: %v", dataPath, err)
 	}
 	store := storage.NewDiskStore(dataPath)
 	log.Infof("using DiskStore with path %s", dataPath)
+	stats := &usageCache{store: store, ttl: time.Minute}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		var logger *log.Entry
 		status, body := func() (int, []byte) {
+			if r.URL.Path == "/stats" {
+				logger = log.WithField("op", "STATS")
+				return stats.serve(logger, r)
+			}
+			if r.URL.Path == "/" {
+				logger = log.WithFields(log.Fields{
+					"op":     "LIST",
+					"prefix": r.URL.Query().Get("prefix"),
+				})
+				if status, body := authorizeAdmin(logger, adminAuthHash, r); status != http.StatusOK {
+					return status, body
+				}
+				return list(logger, store, r)
+			}
 			hkey := r.URL.Path[1:]
 			key, err := hex.DecodeString(hkey)
 			if err != nil {
@@ -81,6 +112,28 @@ func blobserver(bindAddress, dataPath string) {
 				}
 				logger.Info("Success")
 				return http.StatusOK, value
+			case http.MethodHead:
+				ok, err := store.Has(key)
+				if err != nil {
+					logger.WithField("err", err).Error()
+					return http.StatusInternalServerError, nil
+				}
+				if !ok {
+					logger.Debug("Not found")
+					return http.StatusNotFound, nil
+				}
+				logger.Info("Success")
+				return http.StatusOK, nil
+			case http.MethodDelete:
+				if status, body := authorizeAdmin(logger, adminAuthHash, r); status != http.StatusOK {
+					return status, body
+				}
+				if err := store.Delete(key); err != nil {
+					logger.WithField("err", err).Error()
+					return http.StatusInternalServerError, []byte(fmt.Sprintf("%q: %v", hkey, err))
+				}
+				logger.Info("Success")
+				return http.StatusOK, nil
 			case http.MethodPut:
 				value, err := ioutil.ReadAll(r.Body)
 				if err != nil {
@@ -95,7 +148,7 @@ func blobserver(bindAddress, dataPath string) {
 				return http.StatusOK, nil
 			default:
 				logger.Warn("Bad request")
-				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET or PUT", r.Method))
+				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET, HEAD, PUT or DELETE", r.Method))
 			}
 		}()
 		w.WriteHeader(status)
@@ -111,3 +164,81 @@ func blobserver(bindAddress, dataPath string) {
 		log.WithField("err", err).Fatal("Could not listen and serve")
 	}
 }
+
+// usageCache serves the usage of a store, only asking the store again once the
+// last answer is older than ttl, as DiskStore walks the whole directory.
+type usageCache struct {
+	store storage.UsageReporter
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	at    time.Time
+	usage storage.Usage
+}
+
+func (c *usageCache) serve(logger *log.Entry, r *http.Request) (int, []byte) {
+	if r.Method != http.MethodGet {
+		logger.Warn("Bad request")
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET", r.Method))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.at) > c.ttl {
+		usage, err := c.store.Usage()
+		if err != nil {
+			logger.WithField("err", err).Error()
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+		c.at = time.Now()
+		c.usage = usage
+	}
+	body, err := json.Marshal(c.usage)
+	if err != nil {
+		logger.WithField("err", err).Error()
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	logger.Debug("Success")
+	return http.StatusOK, body
+}
+
+// authorizeAdmin checks that the request carries the password hashed in
+// adminAuthHash, as the password of HTTP basic authentication. Requests are
+// refused if there's no hash, as anybody reaching the server could otherwise
+// enumerate and delete all blobs.
+func authorizeAdmin(logger *log.Entry, adminAuthHash string, r *http.Request) (int, []byte) {
+	if adminAuthHash == "" {
+		logger.Warn("Forbidden")
+		return http.StatusForbidden, []byte("deleting and listing blobs needs --admin-auth-hash-file")
+	}
+	_, password, ok := r.BasicAuth()
+	if !ok || bcrypt.CompareHashAndPassword([]byte(adminAuthHash), []byte(password)) != nil {
+		logger.Warn("Unauthorized")
+		return http.StatusUnauthorized, []byte("bad admin password")
+	}
+	return http.StatusOK, nil
+}
+
+// list responds with the keys starting with the hex encoded prefix query
+// parameter, hex encoded, one per line.
+func list(logger *log.Entry, store storage.Store, r *http.Request) (int, []byte) {
+	if r.Method != http.MethodGet {
+		logger.Warn("Bad request")
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET", r.Method))
+	}
+	prefix, err := hex.DecodeString(r.URL.Query().Get("prefix"))
+	if err != nil {
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q: not a valid prefix, expecting hex", r.URL.Query().Get("prefix")))
+	}
+	var body []byte
+	err = store.Scan(prefix, func(key []byte) error {
+		body = hex.AppendEncode(body, key)
+		body = append(body, '\n')
+		return nil
+	})
+	if err != nil {
+		logger.WithField("err", err).Error()
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	logger.Info("Success")
+	return http.StatusOK, body
+}
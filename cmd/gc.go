@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/EncrypteDL/CryptFS/pkg/node"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc [flags] <metadataserver>",
+	Short: "Deletes blobs no longer referenced by the file system",
+	Long: `Walks the file system tree from the root node in the metadata store, then
+deletes from the blob server data directory the blobs that are not referenced
+and were last written before the grace period. It must run where the blob
+server data directory is, and only if the blob server stores blobs for this
+file system alone.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := gcOptions{
+			data:           viper.GetString("gc-data"),
+			grace:          viper.GetDuration("gc-grace"),
+			dryRun:         viper.GetBool("gc-dry-run"),
+			keyFile:        viper.GetString("gc-key-file"),
+			passphraseFile: viper.GetString("gc-passphrase-file"),
+			user:           viper.GetString("gc-user"),
+			passwordFile:   viper.GetString("gc-password-file"),
+			tlsCA:          viper.GetString("gc-tls-ca"),
+		}
+
+		metadataServer := args[0]
+
+		gc(opts, metadataServer)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().StringP(
+		"data", "d", "./data",
+		"Set the directory used by the blob server to store data",
+	)
+
+	gcCmd.Flags().Duration(
+		"grace", 24*time.Hour,
+		"Keep unreferenced blobs written more recently than this, as they may belong to files being saved",
+	)
+
+	gcCmd.Flags().BoolP(
+		"dry-run", "n", false,
+		"Only log the blobs that would be deleted",
+	)
+
+	gcCmd.Flags().StringP(
+		"key-file", "k", "",
+		"Set the file holding the key used to encrypt contents and metadata",
+	)
+
+	gcCmd.Flags().StringP(
+		"passphrase-file", "p", "",
+		"Set the file holding the passphrase used to encrypt contents and metadata",
+	)
+
+	gcCmd.Flags().String(
+		"user", "",
+		"Set the account to authorize with the metadata server as, with a password or token of the account",
+	)
+
+	gcCmd.Flags().String(
+		"password-file", "",
+		"Set the file holding the password to authorize with the metadata server (default $"+passwordEnv+")",
+	)
+
+	gcCmd.Flags().String(
+		"tls-ca", "",
+		"Set the file holding the certificates to trust for tls:// metadata servers, on top of the system ones",
+	)
+
+	viper.BindPFlag("gc-data", gcCmd.Flags().Lookup("data"))
+	viper.SetDefault("gc-data", "./data")
+
+	viper.BindPFlag("gc-grace", gcCmd.Flags().Lookup("grace"))
+	viper.SetDefault("gc-grace", 24*time.Hour)
+
+	viper.BindPFlag("gc-dry-run", gcCmd.Flags().Lookup("dry-run"))
+	viper.SetDefault("gc-dry-run", false)
+
+	viper.BindPFlag("gc-key-file", gcCmd.Flags().Lookup("key-file"))
+	viper.BindPFlag("gc-passphrase-file", gcCmd.Flags().Lookup("passphrase-file"))
+	viper.BindPFlag("gc-user", gcCmd.Flags().Lookup("user"))
+	viper.BindPFlag("gc-password-file", gcCmd.Flags().Lookup("password-file"))
+	viper.BindPFlag("gc-tls-ca", gcCmd.Flags().Lookup("tls-ca"))
+}
+
+type gcOptions struct {
+	data   string
+	grace  time.Duration
+	dryRun bool
+
+	// As for mount, and must match what the file system is mounted with.
+	keyFile        string
+	passphraseFile string
+
+	// As for mount.
+	user         string
+	passwordFile string
+	tlsCA        string
+}
+
+func gc(opts gcOptions, metadataServer string) {
+	// Blobs written after this are too recent to delete, whether referenced or
+	// not, as the metadata referring to them may be about to be saved.
+	cutoff := time.Now().Add(-opts.grace)
+
+	metadataClient, err := newMetadataClient(metadataServer, opts.user, opts.passwordFile, opts.tlsCA)
+	if err != nil {
+		log.Fatalf("Could not set up metadata client: %v", err)
+	}
+	metadataStore := storage.NewRemoteVersionedStore(metadataClient)
+	metadataStore.Start()
+	defer metadataStore.Stop()
+
+	key, err := loadMasterKey(metadataStore, opts.keyFile, opts.passphraseFile)
+	if err != nil {
+		log.Fatalf("Could not load key: %v", err)
+	}
+
+	store := storage.NewDiskStore(os.ExpandEnv(opts.data))
+	var factory node.CryptNodeFactory
+	if key == nil {
+		factory.Blobs = storage.NewBlobStore(store)
+		factory.Metadata = metadataStore
+	} else {
+		factory.Blobs = storage.NewEncryptedBlobStore(store, *key)
+		factory.Metadata = storage.NewEncryptedVersionedStore(metadataStore, *key)
+	}
+
+	// Mark.
+	live := make(map[string]bool)
+	var rootKey [node.NodeKeyLen]byte
+	err = factory.WalkBlobs(rootKey, func(key []byte) error {
+		live[string(key)] = true
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Could not walk the file system: %v", err)
+	}
+
+	// Sweep.
+	var referenced, recent, deleted int
+	err = store.Walk(func(key []byte, info fs.FileInfo) error {
+		if live[string(key)] {
+			referenced++
+			return nil
+		}
+		if info.ModTime().After(cutoff) {
+			recent++
+			return nil
+		}
+		logger := log.WithField("key", fmt.Sprintf("%x", key))
+		if opts.dryRun {
+			logger.Info("Would delete")
+		} else {
+			if err := store.Delete(key); err != nil {
+				return err
+			}
+			logger.Debug("Deleted")
+		}
+		deleted++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Could not sweep blobs: %v", err)
+	}
+	log.WithFields(log.Fields{
+		"referenced": referenced,
+		"recent":     recent,
+		"deleted":    deleted,
+		"dryRun":     opts.dryRun,
+	}).Info("Garbage collection done")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/EncrypteDL/CryptFS/pkg/crypt"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+)
+
+// saltKey is the metadata key under which the salt for passphrase derived keys
+// is stored. It is not node.NodeKeyLen bytes long, so it can't clash with a
+// node key.
+var saltKey = []byte("cryptfs.salt")
+
+// loadMasterKey returns the master key from either a key file or a passphrase
+// file, or nil if neither is given. A passphrase is stretched with a salt that
+// is shared by all clients through the metadata store.
+func loadMasterKey(metadata storage.VersionedStore, keyFile, passphraseFile string) (*crypt.Key, error) {
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return nil, errors.New("use either a key file or a passphrase file, not both")
+	case keyFile != "":
+		key, err := crypt.KeyFromFile(os.ExpandEnv(keyFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read key file: %w", err)
+		}
+		return &key, nil
+	case passphraseFile != "":
+		b, err := os.ReadFile(os.ExpandEnv(passphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase file: %w", err)
+		}
+		passphrase := strings.TrimRight(string(b), "\r\n")
+		if passphrase == "" {
+			return nil, errors.New("empty passphrase")
+		}
+		salt, err := loadOrCreateSalt(metadata)
+		if err != nil {
+			return nil, fmt.Errorf("could not load salt: %w", err)
+		}
+		key := crypt.KeyFromPassphrase([]byte(passphrase), salt)
+		return &key, nil
+	default:
+		return nil, nil
+	}
+}
+
+func loadOrCreateSalt(metadata storage.VersionedStore) ([]byte, error) {
+	_, salt, err := metadata.Get(saltKey)
+	if err == nil {
+		return salt, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	salt, err = crypt.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	err = metadata.Put(1, saltKey, salt)
+	if errors.Is(err, storage.ErrStalePut) {
+		// Some other client got there first.
+		_, salt, err = metadata.Get(saltKey)
+	}
+	return salt, err
+}
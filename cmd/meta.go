@@ -5,6 +5,7 @@ import (
 	"os/signal"
 
 	"github.com/EncrypteDL/CryptFS/pkg/network/server"
+	"github.com/EncrypteDL/CryptFS/pkg/node"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -19,10 +20,17 @@ var metaServer = &cobra.Command{
 	Long:    `...`,
 	Args:    cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
+		opts := metaOptions{
+			tlsCert:        viper.GetString("meta-tls-cert"),
+			tlsKey:         viper.GetString("meta-tls-key"),
+			authHashFile:   viper.GetString("meta-auth-hash-file"),
+			accountsFile:   viper.GetString("meta-accounts-file"),
+			changeLogLimit: viper.GetUint64("meta-change-log-limit"),
+		}
 		bindAddress := viper.GetString("meta-bind")
 		storeURI := viper.GetString("store")
 
-		metaserver(bindAddress, storeURI)
+		metaserver(opts, bindAddress, storeURI)
 	},
 }
 
@@ -39,24 +47,100 @@ func init() {
 		"Set the [interface]:<port> to listen on",
 	)
 
+	metaServer.Flags().String(
+		"tls-cert", "",
+		"Set the file holding the TLS certificate to serve with, along with --tls-key",
+	)
+
+	metaServer.Flags().String(
+		"tls-key", "",
+		"Set the file holding the TLS private key to serve with, along with --tls-cert",
+	)
+
+	metaServer.Flags().String(
+		"auth-hash-file", "",
+		"Set the file holding the bcrypt hash of the password clients must authorize with, as output by genhash (requires TLS)",
+	)
+
+	metaServer.Flags().String(
+		"accounts-file", "",
+		"Set the file holding the accounts clients may authorize as, as managed by the users command (requires TLS)",
+	)
+
+	metaServer.Flags().Uint64(
+		"change-log-limit", 100000,
+		"Set how many of the latest changes to keep for clients to catch up with, 0 to keep them all",
+	)
+
 	viper.BindPFlag("meta-bind", metaServer.Flags().Lookup("bind"))
 	viper.SetDefault("meta-bind", ":8000")
 
 	viper.BindPFlag("store", metaServer.Flags().Lookup("store"))
 	viper.SetDefault("store", "bitcask://dinofs.db")
+
+	viper.BindPFlag("meta-tls-cert", metaServer.Flags().Lookup("tls-cert"))
+	viper.BindPFlag("meta-tls-key", metaServer.Flags().Lookup("tls-key"))
+	viper.BindPFlag("meta-auth-hash-file", metaServer.Flags().Lookup("auth-hash-file"))
+	viper.BindPFlag("meta-accounts-file", metaServer.Flags().Lookup("accounts-file"))
+	viper.BindPFlag("meta-change-log-limit", metaServer.Flags().Lookup("change-log-limit"))
+	viper.SetDefault("meta-change-log-limit", 100000)
+}
+
+type metaOptions struct {
+	// Both or neither may be set. If set, clients connect with TLS.
+	tlsCert string
+	tlsKey  string
+
+	// If set, clients have to authorize with the password hashed in it.
+	authHashFile string
+
+	// If set, clients have to authorize as one of the accounts in it, unless
+	// they have the password above, and only get access to what's granted.
+	accountsFile string
+
+	// How many changes to keep in the change log, all of them if zero.
+	changeLogLimit uint64
 }
 
-func metaserver(bindAddress, storeURI string) {
+func metaserver(opts metaOptions, bindAddress, storeURI string) {
+	if (opts.tlsCert == "") != (opts.tlsKey == "") {
+		log.Fatal("Use both --tls-cert and --tls-key, or neither")
+	}
+	authHash, err := loadAuthHash(opts.authHashFile)
+	if err != nil {
+		log.Fatalf("Could not load auth hash: %v", err)
+	}
+
 	store, err := storage.NewStore(storeURI)
 	if err != nil {
 		log.Fatalf("Could not instantiate backend store: %v", err)
 	}
-	versionedStore := storage.NewVersionedWrapper(store)
+	versionedStore := storage.NewVersionedWrapper(store,
+		storage.WithChangeLog(),
+		storage.WithChangeLogLimit(opts.changeLogLimit),
+	)
+	if err := versionedStore.Recover(); err != nil {
+		log.Fatalf("Could not recover backend store: %v", err)
+	}
 
-	srv := server.New(
+	srvOpts := []server.Option{
 		server.WithBind(bindAddress),
 		server.WithVersionedStore(versionedStore),
-	)
+	}
+	if opts.tlsCert != "" {
+		srvOpts = append(srvOpts, server.WithKeyPair(os.ExpandEnv(opts.tlsCert), os.ExpandEnv(opts.tlsKey)))
+	}
+	if authHash != "" {
+		srvOpts = append(srvOpts, server.WithAuthHash(authHash))
+	}
+	if opts.accountsFile != "" {
+		srvOpts = append(srvOpts,
+			server.WithAccountsFile(os.ExpandEnv(opts.accountsFile)),
+			server.WithTree(node.NewTree(versionedStore)),
+			server.WithSharedKeys(saltKey),
+		)
+	}
+	srv := server.New(srvOpts...)
 
 	if _, err := srv.Listen(); err != nil {
 		log.WithError(err).Fatal("error starting metdata server")
@@ -1,11 +1,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/signal"
+	"time"
 
-	"github.com/EncrypteDL/CryptFS/pkg/network/client"
 	"github.com/EncrypteDL/CryptFS/pkg/node"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -23,14 +24,35 @@ var mountCmd = &cobra.Command{
 	Long:    `...`,
 	Args:    cobra.ExactArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
-		debug := viper.GetBool("debug")
-		cache := viper.GetString("cache")
+		atime, err := node.ParseAtimePolicy(viper.GetString("atime"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		opts := mountOptions{
+			debug:          viper.GetBool("debug"),
+			cache:          viper.GetString("cache"),
+			cacheMaxBytes:  viper.GetInt64("cache-max-bytes"),
+			cacheMaxAge:    viper.GetDuration("cache-max-age"),
+			journal:        viper.GetString("journal"),
+			flushTimeout:   viper.GetDuration("flush-timeout"),
+			keyFile:        viper.GetString("key-file"),
+			passphraseFile: viper.GetString("passphrase-file"),
+			user:           viper.GetString("user"),
+			passwordFile:   viper.GetString("password-file"),
+			tlsCA:          viper.GetString("tls-ca"),
+			convergent:     viper.GetBool("convergent"),
+			checkPerms:     viper.GetBool("check-permissions"),
+			atime:          atime,
+			quotaBytes:     viper.GetUint64("quota-bytes"),
+			quotaFiles:     viper.GetUint64("quota-files"),
+		}
 
 		metadataStore := args[0]
 		blobServer := args[1]
 		mountPoint := args[2]
 
-		mount(debug, cache, metadataStore, blobServer, mountPoint)
+		mount(opts, metadataStore, blobServer, mountPoint)
 	},
 }
 
@@ -42,56 +64,248 @@ func init() {
 		"Set the directory used to store cache blobs",
 	)
 
+	mountCmd.Flags().Int64(
+		"cache-max-bytes", 0,
+		"Evict the least recently used cache blobs above this total size (0 for no limit)",
+	)
+
+	mountCmd.Flags().Duration(
+		"cache-max-age", 0,
+		"Evict cache blobs unused for this long (0 for no limit)",
+	)
+
+	mountCmd.Flags().StringP(
+		"journal", "j", "./journal",
+		"Set the directory used to store blobs not yet uploaded to the blob server",
+	)
+
+	mountCmd.Flags().Duration(
+		"flush-timeout", time.Minute,
+		"Set how long to wait on unmount for blobs to be uploaded to the blob server",
+	)
+
+	mountCmd.Flags().StringP(
+		"key-file", "k", "",
+		"Set the file holding the key used to encrypt contents and metadata",
+	)
+
+	mountCmd.Flags().StringP(
+		"passphrase-file", "p", "",
+		"Set the file holding the passphrase used to encrypt contents and metadata",
+	)
+
+	mountCmd.Flags().String(
+		"user", "",
+		"Set the account to authorize with the metadata server as, with a password or token of the account",
+	)
+
+	mountCmd.Flags().String(
+		"password-file", "",
+		"Set the file holding the password to authorize with the metadata server (default $"+passwordEnv+")",
+	)
+
+	mountCmd.Flags().String(
+		"tls-ca", "",
+		"Set the file holding the certificates to trust for tls:// metadata servers, on top of the system ones",
+	)
+
+	mountCmd.Flags().Bool(
+		"convergent", false,
+		"Encrypt equal contents equally, so they are stored only once",
+	)
+
+	mountCmd.Flags().Uint64(
+		"quota-bytes", 0,
+		"Report this many bytes as the size of the file system (0 for the blob server capacity)",
+	)
+
+	mountCmd.Flags().Uint64(
+		"quota-files", 0,
+		"Report this many files as the limit of the file system (0 for an estimate from the metadata server)",
+	)
+
+	mountCmd.Flags().Bool(
+		"check-permissions", false,
+		"Check operations against the mode and POSIX ACLs of files, e.g., for mounts shared with -o allow_other",
+	)
+
+	mountCmd.Flags().String(
+		"atime", "relatime",
+		"Set when reading files updates their access time: relatime, strictatime or noatime",
+	)
+
 	viper.BindPFlag("cache", mountCmd.Flags().Lookup("cache"))
 	viper.SetDefault("cache", "./cache")
+
+	viper.BindPFlag("cache-max-bytes", mountCmd.Flags().Lookup("cache-max-bytes"))
+	viper.SetDefault("cache-max-bytes", 0)
+
+	viper.BindPFlag("cache-max-age", mountCmd.Flags().Lookup("cache-max-age"))
+	viper.SetDefault("cache-max-age", 0)
+
+	viper.BindPFlag("journal", mountCmd.Flags().Lookup("journal"))
+	viper.SetDefault("journal", "./journal")
+
+	viper.BindPFlag("flush-timeout", mountCmd.Flags().Lookup("flush-timeout"))
+	viper.SetDefault("flush-timeout", time.Minute)
+
+	viper.BindPFlag("key-file", mountCmd.Flags().Lookup("key-file"))
+	viper.BindPFlag("passphrase-file", mountCmd.Flags().Lookup("passphrase-file"))
+	viper.BindPFlag("user", mountCmd.Flags().Lookup("user"))
+	viper.BindPFlag("password-file", mountCmd.Flags().Lookup("password-file"))
+	viper.BindPFlag("tls-ca", mountCmd.Flags().Lookup("tls-ca"))
+
+	viper.BindPFlag("convergent", mountCmd.Flags().Lookup("convergent"))
+	viper.SetDefault("convergent", false)
+
+	viper.BindPFlag("check-permissions", mountCmd.Flags().Lookup("check-permissions"))
+	viper.SetDefault("check-permissions", false)
+
+	viper.BindPFlag("atime", mountCmd.Flags().Lookup("atime"))
+	viper.SetDefault("atime", "relatime")
+
+	viper.BindPFlag("quota-bytes", mountCmd.Flags().Lookup("quota-bytes"))
+	viper.SetDefault("quota-bytes", 0)
+
+	viper.BindPFlag("quota-files", mountCmd.Flags().Lookup("quota-files"))
+	viper.SetDefault("quota-files", 0)
 }
 
-func mount(debug bool, cache, metadataServer, blobServer, mountPoint string) {
+type mountOptions struct {
+	debug         bool
+	cache         string
+	cacheMaxBytes int64
+	cacheMaxAge   time.Duration
+
+	// Blobs are uploaded in the background, and recorded in the journal until
+	// then, so that the next mount resumes uploading them.
+	journal      string
+	flushTimeout time.Duration
+
+	// Only one of keyFile and passphraseFile may be set. If neither is set,
+	// contents are stored in clear.
+	keyFile        string
+	passphraseFile string
+	convergent     bool
+
+	// For the metadata server, if it requires clients to authorize, and has a
+	// certificate not signed by a known authority. Without a user, the password
+	// is that of the server.
+	user         string
+	passwordFile string
+	tlsCA        string
+
+	checkPerms bool
+	atime      node.AtimePolicy
+
+	// Reported by statfs, e.g., df, instead of the capacity of the servers.
+	quotaBytes uint64
+	quotaFiles uint64
+}
+
+func mount(opts mountOptions, metadataServer, blobServer, mountPoint string) {
 	if err := os.MkdirAll(mountPoint, 0755); err != nil {
 		log.WithError(err).Fatal("error creating mount point")
 	}
 
 	var factory node.CryptNodeFactory
 
+	metadataClient, err := newMetadataClient(metadataServer, opts.user, opts.passwordFile, opts.tlsCA)
+	if err != nil {
+		log.Fatalf("Could not set up metadata client: %v", err)
+	}
 	metadataStore := storage.NewRemoteVersionedStore(
-		client.New(
-			client.WithAddress(metadataServer),
-			client.WithFallbackToPlainTCP(),
-		),
+		metadataClient,
 		storage.WithChangeListener(factory.InvalidateCache),
 	)
 	metadataStore.Start()
 	defer metadataStore.Stop()
 
+	key, err := loadMasterKey(metadataStore, opts.keyFile, opts.passphraseFile)
+	if err != nil {
+		log.Fatalf("Could not load key: %v", err)
+	}
+
+	cacheStore, err := storage.NewCacheStore(
+		os.ExpandEnv(opts.cache),
+		storage.WithMaxBytes(opts.cacheMaxBytes),
+		storage.WithMaxAge(opts.cacheMaxAge),
+	)
+	if err != nil {
+		log.Fatalf("Could not open cache: %v", err)
+	}
+	defer func() {
+		stats := cacheStore.Stats()
+		log.WithFields(log.Fields{
+			"hits":      stats.Hits,
+			"misses":    stats.Misses,
+			"evictions": stats.Evictions,
+			"count":     stats.Count,
+			"bytes":     stats.Bytes,
+		}).Info("Cache stats")
+	}()
+
+	journal := os.ExpandEnv(opts.journal)
+	if err := os.MkdirAll(journal, 0700); err != nil {
+		log.Fatalf("Could not ensure directory %q exists: %v", journal, err)
+	}
 	remoteStore := storage.NewRemoteStore(blobServer)
-	pairedStore := storage.NewPaired(
-		storage.NewDiskStore(os.ExpandEnv(cache)),
+	pairedStore, err := storage.NewPaired(
+		cacheStore,
 		remoteStore,
+		storage.WithJournal(storage.NewDiskStore(journal)),
 	)
-	blogStore := storage.NewBlobStore(pairedStore)
+	if err != nil {
+		log.Fatalf("Could not start uploading to the blob server: %v", err)
+	}
+	switch {
+	case key == nil:
+		log.Warn("No key or passphrase given, contents and metadata will be stored in clear")
+		factory.Blobs = storage.NewBlobStore(pairedStore)
+	case opts.convergent:
+		factory.Blobs = storage.NewConvergentBlobStore(pairedStore, *key)
+	default:
+		factory.Blobs = storage.NewEncryptedBlobStore(pairedStore, *key)
+	}
 
-	factory.Blobs = blogStore
-	factory.Metadata = metadataStore
+	if key == nil {
+		factory.Metadata = metadataStore
+	} else {
+		factory.Metadata = storage.NewEncryptedVersionedStore(metadataStore, *key)
+	}
 
 	g := node.NewInodeNumbersGenerator()
 	go g.Start()
 	defer g.Stop()
 	factory.InodeGenerator = g
+	factory.CheckPermissions = opts.checkPerms
+	factory.Atime = opts.atime
+
+	factory.BlobUsage = remoteStore
+	factory.MetadataUsage = metadataStore
+	factory.QuotaBytes = opts.quotaBytes
+	factory.QuotaFiles = opts.quotaFiles
+	factory.Locks = metadataStore
 
 	var fsopts fs.Options
-	fsopts.Debug = debug
+	fsopts.Debug = opts.debug
 	fsopts.UID = uint32(os.Getuid())
 	fsopts.GID = uint32(os.Getgid())
 	fsopts.FsName = "test" // TOOD: Where should this come from?
 	fsopts.Name = "dinofs"
+	// Locks are forwarded to the metadata server, instead of being only local
+	// to this mount.
+	fsopts.EnableLocks = true
 	var rootKey [node.NodeKeyLen]byte
 	root := factory.ExistingNode("root", rootKey)
 	factory.Root = root
 	if err := root.LoadMetadata(root.Key); err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
 			log.Infof("Serving an empty file system (no metadata found for root node)")
-			root.Mode |= fuse.S_IFDIR
-			root.Children = make(map[string]*node.DinoNode)
+			root.Mode |= fuse.S_IFDIR | 0o755
+			root.User = uint32(os.Getuid())
+			root.Group = uint32(os.Getgid())
+			root.Children = make(map[string]*node.CryptNode)
 		} else {
 			log.Fatalf("Could not load root node metadata: %v", err)
 		}
@@ -116,4 +330,13 @@ func mount(debug bool, cache, metadataServer, blobServer, mountPoint string) {
 	}()
 
 	server.Wait()
+
+	if n := pairedStore.Pending(); n > 0 {
+		log.WithField("pending", n).Info("Waiting for blobs to be uploaded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.flushTimeout)
+	defer cancel()
+	if err := pairedStore.Flush(ctx); err != nil {
+		log.WithField("err", err).Warn("Not all blobs were uploaded, they will be on the next mount")
+	}
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/EncrypteDL/CryptFS/pkg/network/server"
+	"github.com/EncrypteDL/CryptFS/pkg/node"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// wholeFS stands for the whole file system in --read and --write.
+const wholeFS = "*"
+
+// usersCmd represents the users command
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "Manages the accounts of a metadata server",
+	Long: `Manages the accounts clients may authorize with a metadata server as, in
+the file given to the server with --accounts-file. The server reads the file
+again whenever a client connects, so there's no need to restart it.
+
+Accounts are granted access to subtrees, given as the hex key of the node at
+their root, or to the whole file system, given as *. Only metadata stored in
+clear can be told apart by subtree, so accounts for encrypted file systems
+need grants on the whole file system.`,
+}
+
+var usersAddCmd = &cobra.Command{
+	Use:   "add <name> [flags]",
+	Short: "Adds an account, and prints a token to authorize as it with",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		grants, err := parseGrants(viper.GetStringSlice("users-add-read"), viper.GetStringSlice("users-add-write"))
+		if err != nil {
+			log.Fatalf("Could not parse grants: %v", err)
+		}
+		var token string
+		updateAccounts(func(accounts *server.Accounts) {
+			account, err := accounts.Add(args[0])
+			if err != nil {
+				log.Fatalf("Could not add account: %v", err)
+			}
+			account.Grants = grants
+			if passwordFile := viper.GetString("users-add-password-file"); passwordFile != "" {
+				password, err := loadPassword(passwordFile)
+				if err != nil {
+					log.Fatal(err)
+				}
+				if err := account.SetPassword(password); err != nil {
+					log.Fatalf("Could not hash password: %v", err)
+				}
+			}
+			token = rotateToken(account)
+		})
+		fmt.Println(token)
+	},
+}
+
+var usersGrantCmd = &cobra.Command{
+	Use:   "grant <name> [flags]",
+	Short: "Replaces what an account is granted access to",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		grants, err := parseGrants(viper.GetStringSlice("users-grant-read"), viper.GetStringSlice("users-grant-write"))
+		if err != nil {
+			log.Fatalf("Could not parse grants: %v", err)
+		}
+		updateAccounts(func(accounts *server.Accounts) {
+			findAccount(accounts, args[0]).Grants = grants
+		})
+	},
+}
+
+var usersRemoveCmd = &cobra.Command{
+	Use:   "remove <name>",
+	Short: "Removes an account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateAccounts(func(accounts *server.Accounts) {
+			if err := accounts.Remove(args[0]); err != nil {
+				log.Fatalf("Could not remove account: %v", err)
+			}
+		})
+	},
+}
+
+var usersRotateCmd = &cobra.Command{
+	Use:   "rotate <name>",
+	Short: "Prints a new token to authorize as an account with, instead of the old one",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var token string
+		updateAccounts(func(accounts *server.Accounts) {
+			token = rotateToken(findAccount(accounts, args[0]))
+		})
+		fmt.Println(token)
+	},
+}
+
+var usersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the accounts and their grants",
+	Args:  cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		accounts, err := server.LoadAccounts(accountsFile())
+		if err != nil {
+			log.Fatalf("Could not load accounts: %v", err)
+		}
+		for _, account := range accounts.Users {
+			var read, write []string
+			for _, g := range account.Grants {
+				subtree := g.Subtree
+				if subtree == "" {
+					subtree = wholeFS
+				}
+				if g.Write {
+					write = append(write, subtree)
+				} else {
+					read = append(read, subtree)
+				}
+			}
+			fmt.Printf("%s\tread=%s\twrite=%s\n", account.Name, strings.Join(read, ","), strings.Join(write, ","))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(usersCmd)
+	usersCmd.AddCommand(usersAddCmd, usersGrantCmd, usersRemoveCmd, usersRotateCmd, usersListCmd)
+
+	usersCmd.PersistentFlags().StringP(
+		"accounts-file", "a", "accounts.json",
+		"Set the file holding the accounts",
+	)
+
+	for _, cmd := range []*cobra.Command{usersAddCmd, usersGrantCmd} {
+		cmd.Flags().StringSlice(
+			"read", nil,
+			"Grant read access to the subtrees with these hex root node keys, or * for the whole file system",
+		)
+		cmd.Flags().StringSlice(
+			"write", nil,
+			"Grant read and write access to the subtrees with these hex root node keys, or * for the whole file system",
+		)
+	}
+
+	usersAddCmd.Flags().String(
+		"password-file", "",
+		"Set the file holding a password to authorize as the account with, on top of the token",
+	)
+
+	viper.BindPFlag("users-accounts-file", usersCmd.PersistentFlags().Lookup("accounts-file"))
+	viper.SetDefault("users-accounts-file", "accounts.json")
+
+	viper.BindPFlag("users-add-read", usersAddCmd.Flags().Lookup("read"))
+	viper.BindPFlag("users-add-write", usersAddCmd.Flags().Lookup("write"))
+	viper.BindPFlag("users-add-password-file", usersAddCmd.Flags().Lookup("password-file"))
+
+	viper.BindPFlag("users-grant-read", usersGrantCmd.Flags().Lookup("read"))
+	viper.BindPFlag("users-grant-write", usersGrantCmd.Flags().Lookup("write"))
+}
+
+func accountsFile() string {
+	return os.ExpandEnv(viper.GetString("users-accounts-file"))
+}
+
+// updateAccounts loads the accounts, lets fn change them, and saves them.
+func updateAccounts(fn func(*server.Accounts)) {
+	file := accountsFile()
+	accounts, err := server.LoadAccounts(file)
+	if err != nil {
+		log.Fatalf("Could not load accounts: %v", err)
+	}
+	fn(accounts)
+	if err := accounts.Save(file); err != nil {
+		log.Fatalf("Could not save accounts: %v", err)
+	}
+}
+
+func findAccount(accounts *server.Accounts, name string) *server.Account {
+	account := accounts.Find(name)
+	if account == nil {
+		log.Fatalf("Could not find account %q: %v", name, server.ErrNoSuchAccount)
+	}
+	return account
+}
+
+func rotateToken(account *server.Account) string {
+	token, err := account.RotateToken()
+	if err != nil {
+		log.Fatalf("Could not generate token: %v", err)
+	}
+	return token
+}
+
+func parseGrants(read, write []string) ([]server.Grant, error) {
+	var grants []server.Grant
+	for _, subtrees := range []struct {
+		keys  []string
+		write bool
+	}{{read, false}, {write, true}} {
+		for _, key := range subtrees.keys {
+			if key == wholeFS {
+				grants = append(grants, server.Grant{Write: subtrees.write})
+				continue
+			}
+			if b, err := hex.DecodeString(key); err != nil || len(b) != node.NodeKeyLen {
+				return nil, fmt.Errorf("%q is neither %s nor a hex node key", key, wholeFS)
+			}
+			grants = append(grants, server.Grant{Subtree: strings.ToLower(key), Write: subtrees.write})
+		}
+	}
+	return grants, nil
+}
@@ -0,0 +1,126 @@
+// Package crypt implements the key handling and authenticated encryption used
+// to keep file contents and metadata confidential from the blob and metadata
+// servers.
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// KeySize is the size in bytes of all keys.
+	KeySize = chacha20poly1305.KeySize
+
+	// NonceSize is the size in bytes of the nonce prepended to sealed values.
+	NonceSize = chacha20poly1305.NonceSizeX
+
+	// SaltSize is the size in bytes of salts for passphrase derived keys.
+	SaltSize = 16
+)
+
+var (
+	// ErrDecrypt is returned when a sealed value cannot be opened, either
+	// because it was tampered with or because the key is wrong.
+	ErrDecrypt = errors.New("could not decrypt")
+
+	// ErrEmptyKeyFile is returned when trying to use an empty file as key.
+	ErrEmptyKeyFile = errors.New("empty key file")
+)
+
+// Key is a symmetric key. Keys for specific purposes should be derived from a
+// master key with Derive, rather than using the master key directly.
+type Key [KeySize]byte
+
+// KeyFromPassphrase derives a master key from a passphrase using Argon2id. The
+// salt should be random, and shared by all clients of a file system.
+func KeyFromPassphrase(passphrase, salt []byte) Key {
+	var key Key
+	copy(key[:], argon2.IDKey(passphrase, salt, 1, 64*1024, 4, KeySize))
+	return key
+}
+
+// KeyFromFile derives a master key from the contents of a file, which should
+// contain at least KeySize bytes of random data.
+func KeyFromFile(path string) (Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return Key{}, fmt.Errorf("%q: %w", path, ErrEmptyKeyFile)
+	}
+	return blake2b.Sum256(b), nil
+}
+
+// NewSalt returns a random salt to be used with KeyFromPassphrase.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Derive returns a subkey of k for the given purpose. Different purposes yield
+// independent keys.
+func (k Key) Derive(purpose string) Key {
+	var sub Key
+	r := hkdf.New(sha256.New, k[:], nil, []byte("cryptfs "+purpose))
+	if _, err := io.ReadFull(r, sub[:]); err != nil {
+		// Can only happen when asking for too many bytes.
+		panic(err)
+	}
+	return sub
+}
+
+// Seal encrypts and authenticates plaintext, and authenticates additional, with
+// XChaCha20-Poly1305. The returned slice is the nonce followed by the
+// ciphertext. If nonce is nil, a random nonce is used; otherwise it must be
+// NonceSize bytes long and must never be reused with the same key for a
+// different plaintext.
+func Seal(key Key, nonce, plaintext, additional []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, NonceSize, NonceSize+len(plaintext)+aead.Overhead())
+	if nonce == nil {
+		if _, err := rand.Read(sealed); err != nil {
+			return nil, err
+		}
+	} else {
+		copy(sealed, nonce)
+	}
+	return aead.Seal(sealed, sealed[:NonceSize], plaintext, additional), nil
+}
+
+// Open reverses Seal, returning ErrDecrypt if the sealed value or the additional
+// data have been tampered with. An empty plaintext is opened as an empty slice,
+// not nil, as stores return empty values.
+func Open(key Key, sealed, additional []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < NonceSize+aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	plaintext := make([]byte, 0, len(sealed)-NonceSize-aead.Overhead())
+	plaintext, err = aead.Open(plaintext, sealed[:NonceSize], sealed[NonceSize:], additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
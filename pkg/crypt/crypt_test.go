@@ -0,0 +1,59 @@
+package crypt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealOpen(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	key := KeyFromPassphrase([]byte("correct horse"), []byte("battery staple"))
+	t.Run("what you seal is what you open", func(t *testing.T) {
+		sealed, err := Seal(key, nil, []byte("plaintext"), []byte("ad"))
+		require.NoError(err)
+		opened, err := Open(key, sealed, []byte("ad"))
+		require.NoError(err)
+		assert.EqualValues("plaintext", opened)
+	})
+	t.Run("empty plaintext opens as empty, not nil", func(t *testing.T) {
+		sealed, err := Seal(key, nil, []byte{}, nil)
+		require.NoError(err)
+		opened, err := Open(key, sealed, nil)
+		require.NoError(err)
+		assert.NotNil(opened)
+		assert.Empty(opened)
+	})
+	t.Run("random nonces give different ciphertexts", func(t *testing.T) {
+		sealed1, err := Seal(key, nil, []byte("plaintext"), nil)
+		require.NoError(err)
+		sealed2, err := Seal(key, nil, []byte("plaintext"), nil)
+		require.NoError(err)
+		assert.NotEqual(sealed1, sealed2)
+	})
+	t.Run("tampering is detected", func(t *testing.T) {
+		sealed, err := Seal(key, nil, []byte("plaintext"), []byte("ad"))
+		require.NoError(err)
+		_, err = Open(key, sealed, []byte("other ad"))
+		assert.ErrorIs(err, ErrDecrypt)
+		sealed[len(sealed)-1] ^= 1
+		_, err = Open(key, sealed, []byte("ad"))
+		assert.ErrorIs(err, ErrDecrypt)
+		_, err = Open(key, sealed[:NonceSize], nil)
+		assert.ErrorIs(err, ErrDecrypt)
+	})
+	t.Run("wrong key is detected", func(t *testing.T) {
+		sealed, err := Seal(key, nil, []byte("plaintext"), nil)
+		require.NoError(err)
+		_, err = Open(key.Derive("other"), sealed, nil)
+		assert.ErrorIs(err, ErrDecrypt)
+	})
+	t.Run("derived keys are independent", func(t *testing.T) {
+		assert.NotEqual(key, key.Derive("a"))
+		assert.NotEqual(key.Derive("a"), key.Derive("b"))
+		assert.Equal(key.Derive("a"), key.Derive("a"))
+	})
+}
@@ -43,14 +43,43 @@ func (e *Encoder) Encode(w io.Writer, m Message) error {
 	case KindGet:
 		e.makeroom(e.off + 2 + len(m.key))
 		e.puts(m.key)
-	case KindPut:
+	case KindPut, KindLease:
 		e.makeroom(e.off + 12 + len(m.key) + len(m.value))
 		e.puts(m.key)
 		e.puts(m.value)
 		e.put64(m.version)
-	case KindAuth, KindError:
+	case KindRevoke:
+		e.makeroom(e.off + 10 + len(m.key))
+		e.puts(m.key)
+		e.put64(m.version)
+	case KindGetLock, KindSetLock:
+		e.makeroom(e.off + 4 + len(m.key) + len(m.value))
+		e.puts(m.key)
+		e.puts(m.value)
+	case KindAuth, KindError, KindUsage:
 		e.makeroom(e.off + 2 + len(m.value))
 		e.puts(m.value)
+	case KindSubscribe:
+		// As a revocation without key.
+		e.makeroom(e.off + 10)
+		e.puts("")
+		e.put64(m.version)
+	case KindTxn, KindRevalidate, KindChange:
+		if len(m.puts) > 0xffff {
+			return ErrBadMessage
+		}
+		e.makeroom(e.off + 2)
+		e.put16(uint16(len(m.puts)))
+		if m.kind == KindChange {
+			e.makeroom(e.off + 8)
+			e.put64(m.version)
+		}
+		for _, p := range m.puts {
+			e.makeroom(e.off + 12 + len(p.key) + len(p.value))
+			e.puts(p.key)
+			e.puts(p.value)
+			e.put64(p.version)
+		}
 	default:
 		return ErrBadMessage
 	}
@@ -113,6 +142,7 @@ func (d *Decoder) Decode(r io.Reader, m *Message) error {
 	d.Lock()
 	defer d.Unlock()
 	d.err = nil
+	*m = Message{}
 	d.read(r, 5)
 	m.kind = Kind(d.get8())
 	m.tag = d.get16()
@@ -121,7 +151,7 @@ func (d *Decoder) Decode(r io.Reader, m *Message) error {
 		n := d.get16()
 		d.read(r, n)
 		m.key = d.gets(n)
-	case KindPut:
+	case KindPut, KindLease:
 		n := d.get16()
 		d.read(r, n+2)
 		m.key = d.gets(n)
@@ -129,10 +159,48 @@ func (d *Decoder) Decode(r io.Reader, m *Message) error {
 		d.read(r, n+8)
 		m.value = d.gets(n)
 		m.version = d.get64()
-	case KindAuth, KindError:
+	case KindRevoke:
+		n := d.get16()
+		d.read(r, n+8)
+		m.key = d.gets(n)
+		m.version = d.get64()
+	case KindGetLock, KindSetLock:
 		n := d.get16()
+		d.read(r, n+2)
+		m.key = d.gets(n)
+		n = d.get16()
 		d.read(r, n)
 		m.value = d.gets(n)
+	case KindAuth, KindError, KindUsage:
+		n := d.get16()
+		d.read(r, n)
+		m.value = d.gets(n)
+	case KindSubscribe:
+		n := d.get16()
+		d.read(r, n+8)
+		d.gets(n)
+		m.version = d.get64()
+	case KindTxn, KindRevalidate, KindChange:
+		count := d.get16()
+		if m.kind == KindChange {
+			d.read(r, 8)
+			m.version = d.get64()
+		}
+		// The count comes before any put has arrived, so the puts are only
+		// allocated for as they do.
+		m.puts = []Message{}
+		for ; count > 0 && d.err == nil; count-- {
+			p := Message{kind: KindPut}
+			d.read(r, 2)
+			n := d.get16()
+			d.read(r, n+2)
+			p.key = d.gets(n)
+			n = d.get16()
+			d.read(r, n+8)
+			p.value = d.gets(n)
+			p.version = d.get64()
+			m.puts = append(m.puts, p)
+		}
 	}
 	return d.err
 }
@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"io"
 	"testing"
 	"testing/quick"
 
@@ -46,6 +47,17 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+	t.Run("truncated transaction allocates no more than what arrived", func(t *testing.T) {
+		var buf bytes.Buffer
+		encoder := new(Encoder)
+		assert.Nil(t, encoder.Encode(&buf, NewTxnMessage(42, []Message{NewPutMessage(0, "a", "1", 1)})))
+		b := buf.Bytes()
+		// Claim as many puts as possible, and send only the first.
+		b[3], b[4] = 0xff, 0xff
+		var out Message
+		assert.ErrorIs(t, new(Decoder).Decode(bytes.NewReader(b), &out), io.EOF)
+		assert.LessOrEqual(t, cap(out.puts), 2)
+	})
 	t.Run("conversion to string", func(t *testing.T) {
 		assert.Equal(t,
 			"kind=GET tag=42 key=name",
@@ -67,5 +79,33 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 			"kind=AUTH tag=46 value=false",
 			NewAuthMessage(46, "").String(),
 		)
+		assert.Equal(t,
+			"kind=TXN tag=47 keys=[a b]",
+			NewTxnMessage(47, []Message{NewPutMessage(0, "a", "1", 1), NewPutMessage(0, "b", "2", 2)}).String(),
+		)
+		assert.Equal(t,
+			"kind=SETLK tag=48 key=node lock={Owner:7 Pid:42 Type:1 Start:0 End:99}",
+			NewSetLockMessage(48, "node", Lock{Owner: 7, Pid: 42, Type: 1, End: 99}).String(),
+		)
+		assert.Equal(t,
+			"kind=LEASE tag=49 key=name value=mark version=666",
+			NewLeaseMessage(49, "name", "mark", 666).String(),
+		)
+		assert.Equal(t,
+			"kind=REVOKE tag=0 key=name version=667",
+			NewRevokeMessage(0, "name", 667).String(),
+		)
+		assert.Equal(t,
+			"kind=REVALIDATE tag=50 keys=[a]",
+			NewRevalidateMessage(50, []Message{NewPutMessage(0, "a", "1", 1)}).String(),
+		)
+		assert.Equal(t,
+			"kind=SUBSCRIBE tag=51 sequence=7",
+			NewSubscribeMessage(51, 7).String(),
+		)
+		assert.Equal(t,
+			"kind=CHANGE tag=0 sequence=8 keys=[a b]",
+			NewChangeMessage(0, 8, []Message{NewPutMessage(0, "a", "1", 1), NewPutMessage(0, "b", "2", 2)}).String(),
+		)
 	})
 }
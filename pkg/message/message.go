@@ -6,6 +6,8 @@ import (
 	"unicode"
 
 	"math/rand"
+
+	"github.com/EncrypteDL/CryptFS/pkg/bits"
 )
 
 // Package message implements the wire protocol between clients and servers
@@ -45,11 +47,71 @@ const (
 	// not match, the server response will be of KindError.
 	KindAuth
 
+	// KindUsage is sent from client to server to ask about the capacity and
+	// contents of the server's store, with a zero usage. The server responds with
+	// a message of the same kind carrying the usage, or with an error message.
+	KindUsage
+
+	// KindTxn is sent from client to server with a number of puts to be applied
+	// all or none, e.g., to move an entry from one directory to another. The
+	// server responds with the exact same message if all puts are accepted, or
+	// with an error message if any is stale, in which case none is applied. The
+	// server fans out the accepted puts one by one, as messages of KindPut.
+	KindTxn
+
+	// KindGetLock is sent from client to server with a lock on the node at the
+	// given key, to ask whether it could be taken. The server responds with a
+	// message of the same kind carrying the first conflicting lock, or the same
+	// lock with an unlock type if there is none.
+	KindGetLock
+
+	// KindSetLock is sent from client to server to take or release a lock on the
+	// node at the given key. The server responds with the exact same message if
+	// it is granted, or with an error message if it conflicts with a lock held by
+	// someone else. Locks are owned by the connection they were taken on, and
+	// released when it is closed.
+	KindSetLock
+
+	// KindLease is sent from client to server to get the latest version of the
+	// value for a given key, as for KindGet, and a read lease on it. The server
+	// responds with a message of the same kind carrying the value, or with an
+	// error message. While the lease is held, the client can trust its copy of
+	// the value: the server revokes the lease before accepting a put from some
+	// other client. Clients get a lease on the keys they put, too.
+	KindLease
+
+	// KindRevoke is sent from server to client, with a zero tag, to revoke its
+	// lease on a key because a put of the given version is about to be
+	// accepted. The client drops its copy of the value and sends back the exact
+	// same message as acknowledgement. Clients that don't in time are
+	// disconnected, and lose all their leases.
+	KindRevoke
+
+	// KindRevalidate is sent from client to server after reconnecting, with the
+	// versions of the values it had leases on, to catch up with the changes made
+	// since. The server responds with a message of the same kind carrying the
+	// latest version for each key, zero if not found, and grants the client a
+	// lease again on those that didn't change.
+	KindRevalidate
+
+	// KindSubscribe is sent from client to server to be streamed the changes
+	// committed from the given sequence number on, including those committed
+	// from then on. The server responds with a message of the same kind carrying
+	// the sequence number of the last change committed, or with an error message
+	// if it doesn't keep a change log. A new subscription replaces the previous
+	// one on the same connection.
+	KindSubscribe
+
+	// KindChange is sent from server to client, with a zero tag, for each change
+	// the client subscribed to, in order. It carries the sequence number of the
+	// change and its puts, all of KindPut.
+	KindChange
+
 	kindCount
 )
 
 // String implement fmt.Stringer.
-func (k Kind) STring() string {
+func (k Kind) String() string {
 	switch k {
 	case KindGet:
 		return "GET"
@@ -61,6 +123,24 @@ func (k Kind) STring() string {
 		return "AUTH"
 	case KindError:
 		return "ERROR"
+	case KindUsage:
+		return "USAGE"
+	case KindTxn:
+		return "TXN"
+	case KindGetLock:
+		return "GETLK"
+	case KindSetLock:
+		return "SETLK"
+	case KindLease:
+		return "LEASE"
+	case KindRevoke:
+		return "REVOKE"
+	case KindRevalidate:
+		return "REVALIDATE"
+	case KindSubscribe:
+		return "SUBSCRIBE"
+	case KindChange:
+		return "CHANGE"
 	default:
 		return "UNKNOWN"
 	}
@@ -77,15 +157,21 @@ type Message struct {
 	// reserved for broadcast messages (those that are not responses to requests).
 	tag uint16
 
-	//The key to get or put. Meaningful for get and put messages only.
+	//The key to get or put. Meaningful for get, put and lock messages only.
 	key string
 
 	// The value for a put message; doubles as a textual description of the error
-	// for error messages, and as the password in auth messages.
+	// for error messages, as the password in auth messages, and as the encoded
+	// payload of usage and lock messages.
 	value string
 
-	//version of the value. Meaningful only for put message
+	//version of the value. Meaningful only for put message; doubles as the
+	// sequence number of subscribe and change messages.
 	version uint64
+
+	// The puts of a transaction, all of KindPut. Meaningful only for txn and
+	// change messages, and for revalidate messages, where they carry no value.
+	puts []Message
 }
 
 func repr(any string) string {
@@ -115,8 +201,28 @@ func (m Message) String() string {
 		return fmt.Sprintf("kind=%v tag=%d value=%s", m.kind, m.tag, repr(m.value))
 	case KindAuth:
 		return fmt.Sprintf("kind=%v tag=%d value=%t", m.kind, m.tag, m.value != "")
+	case KindUsage:
+		return fmt.Sprintf("kind=%v tag=%d usage=%+v", m.kind, m.tag, m.Usage())
+	case KindTxn, KindRevalidate:
+		keys := make([]string, len(m.puts))
+		for i, p := range m.puts {
+			keys[i] = repr(p.key)
+		}
+		return fmt.Sprintf("kind=%v tag=%d keys=%v", m.kind, m.tag, keys)
+	case KindGetLock, KindSetLock:
+		return fmt.Sprintf("kind=%v tag=%d key=%s lock=%+v", m.kind, m.tag, repr(m.key), m.Lock())
+	case KindRevoke:
+		return fmt.Sprintf("kind=%v tag=%d key=%s version=%d", m.kind, m.tag, repr(m.key), m.version)
+	case KindSubscribe:
+		return fmt.Sprintf("kind=%v tag=%d sequence=%d", m.kind, m.tag, m.version)
+	case KindChange:
+		keys := make([]string, len(m.puts))
+		for i, p := range m.puts {
+			keys[i] = repr(p.key)
+		}
+		return fmt.Sprintf("kind=%v tag=%d sequence=%d keys=%v", m.kind, m.tag, m.version, keys)
 	default:
-		// KindPut and unknown messages use all fields.
+		// KindPut, KindLease and unknown messages use all fields.
 		return fmt.Sprintf("kind=%v tag=%d key=%s value=%s version=%d", m.kind, m.tag, repr(m.key), repr(m.value), m.version)
 	}
 }
@@ -134,10 +240,11 @@ func (m Message) Tag() uint16 {
 }
 
 // Key returns a key-value pair's key from the message. Call only for
-// KindGet and KindPut, else it'll panic.
+// KindGet, KindPut, KindGetLock, KindSetLock, KindLease and KindRevoke, else
+// it'll panic.
 func (m Message) Key() string {
 	switch m.kind {
-	case KindGet, KindPut:
+	case KindGet, KindPut, KindGetLock, KindSetLock, KindLease, KindRevoke:
 		return m.key
 	default:
 		panic(m.accessorPanic("Key"))
@@ -145,27 +252,84 @@ func (m Message) Key() string {
 }
 
 // Value returns a key-value pair's value from the message. Call only for
-// KindAuth, KindError and KindPut, else it'll panic.
+// KindAuth, KindError, KindPut and KindLease, else it'll panic.
 func (m Message) Value() string {
 	switch m.kind {
-	case KindAuth, KindError, KindPut:
+	case KindAuth, KindError, KindPut, KindLease:
 		return m.value
 	default:
 		panic(m.accessorPanic("Value"))
 	}
 }
 
-// Version returns the version of a key-value pair. Call only for KindPut
-// messages, or it'll panic.
+// Version returns the version of a key-value pair. Call only for KindPut,
+// KindLease and KindRevoke messages, or it'll panic.
 func (m Message) Version() uint64 {
 	switch m.kind {
-	case KindPut:
+	case KindPut, KindLease, KindRevoke:
 		return m.version
 	default:
 		panic(m.accessorPanic("Version"))
 	}
 }
 
+// Usage returns the usage carried by the message. Call only for KindUsage
+// messages, or it'll panic.
+func (m Message) Usage() Usage {
+	if m.kind != KindUsage {
+		panic(m.accessorPanic("Usage"))
+	}
+	var u Usage
+	if len(m.value) < usageLen {
+		return u
+	}
+	b := []byte(m.value)
+	u.Capacity, b = bits.Get64(b)
+	u.Available, b = bits.Get64(b)
+	u.Used, b = bits.Get64(b)
+	u.Count, _ = bits.Get64(b)
+	return u
+}
+
+// Lock returns the lock carried by the message. Call only for KindGetLock and
+// KindSetLock messages, or it'll panic.
+func (m Message) Lock() Lock {
+	if m.kind != KindGetLock && m.kind != KindSetLock {
+		panic(m.accessorPanic("Lock"))
+	}
+	var l Lock
+	if len(m.value) < lockLen {
+		return l
+	}
+	b := []byte(m.value)
+	l.Owner, b = bits.Get64(b)
+	l.Pid, b = bits.Get32(b)
+	l.Type, b = bits.Get32(b)
+	l.Start, b = bits.Get64(b)
+	l.End, _ = bits.Get64(b)
+	return l
+}
+
+// Puts returns the puts of a transaction or change, or the keys and versions of
+// a revalidation. Call only for KindTxn, KindRevalidate and KindChange
+// messages, or it'll panic.
+func (m Message) Puts() []Message {
+	if m.kind != KindTxn && m.kind != KindRevalidate && m.kind != KindChange {
+		panic(m.accessorPanic("Puts"))
+	}
+	return m.puts
+}
+
+// Sequence returns the sequence number of a change, or the one a subscription
+// starts from. Call only for KindSubscribe and KindChange messages, or it'll
+// panic.
+func (m Message) Sequence() uint64 {
+	if m.kind != KindSubscribe && m.kind != KindChange {
+		panic(m.accessorPanic("Sequence"))
+	}
+	return m.version
+}
+
 func (m Message) accessorPanic(accessorName string) string {
 	return fmt.Sprintf("cannot call .%s for message of kind %v", accessorName, m.kind)
 }
@@ -190,6 +354,28 @@ func NewPutMessage(tag uint16, key string, value string, version uint64) Message
 	}
 }
 
+// NewLeaseMessage constructs a message of KindLease kind. Requests carry only
+// the key.
+func NewLeaseMessage(tag uint16, key string, value string, version uint64) Message {
+	return Message{
+		kind:    KindLease,
+		tag:     tag,
+		key:     key,
+		value:   value,
+		version: version,
+	}
+}
+
+// NewRevokeMessage constructs a message of KindRevoke kind.
+func NewRevokeMessage(tag uint16, key string, version uint64) Message {
+	return Message{
+		kind:    KindRevoke,
+		tag:     tag,
+		key:     key,
+		version: version,
+	}
+}
+
 // NewErrorMessage constructs a message of KindError kind.
 func NewErrorMessage(tag uint16, message string) Message {
 	return Message{
@@ -208,6 +394,128 @@ func NewAuthMessage(tag uint16, password string) Message {
 	}
 }
 
+// Usage is the payload of KindUsage messages.
+type Usage struct {
+	// Bytes of the device the store is on, and bytes still available to it.
+	// Zero if unknown.
+	Capacity  uint64
+	Available uint64
+
+	// Bytes used by values, and number of keys.
+	Used  uint64
+	Count uint64
+}
+
+const usageLen = 32
+
+// NewUsageMessage constructs a message of KindUsage kind.
+func NewUsageMessage(tag uint16, u Usage) Message {
+	buf := make([]byte, usageLen)
+	b := bits.Put64(buf, u.Capacity)
+	b = bits.Put64(b, u.Available)
+	b = bits.Put64(b, u.Used)
+	bits.Put64(b, u.Count)
+	return Message{
+		kind:  KindUsage,
+		tag:   tag,
+		value: string(buf),
+	}
+}
+
+// NewTxnMessage constructs a message of KindTxn kind, out of messages of
+// KindPut kind. Their tags are ignored.
+func NewTxnMessage(tag uint16, puts []Message) Message {
+	m := Message{
+		kind: KindTxn,
+		tag:  tag,
+		puts: make([]Message, len(puts)),
+	}
+	for i, p := range puts {
+		m.puts[i] = NewPutMessage(0, p.Key(), p.Value(), p.Version())
+	}
+	return m
+}
+
+// Lock is the payload of KindGetLock and KindSetLock messages.
+type Lock struct {
+	// Identifies the holder of the lock among those sharing a connection, and
+	// the process that took it.
+	Owner uint64
+	Pid   uint32
+
+	// One of F_RDLCK, F_WRLCK and F_UNLCK, as in fcntl(2).
+	Type uint32
+
+	// The first and last byte locked, inclusive.
+	Start uint64
+	End   uint64
+}
+
+const lockLen = 32
+
+func newLockMessage(kind Kind, tag uint16, key string, l Lock) Message {
+	buf := make([]byte, lockLen)
+	b := bits.Put64(buf, l.Owner)
+	b = bits.Put32(b, l.Pid)
+	b = bits.Put32(b, l.Type)
+	b = bits.Put64(b, l.Start)
+	bits.Put64(b, l.End)
+	return Message{
+		kind:  kind,
+		tag:   tag,
+		key:   key,
+		value: string(buf),
+	}
+}
+
+// NewGetLockMessage constructs a message of KindGetLock kind.
+func NewGetLockMessage(tag uint16, key string, l Lock) Message {
+	return newLockMessage(KindGetLock, tag, key, l)
+}
+
+// NewSetLockMessage constructs a message of KindSetLock kind.
+func NewSetLockMessage(tag uint16, key string, l Lock) Message {
+	return newLockMessage(KindSetLock, tag, key, l)
+}
+
+// NewRevalidateMessage constructs a message of KindRevalidate kind, out of
+// messages of KindPut kind. Only their keys and versions are kept.
+func NewRevalidateMessage(tag uint16, versions []Message) Message {
+	m := Message{
+		kind: KindRevalidate,
+		tag:  tag,
+		puts: make([]Message, len(versions)),
+	}
+	for i, v := range versions {
+		m.puts[i] = NewPutMessage(0, v.Key(), "", v.Version())
+	}
+	return m
+}
+
+// NewSubscribeMessage constructs a message of KindSubscribe kind.
+func NewSubscribeMessage(tag uint16, sequence uint64) Message {
+	return Message{
+		kind:    KindSubscribe,
+		tag:     tag,
+		version: sequence,
+	}
+}
+
+// NewChangeMessage constructs a message of KindChange kind, out of messages of
+// KindPut kind. Their tags are ignored.
+func NewChangeMessage(tag uint16, sequence uint64, puts []Message) Message {
+	m := Message{
+		kind:    KindChange,
+		tag:     tag,
+		version: sequence,
+		puts:    make([]Message, len(puts)),
+	}
+	for i, p := range puts {
+		m.puts[i] = NewPutMessage(0, p.Key(), p.Value(), p.Version())
+	}
+	return m
+}
+
 // ForBroadcast returns a copy of the message that's suitable to be broadcasted to
 // many connections.
 func (m Message) ForBroadcast() Message {
@@ -251,15 +559,65 @@ func (Message) Generate(rand *rand.Rand, size int) reflect.Value {
 	case KindGet:
 		rand.Read(b)
 		m.key = string(b)
-	case KindPut:
+	case KindPut, KindLease:
 		rand.Read(b)
 		m.key = string(b)
 		rand.Read(b)
 		m.value = string(b)
 		m.version = rand.Uint64()
+	case KindRevoke:
+		rand.Read(b)
+		m.key = string(b)
+		m.version = rand.Uint64()
 	case KindAuth, KindError:
 		rand.Read(b)
 		m.value = string(b)
+	case KindUsage:
+		m = NewUsageMessage(m.tag, Usage{
+			Capacity:  rand.Uint64(),
+			Available: rand.Uint64(),
+			Used:      rand.Uint64(),
+			Count:     rand.Uint64(),
+		})
+	case KindTxn:
+		puts := make([]Message, 1+rand.Intn(4))
+		for i := range puts {
+			key := make([]byte, rand.Intn(size+1))
+			value := make([]byte, rand.Intn(size+1))
+			rand.Read(key)
+			rand.Read(value)
+			puts[i] = NewPutMessage(0, string(key), string(value), rand.Uint64())
+		}
+		m = NewTxnMessage(m.tag, puts)
+	case KindRevalidate:
+		versions := make([]Message, rand.Intn(4))
+		for i := range versions {
+			key := make([]byte, rand.Intn(size+1))
+			rand.Read(key)
+			versions[i] = NewPutMessage(0, string(key), "", rand.Uint64())
+		}
+		m = NewRevalidateMessage(m.tag, versions)
+	case KindSubscribe:
+		m = NewSubscribeMessage(m.tag, rand.Uint64())
+	case KindChange:
+		puts := make([]Message, rand.Intn(4))
+		for i := range puts {
+			key := make([]byte, rand.Intn(size+1))
+			value := make([]byte, rand.Intn(size+1))
+			rand.Read(key)
+			rand.Read(value)
+			puts[i] = NewPutMessage(0, string(key), string(value), rand.Uint64())
+		}
+		m = NewChangeMessage(m.tag, rand.Uint64(), puts)
+	case KindGetLock, KindSetLock:
+		rand.Read(b)
+		m = newLockMessage(m.kind, m.tag, string(b), Lock{
+			Owner: rand.Uint64(),
+			Pid:   rand.Uint32(),
+			Type:  rand.Uint32() % 3,
+			Start: rand.Uint64(),
+			End:   rand.Uint64(),
+		})
 	default:
 		panic("programmer error")
 	}
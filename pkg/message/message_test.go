@@ -41,3 +41,45 @@ func TestDecoderRead(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUsageMessage(t *testing.T) {
+	f := func(capacity, available, used, count uint64) bool {
+		u := Usage{
+			Capacity:  capacity,
+			Available: available,
+			Used:      used,
+			Count:     count,
+		}
+		return NewUsageMessage(RandomTag(), u).Usage() == u
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockMessage(t *testing.T) {
+	f := func(owner uint64, pid, typ uint32, start, end uint64) bool {
+		l := Lock{
+			Owner: owner,
+			Pid:   pid,
+			Type:  typ,
+			Start: start,
+			End:   end,
+		}
+		return NewGetLockMessage(RandomTag(), RandomString(), l).Lock() == l &&
+			NewSetLockMessage(RandomTag(), RandomString(), l).Lock() == l
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	f := func(sequence uint64) bool {
+		return NewSubscribeMessage(RandomTag(), sequence).Sequence() == sequence &&
+			NewChangeMessage(0, sequence, nil).Sequence() == sequence
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
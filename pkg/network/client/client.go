@@ -3,6 +3,7 @@ package client
 import (
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -15,11 +16,26 @@ import (
 var (
 	//ErrTimeout is the error returned when  things time out
 	ErrTimeout = errors.New("timeout")
+
+	// ErrClosed is returned when using a client after calling Close
+	ErrClosed = errors.New("client closed")
+
+	// ErrUnauthorized is returned when the server refuses the password
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrWaitingToReconnect is returned when using a client that couldn't
+	// connect recently, before it tries again
+	ErrWaitingToReconnect = errors.New("waiting to reconnect")
 )
 
 type options struct {
 	address            string
+	tlsConfig          *tls.Config
 	fallBackToPlainTCP bool
+	user               string
+	password           string
+	minBackoff         time.Duration
+	maxBackoff         time.Duration
 }
 
 // Option is a client functional option for configuring the client
@@ -32,13 +48,48 @@ func WithAddress(value string) Option {
 	}
 }
 
-// WithFallbackToPlainTCP configures the client to fallback to plain unsecured TCP
+// WithTLSConfig sets the TLS configuration to dial tls:// addresses with, e.g.,
+// to trust the certificate of a server that's not signed by a known authority
+func WithTLSConfig(value *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = value
+	}
+}
+
+// WithFallbackToPlainTCP configures the client to fallback to plain unsecured
+// TCP. It doesn't, if a password is set, so that it's not sent in clear
 func WithFallbackToPlainTCP() Option {
 	return func(o *options) {
 		o.fallBackToPlainTCP = true
 	}
 }
 
+// WithPassword sets the password to authorize the client with, each time it
+// connects
+func WithPassword(value string) Option {
+	return func(o *options) {
+		o.password = value
+	}
+}
+
+// WithUser sets the account to authorize the client as, with the password set
+// or a token of the account. Without it, the client authorizes with the
+// password of the server
+func WithUser(value string) Option {
+	return func(o *options) {
+		o.user = value
+	}
+}
+
+// WithBackoff sets how long to wait before trying to connect again after
+// failing to, doubling from min up to max with each failure in a row
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
 // Client is a low-level metadata server client that can send and receive
 // message.Message's. It can be used to build higher level clients, e.g., a
 // storage.VersionedStore implementation.
@@ -51,14 +102,21 @@ type Client struct {
 	encoder *message.Encoder
 	decoder *message.Decoder
 
-	mu   sync.Mutex
-	conn net.Conn
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+
+	// Connection attempts failed in a row, and when to try again.
+	failures int
+	retryAt  time.Time
 }
 
 // New creates an instances of the client with the provided options
 func New(opts ...Option) *Client {
 	var c Client
 	c.opts.address = "tcp://127.0.0.1:8000"
+	c.opts.minBackoff = 100 * time.Millisecond
+	c.opts.maxBackoff = 30 * time.Second
 	c.encoder = new(message.Encoder)
 	c.decoder = new(message.Decoder)
 	for _, o := range opts {
@@ -67,11 +125,32 @@ func New(opts ...Option) *Client {
 	return &c
 }
 
-// Close closes the client connection
+// Close closes the client connection. The client won't reconnect after that.
 func (c *Client) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
 	c.closeBoth(nil)
 }
 
+// Connect dials the server, unless the client is connected already. There's no
+// need to call Connect before Send or Receive, which connect as needed.
+func (c *Client) Connect() error {
+	_, err := c.getCachedConn()
+	return err
+}
+
+// RetryIn returns how long until the client tries to connect again, zero if
+// connected or ready to.
+func (c *Client) RetryIn() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		return 0
+	}
+	return max(time.Until(c.retryAt), 0)
+}
+
 func (c *Client) closeBoth(cached net.Conn) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -131,21 +210,79 @@ func (c *Client) doWithConn(consumer func(net.Conn) error) error {
 func (c *Client) getCachedConn() (conn net.Conn, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
 	if c.conn != nil {
 		return c.conn, nil
 	}
-	if strings.HasPrefix(c.opts.address, "tls://") {
-		conn, err = tls.Dial("tcp", strings.TrimPrefix(c.opts.address, "tls://"), nil)
-		if err != nil && c.opts.fallBackToPlainTCP {
-			log.WithField("err", err).Warn("Could not dial using TLS, trying plain TCP")
-			conn, err = net.Dial("tcp", c.opts.address)
+	if wait := time.Until(c.retryAt); wait > 0 {
+		return nil, fmt.Errorf("%v left: %w", wait.Round(time.Millisecond), ErrWaitingToReconnect)
+	}
+	conn, err = c.dial()
+	if err == nil && c.opts.password != "" {
+		if err = c.authorize(conn); err != nil {
+			_ = conn.Close()
 		}
-	} else {
-		conn, err = net.Dial("tcp", c.opts.address)
 	}
 	if err != nil {
+		c.failures++
+		backoff := c.opts.maxBackoff
+		if c.failures < 32 {
+			backoff = min(c.opts.minBackoff<<(c.failures-1), c.opts.maxBackoff)
+		}
+		c.retryAt = time.Now().Add(backoff)
+		log.WithFields(log.Fields{
+			"err":      err,
+			"failures": c.failures,
+			"backoff":  backoff,
+		}).Debug("Could not connect")
 		return nil, err
 	}
+	if c.failures > 0 {
+		log.WithField("failures", c.failures).Info("Reconnected")
+	}
+	c.failures = 0
 	c.conn = conn
 	return conn, nil
 }
+
+// Call with lock held.
+func (c *Client) dial() (conn net.Conn, err error) {
+	if strings.HasPrefix(c.opts.address, "tls://") {
+		conn, err = tls.Dial("tcp", strings.TrimPrefix(c.opts.address, "tls://"), c.opts.tlsConfig)
+		if err != nil && c.opts.fallBackToPlainTCP && c.opts.password == "" {
+			log.WithField("err", err).Warn("Could not dial using TLS, trying plain TCP")
+			conn, err = net.Dial("tcp", c.opts.address)
+		}
+		return conn, err
+	}
+	return net.Dial("tcp", c.opts.address)
+}
+
+// authorize does the auth message exchange on a new connection, before anyone
+// else gets to use it.
+func (c *Client) authorize(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	secret := c.opts.password
+	if c.opts.user != "" {
+		secret = c.opts.user + ":" + secret
+	}
+	if err := new(message.Encoder).Encode(conn, message.NewAuthMessage(1, secret)); err != nil {
+		return err
+	}
+	var m message.Message
+	if err := new(message.Decoder).Decode(conn, &m); err != nil {
+		return err
+	}
+	switch m.Kind() {
+	case message.KindAuth:
+		return conn.SetDeadline(time.Time{})
+	case message.KindError:
+		return fmt.Errorf("%s: %w", m.Value(), ErrUnauthorized)
+	default:
+		return fmt.Errorf("unexpected response to auth: %v", m)
+	}
+}
@@ -1,2 +1,104 @@
 package client
 
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/EncrypteDL/CryptFS/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer accepts connections, sending each message it gets on them to
+// received and answering auth messages with the given password.
+func fakeServer(t *testing.T, password string) (address string, received chan message.Message, conns chan net.Conn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	received = make(chan message.Message, 16)
+	conns = make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				var encoder message.Encoder
+				var decoder message.Decoder
+				for {
+					var m message.Message
+					if err := decoder.Decode(conn, &m); err != nil {
+						return
+					}
+					received <- m
+					if m.Kind() != message.KindAuth {
+						continue
+					}
+					response := message.NewAuthMessage(m.Tag(), "")
+					if m.Value() != password {
+						response = message.NewErrorMessage(m.Tag(), "go away, bad password")
+					}
+					if err := encoder.Encode(conn, response); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received, conns
+}
+
+func TestClient(t *testing.T) {
+	t.Run("authorizes on every connection", func(t *testing.T) {
+		address, received, conns := fakeServer(t, "s3cr3t")
+		c := New(WithAddress(address), WithPassword("s3cr3t"))
+		defer c.Close()
+
+		for i := 0; i < 2; i++ {
+			require.NoError(t, c.Send(message.NewGetMessage(42, "key")))
+			auth := <-received
+			assert.Equal(t, message.KindAuth, auth.Kind())
+			assert.Equal(t, "s3cr3t", auth.Value())
+			assert.Equal(t, message.NewGetMessage(42, "key"), <-received)
+
+			// The server goes away, the client connects again.
+			(<-conns).Close()
+			var m message.Message
+			assert.Error(t, c.Receive(&m))
+		}
+	})
+
+	t.Run("authorizes as a user", func(t *testing.T) {
+		address, received, _ := fakeServer(t, "alice:s3cr3t")
+		c := New(WithAddress(address), WithUser("alice"), WithPassword("s3cr3t"))
+		defer c.Close()
+		require.NoError(t, c.Connect())
+		assert.Equal(t, "alice:s3cr3t", (<-received).Value())
+	})
+
+	t.Run("fails with a bad password", func(t *testing.T) {
+		address, _, _ := fakeServer(t, "s3cr3t")
+		c := New(WithAddress(address), WithPassword("guess"))
+		defer c.Close()
+		assert.ErrorIs(t, c.Connect(), ErrUnauthorized)
+	})
+
+	t.Run("backs off after failing to connect", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		address := ln.Addr().String()
+		require.NoError(t, ln.Close())
+
+		c := New(WithAddress(address), WithBackoff(time.Hour, time.Hour))
+		defer c.Close()
+		err = c.Connect()
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrWaitingToReconnect))
+		assert.ErrorIs(t, c.Connect(), ErrWaitingToReconnect)
+		assert.Greater(t, c.RetryIn(), 59*time.Minute)
+	})
+}
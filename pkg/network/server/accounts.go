@@ -0,0 +1,262 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrAccountExists is returned when adding an account with the name of an
+	// existing one.
+	ErrAccountExists = errors.New("account exists")
+
+	// ErrNoSuchAccount is returned when there's no account with the given name.
+	ErrNoSuchAccount = errors.New("no such account")
+
+	// ErrBadAccountName is returned for empty names, and names with a colon,
+	// which separates the name from the secret in auth messages.
+	ErrBadAccountName = errors.New("bad account name")
+)
+
+// Accounts are the principals that can authorize with a metadata server, as
+// kept in a JSON file.
+type Accounts struct {
+	Users []*Account `json:"users"`
+}
+
+// Account is a principal that can authorize with a password or any of its
+// tokens, and is granted access to parts of the file system.
+type Account struct {
+	Name string `json:"name"`
+
+	// Bcrypt hash of the password, if any.
+	PasswordHash string `json:"password_hash,omitempty"`
+
+	// Hex SHA-256 hashes of the tokens. Tokens are random, so there's no need
+	// for a slow hash.
+	TokenHashes []string `json:"token_hashes,omitempty"`
+
+	Grants []Grant `json:"grants,omitempty"`
+}
+
+// Grant gives read, and maybe write, access to a subtree of the file system.
+type Grant struct {
+	// The hex key of the node at the root of the subtree, or empty for the
+	// whole file system, including values that aren't nodes.
+	Subtree string `json:"subtree,omitempty"`
+	Write   bool   `json:"write,omitempty"`
+}
+
+// LoadAccounts reads the accounts from the given file. A file that doesn't
+// exist has no accounts.
+func LoadAccounts(file string) (*Accounts, error) {
+	var a Accounts
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return &a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %w", file, err)
+	}
+	return &a, nil
+}
+
+// Save writes the accounts to the given file, replacing it at once, so that a
+// server reading it never sees it halfway written.
+func (a *Accounts) Save(file string) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Find returns the account with the given name, or nil if there's none.
+func (a *Accounts) Find(name string) *Account {
+	for _, account := range a.Users {
+		if account.Name == name {
+			return account
+		}
+	}
+	return nil
+}
+
+// Add adds an account with the given name and no way to authorize yet.
+func (a *Accounts) Add(name string) (*Account, error) {
+	if name == "" || strings.Contains(name, ":") {
+		return nil, fmt.Errorf("%q: %w", name, ErrBadAccountName)
+	}
+	if a.Find(name) != nil {
+		return nil, fmt.Errorf("%q: %w", name, ErrAccountExists)
+	}
+	account := &Account{Name: name}
+	a.Users = append(a.Users, account)
+	return account, nil
+}
+
+// Remove removes the account with the given name.
+func (a *Accounts) Remove(name string) error {
+	for i, account := range a.Users {
+		if account.Name == name {
+			a.Users = append(a.Users[:i], a.Users[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%q: %w", name, ErrNoSuchAccount)
+}
+
+// SetPassword sets the password the account can authorize with.
+func (account *Account) SetPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	account.PasswordHash = string(hash)
+	return nil
+}
+
+// RotateToken returns a new token the account can authorize with, instead of
+// any it had.
+func (account *Account) RotateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	account.TokenHashes = []string{hashToken(token)}
+	return token, nil
+}
+
+// Authorize tells whether the secret is the password or one of the tokens of
+// the account.
+func (account *Account) Authorize(secret string) bool {
+	hash := hashToken(secret)
+	for _, h := range account.TokenHashes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			return true
+		}
+	}
+	return account.PasswordHash != "" &&
+		bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(secret)) == nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Tree tells where nodes are in the file system, so that grants on subtrees
+// can be enforced.
+type Tree interface {
+	// IsNode should tell whether the key is that of a node.
+	IsNode(key []byte) bool
+
+	// Within should tell whether the node with the given key is the given root
+	// or one of its descendants, as committed.
+	Within(root, key []byte) bool
+
+	// Adopted should return the keys of the nodes the given mutations add as
+	// children of nodes they aren't committed children of.
+	Adopted(mutations []storage.Mutation) [][]byte
+
+	// Exists should tell whether a node with the given key is committed.
+	Exists(key []byte) bool
+
+	// Commit is called with the mutations of each put and transaction
+	// committed.
+	Commit(mutations []storage.Mutation)
+}
+
+// grantedPermissions implement storage.Permissions for the grants of an
+// account. Values that aren't nodes can only be read with a grant on the whole
+// file system, but for the shared ones, which can be read with any grant, and
+// only written with a grant on the whole file system. Without a tree, grants on
+// subtrees give no access to nodes at all.
+type grantedPermissions struct {
+	grants []Grant
+	tree   Tree
+	shared map[string]bool
+}
+
+func (p *grantedPermissions) CanRead(key []byte) bool {
+	if storage.Reserved(key) {
+		return false
+	}
+	for _, g := range p.grants {
+		if p.covers(g, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanWrite tells whether the mutations may be committed together. Nodes are
+// only written where committed, so that a transaction can't move a node into
+// a subtree that can be written to write it there. Nodes added as children
+// must be writable where they are too, unless they're new.
+func (p *grantedPermissions) CanWrite(mutations []storage.Mutation) bool {
+	adopted := make(map[string]bool)
+	if p.tree != nil {
+		for _, child := range p.tree.Adopted(mutations) {
+			if !p.writable(child) && p.tree.Exists(child) {
+				return false
+			}
+			adopted[string(child)] = true
+		}
+	}
+	for _, m := range mutations {
+		if storage.Reserved(m.Key) {
+			return false
+		}
+		if !p.writable(m.Key) && !(adopted[string(m.Key)] && !p.tree.Exists(m.Key)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *grantedPermissions) writable(key []byte) bool {
+	for _, g := range p.grants {
+		if g.Write && p.covers(g, key, true) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *grantedPermissions) covers(g Grant, key []byte, write bool) bool {
+	switch {
+	case g.Subtree == "":
+		return true
+	case p.tree == nil || !p.tree.IsNode(key):
+		return !write && p.shared[string(key)]
+	}
+	root, err := hex.DecodeString(g.Subtree)
+	return err == nil && p.tree.Within(root, key)
+}
@@ -0,0 +1,65 @@
+package server_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/network/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccounts(t *testing.T) {
+	t.Run("add and remove", func(t *testing.T) {
+		accounts := new(server.Accounts)
+		_, err := accounts.Add("alice")
+		require.Nil(t, err)
+		_, err = accounts.Add("alice")
+		assert.ErrorIs(t, err, server.ErrAccountExists)
+		_, err = accounts.Add("al:ce")
+		assert.ErrorIs(t, err, server.ErrBadAccountName)
+		assert.NotNil(t, accounts.Find("alice"))
+
+		require.Nil(t, accounts.Remove("alice"))
+		assert.Nil(t, accounts.Find("alice"))
+		assert.ErrorIs(t, accounts.Remove("alice"), server.ErrNoSuchAccount)
+	})
+
+	t.Run("authorize with a password or the latest token", func(t *testing.T) {
+		account := &server.Account{Name: "alice"}
+		assert.False(t, account.Authorize(""))
+		require.Nil(t, account.SetPassword("s3cr3t"))
+		assert.True(t, account.Authorize("s3cr3t"))
+		assert.False(t, account.Authorize("guess"))
+
+		old, err := account.RotateToken()
+		require.Nil(t, err)
+		assert.True(t, account.Authorize(old))
+		token, err := account.RotateToken()
+		require.Nil(t, err)
+		assert.NotEqual(t, old, token)
+		assert.True(t, account.Authorize(token))
+		assert.False(t, account.Authorize(old))
+		assert.True(t, account.Authorize("s3cr3t"))
+	})
+
+	t.Run("save and load", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "accounts.json")
+		loaded, err := server.LoadAccounts(file)
+		require.Nil(t, err)
+		assert.Empty(t, loaded.Users)
+
+		accounts := new(server.Accounts)
+		account, err := accounts.Add("alice")
+		require.Nil(t, err)
+		token, err := account.RotateToken()
+		require.Nil(t, err)
+		account.Grants = []server.Grant{{Subtree: "00ff", Write: true}}
+		require.Nil(t, accounts.Save(file))
+
+		loaded, err = server.LoadAccounts(file)
+		require.Nil(t, err)
+		assert.Equal(t, accounts, loaded)
+		assert.True(t, loaded.Find("alice").Authorize(token))
+	})
+}
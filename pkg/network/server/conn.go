@@ -3,9 +3,12 @@ package server
 import (
 	"io"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/EncrypteDL/CryptFS/pkg/message"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	sync "github.com/sasha-s/go-deadlock"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -14,26 +17,45 @@ type serverConn struct {
 	id     uint16
 	server *Server
 
-	conn    net.Conn
+	conn net.Conn
+	// Held while writing, along with the deadline of the write.
+	writeMu sync.Mutex
 	encoder *message.Encoder
 	decoder *message.Decoder
+	locks   storage.Locker
 
 	authorized bool
+	// The account the client authorized as, if any, and what it may do. Nil
+	// permissions, as when authorizing with the server password, allow
+	// everything.
+	user  string
+	perms storage.Permissions
+
+	// Closed to stop streaming changes. Only touched while serving requests, or
+	// once done.
+	stopFeed chan struct{}
 }
 
 func (s *Server) wrapConn(conn net.Conn) *serverConn {
+	id := s.connIDs.Next()
 	return &serverConn{
-		id:      s.connIDs.Next(),
+		id:      id,
 		server:  s,
 		conn:    conn,
 		encoder: new(message.Encoder),
 		decoder: new(message.Decoder),
+		locks:   s.locks.Session(id),
 	}
 }
 
 // To be run in a separate goroutine, which will exit when the connection is
 // closed or reset.
 func (sc *serverConn) handleInput() {
+	// Requests are handled apart, so that acknowledgements of revocations are
+	// read while a request is waiting for them.
+	requests := make(chan message.Message, 1024)
+	done := make(chan struct{})
+	go sc.serve(requests, done)
 	for {
 		var input message.Message
 		if err := sc.decoder.Decode(sc.conn, &input); err != nil {
@@ -57,39 +79,120 @@ func (sc *serverConn) handleInput() {
 			logger.Warn("Unknown error decoding")
 			break
 		}
+		if input.Kind() == message.KindRevoke {
+			// Handled right away, as requests might be waiting for it.
+			sc.server.acknowledgeRevocation(sc, input.Key())
+			continue
+		}
+		requests <- input
+	}
+	close(requests)
+	<-done
+	// Since we're no longer handling input, deregister this connection from
+	// notification.
+	sc.server.removeConn(sc)
+}
+
+// To be run in a separate goroutine, which will exit when the requests channel
+// is closed. Requests are handled in order, one at a time.
+func (sc *serverConn) serve(requests <-chan message.Message, done chan<- struct{}) {
+	defer close(done)
+	for input := range requests {
 		var output message.Message
-		if sc.server.opts.authHash != "" && !sc.authorized {
+		if sc.server.opts.authRequired() && !sc.authorized {
 			switch {
 			case input.Kind() != message.KindAuth:
 				output = message.NewErrorMessage(input.Tag(), "go away, bad message type")
-			case bcrypt.CompareHashAndPassword([]byte(sc.server.opts.authHash), []byte(input.Value())) == nil:
+			case sc.authorize(input.Value()):
 				sc.authorized = true
+				log.WithFields(log.Fields{
+					"id":   sc.id,
+					"user": sc.user,
+				}).Info("Client authorized")
 				output = message.NewAuthMessage(input.Tag(), "")
 			default:
 				output = message.NewErrorMessage(input.Tag(), "go away, bad password")
 			}
 		} else {
-			output = storage.ApplyMessage(sc.server.opts.store, input)
+			switch input.Kind() {
+			case message.KindGetLock, message.KindSetLock:
+				output = storage.ApplyLockMessage(sc.locks, input, storage.WithPermissions(sc.perms))
+			case message.KindLease, message.KindRevalidate, message.KindPut, message.KindTxn:
+				// Replied to while leases on its keys can't change.
+				sc.server.applyLeasing(sc, input)
+				continue
+			case message.KindSubscribe:
+				output = sc.server.subscribe(sc, input)
+			default:
+				output = storage.ApplyMessage(sc.server.opts.store, input, storage.WithPermissions(sc.perms))
+			}
 		}
-		if log.IsLevelEnabled(log.DebugLevel) {
+		sc.reply(input, output)
+	}
+}
+
+// reply sends the output of handling the input. A client that can't be sent
+// it is disconnected.
+func (sc *serverConn) reply(input, output message.Message) {
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.WithFields(log.Fields{
+			"input":  input,
+			"output": output,
+		}).Info("Handled message")
+	}
+	if err := sc.send(output); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"id":  sc.id,
+		}).Warn("Could not reply, disconnecting")
+		sc.close()
+	}
+}
+
+// send writes the message to the client. Writes time out like revocations do,
+// so that a client not reading can't hold up whoever is writing to it, e.g.,
+// with keys claimed.
+func (sc *serverConn) send(m message.Message) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	if err := sc.conn.SetWriteDeadline(time.Now().Add(sc.server.opts.revokeTimeout)); err != nil {
+		return err
+	}
+	return sc.encoder.Encode(sc.conn, m)
+}
+
+// authorize tells whether the value of an auth message is either the name of
+// an account and one of its secrets, separated by a colon, or the server
+// password. The accounts file is read every time, so that changes to it apply
+// to connections from then on.
+func (sc *serverConn) authorize(value string) bool {
+	opts := &sc.server.opts
+	if opts.accountsFile != "" {
+		accounts, err := LoadAccounts(opts.accountsFile)
+		if err != nil {
 			log.WithFields(log.Fields{
-				"input":  input,
-				"output": output,
-			}).Info("Handled message")
-		}
-		if err := sc.encoder.Encode(sc.conn, output); err != nil {
-			log.Warn(err)
+				"err":  err,
+				"file": opts.accountsFile,
+			}).Error("Could not load accounts")
 		}
-		if input.Kind() == message.KindPut && output.Kind() == message.KindPut {
-			// All these goroutines will serialize on the fan-out mutex. It might be
-			// better to use a buffered channel to write to here instead of piling up
-			// goroutines.
-			go sc.server.broadcast(sc.id, output)
+		name, secret, ok := strings.Cut(value, ":")
+		if ok && accounts != nil {
+			if account := accounts.Find(name); account != nil && account.Authorize(secret) {
+				sc.user = account.Name
+				sc.perms = &grantedPermissions{grants: account.Grants, tree: opts.tree, shared: opts.sharedKeys}
+				return true
+			}
 		}
 	}
-	// Since we're no longer handling input, deregister this connection from
-	// notification.
-	sc.server.removeConn(sc)
+	return opts.authHash != "" &&
+		bcrypt.CompareHashAndPassword([]byte(opts.authHash), []byte(value)) == nil
+}
+
+func (sc *serverConn) unsubscribe() {
+	if sc.stopFeed != nil {
+		close(sc.stopFeed)
+		sc.stopFeed = nil
+	}
 }
 
 func (sc *serverConn) close() {
@@ -1 +1 @@
-package server
\ No newline at end of file
+package server
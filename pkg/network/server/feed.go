@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/EncrypteDL/CryptFS/pkg/message"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	sync "github.com/sasha-s/go-deadlock"
+	log "github.com/sirupsen/logrus"
+)
+
+// feed tells subscribers that changes were committed.
+type feed struct {
+	mu sync.Mutex
+	// Closed, and replaced, on the next commit.
+	committed chan struct{}
+}
+
+func newFeed() *feed {
+	return &feed{committed: make(chan struct{})}
+}
+
+// next returns a channel that will be closed once a change is committed.
+func (f *feed) next() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.committed
+}
+
+func (f *feed) notify() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.committed)
+	f.committed = make(chan struct{})
+}
+
+var errUnsubscribed = errors.New("unsubscribed")
+
+// subscribe applies a subscribe message and, if the store keeps a change log,
+// starts streaming changes to the connection from the given sequence number,
+// replacing its previous subscription.
+func (s *Server) subscribe(sc *serverConn, in message.Message) message.Message {
+	out := storage.ApplyMessage(s.opts.store, in, storage.WithPermissions(sc.perms))
+	if out.Kind() != message.KindSubscribe {
+		return out
+	}
+	sc.unsubscribe()
+	stop := make(chan struct{})
+	sc.stopFeed = stop
+	go s.stream(sc, s.opts.store.(storage.ChangeLog), in.Sequence(), stop)
+	return out
+}
+
+// To be run in a separate goroutine, which will exit when stop is closed or
+// the connection fails. Puts of values the connection may not read are left
+// out of changes, but changes are all sent, so that there are no gaps in
+// sequence numbers.
+func (s *Server) stream(sc *serverConn, changes storage.ChangeLog, from uint64, stop <-chan struct{}) {
+	logger := log.WithField("id", sc.id)
+	for {
+		// Taken before reading, so that no commit goes unnoticed.
+		committed := s.feed.next()
+		err := changes.Changes(from, func(c storage.Change) error {
+			select {
+			case <-stop:
+				return errUnsubscribed
+			default:
+			}
+			puts := make([]message.Message, 0, len(c.Mutations))
+			for _, m := range c.Mutations {
+				if sc.perms != nil && !sc.perms.CanRead(m.Key) {
+					continue
+				}
+				puts = append(puts, message.NewPutMessage(0, string(m.Key), string(m.Value), m.Version))
+			}
+			if err := sc.send(message.NewChangeMessage(0, c.Sequence, puts)); err != nil {
+				return err
+			}
+			from = c.Sequence + 1
+			return nil
+		})
+		if errors.Is(err, errUnsubscribed) {
+			return
+		}
+		if err != nil {
+			logger.WithField("err", err).Warn("Could not stream changes, disconnecting")
+			sc.close()
+			return
+		}
+		select {
+		case <-committed:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -13,12 +13,12 @@ func main() {
 	fmt.Println("Type password (echo is off) and return: ")
 	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
-		log.Fatal("Couldd not read password: %v", err)
+		log.Fatalf("Could not read password: %v", err)
 	}
 
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		log.Fatal("Coild not hash input password:%v", err)
+		log.Fatalf("Could not hash input password: %v", err)
 	}
-	fmt.Printf("\nThe hash is: %s\n", &hash)
+	fmt.Printf("\nThe hash is: %s\n", hash)
 }
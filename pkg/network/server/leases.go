@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/EncrypteDL/CryptFS/pkg/message"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	sync "github.com/sasha-s/go-deadlock"
+	log "github.com/sirupsen/logrus"
+)
+
+// leases keeps track of which connections hold read leases on which keys.
+type leases struct {
+	// Held while changing holders or busy, and while applying puts, so that
+	// puts are checked against and committed to the tree one at a time. Never
+	// held while waiting for or writing to clients.
+	mu      sync.Mutex
+	holders map[string]map[uint16]bool
+
+	// Keys whose leases are being granted or revoked, and whose puts are being
+	// applied, each with a channel closed once done. No other lease is granted
+	// or revoked on a busy key, so that the reply granting a lease can't be
+	// overtaken by the revocation of that lease, and no lease is granted on a
+	// value about to change. Other keys are not held up.
+	busy map[string]chan struct{}
+
+	// Revocations waiting for acknowledgement. Acknowledgements are handled
+	// while mu may be held, so they have their own mutex.
+	acksMu sync.Mutex
+	acks   map[revocation]chan struct{}
+}
+
+type revocation struct {
+	conn uint16
+	key  string
+}
+
+func newLeases() *leases {
+	return &leases{
+		holders: make(map[string]map[uint16]bool),
+		busy:    make(map[string]chan struct{}),
+		acks:    make(map[revocation]chan struct{}),
+	}
+}
+
+// Call with mu held.
+func (l *leases) add(key string, conn uint16) {
+	if l.holders[key] == nil {
+		l.holders[key] = make(map[uint16]bool)
+	}
+	l.holders[key][conn] = true
+}
+
+// claim waits until none of the keys is busy, then makes them all busy until
+// the returned function is called. Keys are claimed all at once, so that
+// messages with overlapping keys can't wait for each other.
+func (l *leases) claim(keys []string) (release func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for done := l.anyBusy(keys); done != nil; done = l.anyBusy(keys) {
+		l.mu.Unlock()
+		<-done
+		l.mu.Lock()
+	}
+	done := make(chan struct{})
+	for _, key := range keys {
+		l.busy[key] = done
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, key := range keys {
+			delete(l.busy, key)
+		}
+		close(done)
+	}
+}
+
+// anyBusy returns the channel of one of the keys that are busy, or nil if none
+// is.
+// Call with mu held.
+func (l *leases) anyBusy(keys []string) chan struct{} {
+	for _, key := range keys {
+		if done, ok := l.busy[key]; ok {
+			return done
+		}
+	}
+	return nil
+}
+
+// leasedKeys returns the keys a lease, revalidate, put or txn message is about.
+func leasedKeys(in message.Message) []string {
+	switch in.Kind() {
+	case message.KindTxn, message.KindRevalidate:
+		keys := make([]string, len(in.Puts()))
+		for i, p := range in.Puts() {
+			keys[i] = p.Key()
+		}
+		return keys
+	default:
+		return []string{in.Key()}
+	}
+}
+
+// applyLeasing handles a message granting or revoking leases, and replies to
+// it while its keys are still busy, so that the reply granting a lease can't be
+// overtaken by the revocation of that lease.
+func (s *Server) applyLeasing(sc *serverConn, in message.Message) {
+	release := s.leases.claim(leasedKeys(in))
+	defer release()
+	var out message.Message
+	switch in.Kind() {
+	case message.KindLease:
+		out = s.grantLease(sc, in)
+	case message.KindRevalidate:
+		out = s.revalidate(sc, in)
+	default:
+		out = s.applyRevoking(sc, in)
+	}
+	sc.reply(in, out)
+}
+
+// grantLease applies a lease message, registering the connection as holder if
+// the value could be got.
+// Call with the key claimed.
+func (s *Server) grantLease(sc *serverConn, in message.Message) message.Message {
+	out := storage.ApplyMessage(s.opts.store, in, storage.WithPermissions(sc.perms))
+	if out.Kind() == message.KindLease {
+		s.leases.mu.Lock()
+		s.leases.add(in.Key(), sc.id)
+		s.leases.mu.Unlock()
+	}
+	return out
+}
+
+// revalidate applies a revalidate message, granting the connection a lease
+// again on the keys that didn't change.
+// Call with the keys claimed.
+func (s *Server) revalidate(sc *serverConn, in message.Message) message.Message {
+	out := storage.ApplyMessage(s.opts.store, in, storage.WithPermissions(sc.perms))
+	if out.Kind() != message.KindRevalidate {
+		return out
+	}
+	s.leases.mu.Lock()
+	defer s.leases.mu.Unlock()
+	for i, latest := range out.Puts() {
+		if latest.Version() != 0 && latest.Version() == in.Puts()[i].Version() {
+			s.leases.add(latest.Key(), sc.id)
+		}
+	}
+	return out
+}
+
+// applyRevoking applies a put or txn message, after revoking the leases other
+// connections hold on the keys it puts. Holders that don't acknowledge the
+// revocation in time are disconnected. If the message is applied, the sender
+// gets a lease on the keys. Messages the sender may not apply revoke nothing.
+// Call with the keys claimed.
+func (s *Server) applyRevoking(sc *serverConn, in message.Message) message.Message {
+	var puts []message.Message
+	if in.Kind() == message.KindTxn {
+		puts = in.Puts()
+	} else {
+		puts = []message.Message{in}
+	}
+	mutations := make([]storage.Mutation, len(puts))
+	for i, p := range puts {
+		mutations[i] = storage.Mutation{Version: p.Version(), Key: []byte(p.Key()), Value: []byte(p.Value())}
+	}
+	if sc.perms != nil && !sc.perms.CanWrite(mutations) {
+		return message.NewErrorMessage(in.Tag(), storage.ErrForbidden.Error())
+	}
+
+	// Revocations are sent in the order of the puts.
+	type revoked struct {
+		revocation
+		version uint64
+	}
+	var revocations []revoked
+	s.leases.mu.Lock()
+	for _, p := range puts {
+		for holder := range s.leases.holders[p.Key()] {
+			if holder != sc.id {
+				revocations = append(revocations, revoked{revocation{conn: holder, key: p.Key()}, p.Version()})
+				delete(s.leases.holders[p.Key()], holder)
+			}
+		}
+	}
+	s.leases.mu.Unlock()
+
+	waiting := make(map[revocation]chan struct{})
+	for _, r := range revocations {
+		if ack := s.revoke(r.revocation, r.version); ack != nil {
+			waiting[r.revocation] = ack
+		}
+	}
+	disconnected := make(map[uint16]bool)
+	ctx, cancel := context.WithTimeout(context.Background(), s.opts.revokeTimeout)
+	defer cancel()
+	for r, ack := range waiting {
+		select {
+		case <-ack:
+		case <-ctx.Done():
+			if disconnected[r.conn] {
+				break
+			}
+			log.WithFields(log.Fields{
+				"id":  r.conn,
+				"key": fmt.Sprintf("%.10x", r.key),
+			}).Warn("Lease not given back in time, disconnecting")
+			if holder := s.connByID(r.conn); holder != nil {
+				holder.close()
+			}
+			disconnected[r.conn] = true
+		}
+		s.leases.acksMu.Lock()
+		delete(s.leases.acks, r)
+		s.leases.acksMu.Unlock()
+	}
+
+	s.leases.mu.Lock()
+	defer s.leases.mu.Unlock()
+	// The tree may have changed while waiting.
+	if sc.perms != nil && !sc.perms.CanWrite(mutations) {
+		return message.NewErrorMessage(in.Tag(), storage.ErrForbidden.Error())
+	}
+	out := storage.ApplyMessage(s.opts.store, in, storage.WithPermissions(sc.perms))
+	if out.Kind() == in.Kind() {
+		for _, p := range puts {
+			s.leases.add(p.Key(), sc.id)
+		}
+		if s.opts.tree != nil {
+			s.opts.tree.Commit(mutations)
+		}
+		s.feed.notify()
+	}
+	return out
+}
+
+// revoke sends the revocation, returning a channel closed once it is
+// acknowledged, or nil if there's no need to wait.
+func (s *Server) revoke(r revocation, version uint64) chan struct{} {
+	holder := s.connByID(r.conn)
+	if holder == nil {
+		// Gone already, and its leases with it.
+		return nil
+	}
+	ack := make(chan struct{})
+	s.leases.acksMu.Lock()
+	s.leases.acks[r] = ack
+	s.leases.acksMu.Unlock()
+	logger := log.WithFields(log.Fields{
+		"id":      r.conn,
+		"key":     fmt.Sprintf("%.10x", r.key),
+		"version": version,
+	})
+	if err := holder.send(message.NewRevokeMessage(0, r.key, version)); err != nil {
+		logger.WithField("err", err).Warn("Could not revoke lease, disconnecting")
+		holder.close()
+		s.leases.acksMu.Lock()
+		delete(s.leases.acks, r)
+		s.leases.acksMu.Unlock()
+		return nil
+	}
+	logger.Debug("Revoked lease")
+	return ack
+}
+
+// acknowledgeRevocation is called when the connection gives back its lease on
+// the key.
+func (s *Server) acknowledgeRevocation(sc *serverConn, key string) {
+	s.leases.acksMu.Lock()
+	defer s.leases.acksMu.Unlock()
+	r := revocation{conn: sc.id, key: key}
+	if ack, ok := s.leases.acks[r]; ok {
+		close(ack)
+		delete(s.leases.acks, r)
+	}
+}
+
+// dropLeases forgets about the leases held by the connection, which is gone.
+func (s *Server) dropLeases(sc *serverConn) {
+	s.leases.acksMu.Lock()
+	for r, ack := range s.leases.acks {
+		if r.conn == sc.id {
+			close(ack)
+			delete(s.leases.acks, r)
+		}
+	}
+	s.leases.acksMu.Unlock()
+
+	s.leases.mu.Lock()
+	defer s.leases.mu.Unlock()
+	for key, holders := range s.leases.holders {
+		delete(holders, sc.id)
+		if len(holders) == 0 {
+			delete(s.leases.holders, key)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"time"
 
 	"github.com/EncrypteDL/CryptFS/pkg/message"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
@@ -32,6 +33,22 @@ type options struct {
 	// before any other message on a client connection. Only TLS connections can
 	// be used in this case.
 	authHash string
+
+	// If non-empty, the server will require clients to authorize as one of the
+	// accounts in the file, which is read again on every attempt. Only TLS
+	// connections can be used in this case.
+	accountsFile string
+
+	// Where nodes are, to enforce grants on subtrees. Without it, only grants on
+	// the whole file system give access.
+	tree Tree
+
+	// Keys of values that aren't nodes, but any account may read.
+	sharedKeys map[string]bool
+
+	// How long clients have to give back a lease before a conflicting put is
+	// accepted anyway, and they are disconnected.
+	revokeTimeout time.Duration
 }
 
 // WithBind sets the interface and port to bind the server to
@@ -65,11 +82,55 @@ func WithAuthHash(value string) Option {
 	}
 }
 
+// WithAccountsFile configures the server with the accounts clients can
+// authorize as, and the permissions they get
+// Also requires WithKeyPair for TLS
+func WithAccountsFile(value string) Option {
+	return func(o *options) {
+		o.accountsFile = value
+	}
+}
+
+// WithTree sets the index of the nodes in the store, used to enforce grants on
+// subtrees
+func WithTree(value Tree) Option {
+	return func(o *options) {
+		o.tree = value
+	}
+}
+
+// WithSharedKeys sets the keys of values that aren't nodes, but accounts
+// granted access to subtrees only may read nonetheless, e.g., the salt for
+// passphrases
+func WithSharedKeys(keys ...[]byte) Option {
+	return func(o *options) {
+		o.sharedKeys = make(map[string]bool, len(keys))
+		for _, key := range keys {
+			o.sharedKeys[string(key)] = true
+		}
+	}
+}
+
+// WithRevokeTimeout sets how long to wait for clients to give back a lease
+// when revoked, and for writes to clients to complete
+func WithRevokeTimeout(value time.Duration) Option {
+	return func(o *options) {
+		o.revokeTimeout = value
+	}
+}
+
+func (o *options) authRequired() bool {
+	return o.authHash != "" || o.accountsFile != ""
+}
+
 // Server is the server implementation
 type Server struct {
 	opts    options
 	ln      net.Listener
 	connIDs *message.MonotoneTags
+	locks   *storage.LockTable
+	leases  *leases
+	feed    *feed
 	mu      sync.Mutex
 	conns   []*serverConn
 }
@@ -78,8 +139,12 @@ type Server struct {
 func New(opts ...Option) *Server {
 	s := &Server{
 		connIDs: message.NewMonotoneTags(),
+		locks:   storage.NewLockTable(),
+		leases:  newLeases(),
+		feed:    newFeed(),
 	}
 	s.opts.bind = ":8000"
+	s.opts.revokeTimeout = 5 * time.Second
 	for _, o := range opts {
 		o(&s.opts)
 	}
@@ -97,7 +162,7 @@ func (s *Server) Listen() (addr string, err error) {
 			})
 		}
 	} else {
-		if s.opts.authHash != "" {
+		if s.opts.authRequired() {
 			return "", ErrPasswordWithoutTLS
 		}
 		s.ln, err = net.Listen("tcp", s.opts.bind)
@@ -142,7 +207,6 @@ func (s *Server) Serve() error {
 
 func (s *Server) removeConn(sc *serverConn) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	// Should consider using a map instead.
 	var newConns []*serverConn
 	for _, conn := range s.conns {
@@ -151,39 +215,23 @@ func (s *Server) removeConn(sc *serverConn) {
 		}
 	}
 	s.conns = newConns
+	s.mu.Unlock()
+	// Locks are owned by the connection, so a client that goes away can't leave
+	// others waiting forever. Neither should it hold up puts with its leases.
+	s.locks.Release(sc.id)
+	s.dropLeases(sc)
+	sc.unsubscribe()
 }
 
-func (s *Server) broadcast(excluded uint16, m message.Message) {
+func (s *Server) connByID(id uint16) *serverConn {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	broadcastMessage := m.ForBroadcast()
 	for _, conn := range s.conns {
-		if excluded == conn.id {
-			continue
-		}
-		if s.opts.authHash != "" && !conn.authorized {
-			continue
-		}
-		logger := log.WithFields(log.Fields{
-			"message":   broadcastMessage,
-			"sender":    excluded,
-			"recipient": conn.id,
-			"local":     conn.conn.LocalAddr(),
-			"remote":    conn.conn.RemoteAddr(),
-		})
-		// Note: We're re-encoding for all conns, that's a waste.
-		// This calls for a refactoring.
-		err := conn.encoder.Encode(conn.conn, broadcastMessage)
-		if err != nil {
-			// Never mind if a client didn't get the message. They are simply more likely
-			// to send stale puts as a consequence of the missed update. They would also
-			// see potentially stale content. Note: We should probably have a retry
-			// queue.
-			logger.WithField("err", err).Warn("Could not notify")
-		} else {
-			logger.Debug("Notified")
+		if conn.id == id {
+			return conn
 		}
 	}
+	return nil
 }
 
 // Shutdown instructs the server to shutdown. This method will return
@@ -193,10 +241,12 @@ func (s *Server) Shutdown() error {
 	// Stop accepting
 	err := s.ln.Close()
 	s.connIDs.Stop()
-	// Stop accepted
+	// Stop accepted. Closing makes each connection remove itself, which takes
+	// the lock, so close them from a copy.
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	for _, conn := range s.conns {
+	conns := append([]*serverConn(nil), s.conns...)
+	s.mu.Unlock()
+	for _, conn := range conns {
 		conn.close()
 	}
 	return err
@@ -1,18 +1,45 @@
-package server
+package server_test
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/EncrypteDL/CryptFS/pkg/message"
 	"github.com/EncrypteDL/CryptFS/pkg/network/client"
+	"github.com/EncrypteDL/CryptFS/pkg/network/server"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/petermattis/goid"
+	"github.com/sasha-s/go-deadlock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
+func init() {
+	// Lock order detection tells goroutines apart by id. Where ids can't be
+	// got, any two goroutines contending for a lock look like one locking it
+	// twice.
+	if goid.Get() == 0 {
+		deadlock.Opts.DisableLockOrderDetection = true
+	}
+}
+
 func TestServer(t *testing.T) {
 	t.Run("can be shutdown right after start", func(t *testing.T) {
 		_, cleanup := newDisposableServer(t)
@@ -105,38 +132,574 @@ func TestServer(t *testing.T) {
 		assert.EqualValues(t, 1, version)
 		assert.EqualValues(t, "glenda", value)
 	})
-	t.Run("successful put fans out to many clients", func(t *testing.T) {
+	t.Run("concurrent requests get their own responses", func(t *testing.T) {
 		address, cleanup := newDisposableServer(t)
+		defer cleanup()
 
-		// Connect three clients.
 		vs1, _ := newRemoteVersionedStore(address)
-		vs2, ready2 := newRemoteVersionedStore(address)
-		vs3, ready3 := newRemoteVersionedStore(address)
+		for i := 0; i < 32; i++ {
+			require.Nil(t, vs1.Put(uint64(i+1), []byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+		}
+
+		// A new client has nothing cached, so every get is a round trip.
+		vs2, _ := newRemoteVersionedStore(address)
+		var wg sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				version, value, err := vs2.Get([]byte(fmt.Sprint("key", i)))
+				assert.Nil(t, err)
+				assert.EqualValues(t, i+1, version)
+				assert.Equal(t, fmt.Sprint("value", i), string(value))
+			}(i)
+		}
+		wg.Wait()
+	})
+	t.Run("stale puts are refused over the wire", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs.Put(1, []byte("name"), []byte("glenda")))
+		assert.ErrorIs(t, vs.Put(1, []byte("name"), []byte("rob")), storage.ErrStalePut)
 
-		// One client makes a successful put.
-		require.Nil(t, vs1.Put(444, []byte("foo"), []byte("bar")))
+		// The stale value isn't cached.
+		version, value, err := vs.Get([]byte("name"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, version)
+		assert.Equal(t, []byte("glenda"), value)
+
+		_, _, err = vs.Get([]byte("nobody"))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+	t.Run("successful put revokes the leases of other clients", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
 
-		<-ready2
-		<-ready3
-		cleanup()
+		// Connect three clients, two of them holding a lease on "foo".
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, revoked2 := newRemoteVersionedStore(address)
+		vs3, revoked3 := newRemoteVersionedStore(address)
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("bar")))
+		for _, vs := range []*storage.RemoteVersionedStore{vs2, vs3} {
+			_, value, err := vs.Get([]byte("foo"))
+			require.Nil(t, err)
+			assert.EqualValues(t, "bar", value)
+		}
+
+		// By the time a put is accepted, the others have given back their lease.
+		require.Nil(t, vs1.Put(444, []byte("foo"), []byte("baz")))
+		for _, revoked := range []chan message.Message{revoked2, revoked3} {
+			select {
+			case m := <-revoked:
+				assert.Equal(t, message.NewRevokeMessage(0, "foo", 444), m)
+			default:
+				t.Error("lease not revoked before put was accepted")
+			}
+		}
 
-		// All clients know *locally* about the value of "foo".
+		// So they get the new value.
 		verify := func(rvs *storage.RemoteVersionedStore) {
 			version, value, err := rvs.Get([]byte("foo"))
 			if err != nil {
 				t.Errorf("got %v, want nil", err)
 			}
-			if want := []byte("bar"); !bytes.Equal(value, want) {
+			if want := []byte("baz"); !bytes.Equal(value, want) {
 				t.Errorf("got %q, want %q", value, want)
 			}
 			if want := uint64(444); version != want {
 				t.Errorf("got %d, want %d", version, want)
 			}
 		}
-
 		verify(vs2)
 		verify(vs3)
 	})
+	t.Run("successful transaction revokes every lease", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, revoked2 := newRemoteVersionedStore(address)
+		require.Nil(t, vs2.PutAll([]storage.Mutation{
+			{Version: 1, Key: []byte("parent"), Value: []byte("dir")},
+			{Version: 1, Key: []byte("child"), Value: []byte("file")},
+		}))
+		require.Nil(t, vs1.PutAll([]storage.Mutation{
+			{Version: 2, Key: []byte("parent"), Value: []byte("dir")},
+			{Version: 2, Key: []byte("child"), Value: []byte("moved")},
+		}))
+		for _, key := range []string{"parent", "child"} {
+			m := <-revoked2
+			assert.Equal(t, message.KindRevoke, m.Kind())
+			assert.Equal(t, key, m.Key())
+		}
+		version, value, err := vs2.Get([]byte("child"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 2, version)
+		assert.EqualValues(t, "moved", value)
+
+		err = vs2.PutAll([]storage.Mutation{
+			{Version: 3, Key: []byte("parent"), Value: []byte("dir")},
+			{Version: 2, Key: []byte("child"), Value: []byte("stale")},
+		})
+		assert.ErrorIs(t, err, storage.ErrStalePut)
+		_, value, err = vs1.Get([]byte("parent"))
+		require.Nil(t, err)
+		assert.EqualValues(t, "dir", value)
+	})
+	t.Run("clients that don't give back leases are disconnected", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t, server.WithRevokeTimeout(100*time.Millisecond))
+		defer cleanup()
+
+		// A raw client that never acknowledges revocations.
+		c := newAttachedClient(address)
+		require.Nil(t, c.Send(message.NewLeaseMessage(1, "foo", "", 0)))
+		var m message.Message
+		require.Nil(t, c.Receive(&m))
+		require.Equal(t, message.KindError, m.Kind())
+
+		vs, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs.Put(1, []byte("foo"), []byte("bar")))
+		require.Nil(t, c.Send(message.NewLeaseMessage(2, "foo", "", 0)))
+		require.Nil(t, c.Receive(&m))
+		require.Equal(t, message.NewLeaseMessage(2, "foo", "bar", 1), m)
+
+		require.Nil(t, vs.Put(2, []byte("foo"), []byte("baz")))
+		require.Nil(t, c.Receive(&m))
+		assert.Equal(t, message.NewRevokeMessage(0, "foo", 2), m)
+		assert.NotNil(t, c.Receive(&m))
+	})
+	t.Run("clients that don't give back leases hold up only their keys", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t, server.WithRevokeTimeout(2*time.Second))
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("bar")))
+		require.Nil(t, vs1.Put(1, []byte("baz"), []byte("qux")))
+
+		// A raw client holding a lease on foo, and never giving it back.
+		c := newAttachedClient(address)
+		defer c.Close()
+		require.Nil(t, c.Send(message.NewLeaseMessage(1, "foo", "", 0)))
+		var m message.Message
+		require.Nil(t, c.Receive(&m))
+		require.Equal(t, message.KindLease, m.Kind())
+
+		stalled := make(chan error, 1)
+		go func() {
+			stalled <- vs1.Put(2, []byte("foo"), []byte("new"))
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// Meanwhile, other keys are put and leased right away.
+		start := time.Now()
+		require.Nil(t, vs2.Put(2, []byte("baz"), []byte("quux")))
+		_, _, err := vs2.Get([]byte("other"))
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+		assert.Less(t, time.Since(start), time.Second)
+
+		// While leases on foo wait for the put to be applied.
+		version, value, err := vs2.Get([]byte("foo"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 2, version)
+		assert.EqualValues(t, "new", value)
+		assert.Nil(t, <-stalled)
+	})
+	t.Run("clients that don't read hold up no one", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t, server.WithRevokeTimeout(100*time.Millisecond))
+		defer cleanup()
+
+		vs, _ := newRemoteVersionedStore(address)
+		value := bytes.Repeat([]byte("x"), 60000)
+		require.Nil(t, vs.Put(1, []byte("foo"), value))
+
+		// A raw client asking for leases faster than it reads them, which is not
+		// at all.
+		c := newAttachedClient(address)
+		defer c.Close()
+		go func() {
+			for i := 0; i < 4096; i++ {
+				if c.Send(message.NewLeaseMessage(uint16(i), "foo", "", 0)) != nil {
+					return
+				}
+			}
+		}()
+		time.Sleep(500 * time.Millisecond)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- vs.Put(2, []byte("foo"), []byte("bar"))
+		}()
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("put held up by a client not reading")
+		}
+	})
+	t.Run("listeners not returning hold up no responses", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		// Nobody reads what the listener of vs2 is called with, so it blocks
+		// once the channel it sends to is full.
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, _ := newRemoteVersionedStore(address)
+		const count = 2000
+		mutations := make([]storage.Mutation, count)
+		for i := range mutations {
+			mutations[i] = storage.Mutation{Version: 1, Key: []byte(fmt.Sprint("key", i)), Value: []byte("old")}
+		}
+		require.Nil(t, vs1.PutAll(mutations))
+		for _, m := range mutations {
+			_, _, err := vs2.Get(m.Key)
+			require.Nil(t, err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			for i := range mutations {
+				mutations[i].Version, mutations[i].Value = 2, []byte("new")
+			}
+			if err := vs1.PutAll(mutations); err != nil {
+				done <- err
+				return
+			}
+			_, value, err := vs2.Get([]byte("key0"))
+			if err == nil && string(value) != "new" {
+				err = fmt.Errorf("got %q, want %q", value, "new")
+			}
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("responses held up by a listener")
+		}
+	})
+	t.Run("clients catch up with changes after reconnecting", func(t *testing.T) {
+		store := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		address, shutdown := newServer(t, store, "localhost:0")
+
+		vs, revoked := newRemoteVersionedStore(address)
+		require.Nil(t, vs.Put(1, []byte("changed"), []byte("before")))
+		require.Nil(t, vs.Put(1, []byte("unchanged"), []byte("same")))
+		shutdown()
+
+		// Changed while the client is disconnected.
+		require.Nil(t, store.Put(2, []byte("changed"), []byte("after")))
+		_, shutdown = newServer(t, store, address)
+		defer shutdown()
+
+		select {
+		case m := <-revoked:
+			assert.Equal(t, message.NewRevokeMessage(0, "changed", 2), m)
+		case <-time.After(10 * time.Second):
+			t.Fatal("no catch up after reconnecting")
+		}
+		version, value, err := vs.Get([]byte("changed"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 2, version)
+		assert.EqualValues(t, "after", value)
+		version, value, err = vs.Get([]byte("unchanged"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 1, version)
+		assert.EqualValues(t, "same", value)
+		select {
+		case m := <-revoked:
+			t.Errorf("unexpected revocation %v", m)
+		default:
+		}
+	})
+	t.Run("subscribers are streamed changes from the given sequence", func(t *testing.T) {
+		store := storage.NewVersionedWrapper(storage.NewInMemoryStore(), storage.WithChangeLog())
+		address, shutdown := newServer(t, store, "localhost:0")
+		defer shutdown()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs1.Put(1, []byte("foo"), []byte("bar")))
+		require.Nil(t, vs1.Put(2, []byte("foo"), []byte("baz")))
+
+		changes := make(chan storage.Change, 16)
+		last, err := vs2.Subscribe(2, func(c storage.Change) { changes <- c })
+		require.Nil(t, err)
+		assert.EqualValues(t, 2, last)
+		require.Nil(t, vs1.PutAll([]storage.Mutation{
+			{Version: 3, Key: []byte("foo"), Value: []byte("qux")},
+			{Version: 1, Key: []byte("bar"), Value: []byte("quux")},
+		}))
+
+		for _, want := range []storage.Change{
+			{Sequence: 2, Mutations: []storage.Mutation{
+				{Version: 2, Key: []byte("foo"), Value: []byte("baz")},
+			}},
+			{Sequence: 3, Mutations: []storage.Mutation{
+				{Version: 3, Key: []byte("foo"), Value: []byte("qux")},
+				{Version: 1, Key: []byte("bar"), Value: []byte("quux")},
+			}},
+		} {
+			select {
+			case c := <-changes:
+				assert.Equal(t, want, c)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("change %d not streamed", want.Sequence)
+			}
+		}
+	})
+	t.Run("subscribers catch up with changes after reconnecting", func(t *testing.T) {
+		store := storage.NewVersionedWrapper(storage.NewInMemoryStore(), storage.WithChangeLog())
+		address, shutdown := newServer(t, store, "localhost:0")
+
+		vs, _ := newRemoteVersionedStore(address)
+		changes := make(chan storage.Change, 16)
+		_, err := vs.Subscribe(0, func(c storage.Change) { changes <- c })
+		require.Nil(t, err)
+		require.Nil(t, vs.Put(1, []byte("foo"), []byte("bar")))
+		select {
+		case c := <-changes:
+			assert.EqualValues(t, 1, c.Sequence)
+		case <-time.After(5 * time.Second):
+			t.Fatal("change not streamed")
+		}
+		shutdown()
+
+		// Committed while the client is disconnected.
+		require.Nil(t, store.Put(2, []byte("foo"), []byte("baz")))
+		_, shutdown = newServer(t, store, address)
+		defer shutdown()
+
+		select {
+		case c := <-changes:
+			assert.Equal(t, storage.Change{Sequence: 2, Mutations: []storage.Mutation{
+				{Version: 2, Key: []byte("foo"), Value: []byte("baz")},
+			}}, c)
+		case <-time.After(10 * time.Second):
+			t.Fatal("no catch up after reconnecting")
+		}
+		select {
+		case c := <-changes:
+			t.Errorf("unexpected change %+v", c)
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+	t.Run("subscribing needs a change log", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs, _ := newRemoteVersionedStore(address)
+		_, err := vs.Subscribe(0, func(storage.Change) {})
+		assert.ErrorIs(t, err, storage.ErrNoChangeLog)
+	})
+	t.Run("locks are released when the client detaches", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, _ := newRemoteVersionedStore(address)
+		lock := storage.Lock{Owner: 1, Pid: 42, Type: storage.WriteLock, End: 99}
+		require.Nil(t, vs1.SetLock([]byte("node"), lock))
+		assert.ErrorIs(t, vs2.SetLock([]byte("node"), lock), storage.ErrLocked)
+		got, err := vs2.GetLock([]byte("node"), lock)
+		require.Nil(t, err)
+		assert.Equal(t, lock, got)
+
+		vs1.Stop()
+		assert.Eventually(t, func() bool {
+			return vs2.SetLock([]byte("node"), lock) == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+	t.Run("locks are taken again after reconnecting", func(t *testing.T) {
+		store := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		address, shutdown := newServer(t, store, "localhost:0")
+
+		vs1, _ := newRemoteVersionedStore(address)
+		lock := storage.Lock{Owner: 1, Pid: 42, Type: storage.WriteLock, End: 99}
+		require.Nil(t, vs1.SetLock([]byte("node"), lock))
+		shutdown()
+		_, shutdown = newServer(t, store, address)
+		defer shutdown()
+
+		vs2, _ := newRemoteVersionedStore(address)
+		assert.Eventually(t, func() bool {
+			got, err := vs2.GetLock([]byte("node"), lock)
+			return err == nil && got == lock
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+	t.Run("locks taken by someone else while disconnected are lost", func(t *testing.T) {
+		store := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		address, shutdown := newServer(t, store, "localhost:0")
+
+		// Slow to reconnect, so that the other client gets there first.
+		vs1, _ := newRemoteVersionedStore(address, client.WithBackoff(time.Second, time.Second))
+		lock := storage.Lock{Owner: 1, Pid: 42, Type: storage.WriteLock, End: 99}
+		require.Nil(t, vs1.SetLock([]byte("node"), lock))
+		shutdown()
+		time.Sleep(300 * time.Millisecond)
+		_, shutdown = newServer(t, store, address)
+		defer shutdown()
+
+		vs2, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs2.SetLock([]byte("node"), lock))
+		assert.Eventually(t, func() bool {
+			return errors.Is(vs1.SetLock([]byte("node"), lock), storage.ErrLockLost)
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.ErrorIs(t, vs1.SetLock([]byte("node"), lock), storage.ErrLocked)
+		require.Nil(t, vs2.SetLock([]byte("node"), storage.Lock{Owner: 1, Type: storage.Unlock, End: 99}))
+		assert.Nil(t, vs1.SetLock([]byte("node"), lock))
+	})
+	t.Run("clients authorize over TLS", func(t *testing.T) {
+		certFile, keyFile, pool := newKeyPair(t)
+		hash, err := bcrypt.GenerateFromPassword([]byte("s3cr3t"), bcrypt.MinCost)
+		require.Nil(t, err)
+		address, cleanup := newDisposableServer(t,
+			server.WithKeyPair(certFile, keyFile),
+			server.WithAuthHash(string(hash)),
+		)
+		defer cleanup()
+
+		newClient := func(password string) *client.Client {
+			return client.New(
+				client.WithAddress("tls://"+address),
+				client.WithTLSConfig(&tls.Config{RootCAs: pool}),
+				client.WithPassword(password),
+				client.WithFallbackToPlainTCP(),
+			)
+		}
+		vs := storage.NewRemoteVersionedStore(newClient("s3cr3t"), storage.WithRequestTimeout(5*time.Second))
+		vs.Start()
+		defer vs.Stop()
+		require.Nil(t, vs.Put(1, []byte("foo"), []byte("bar")))
+
+		c := newClient("guess")
+		defer c.Close()
+		assert.ErrorIs(t, c.Connect(), client.ErrUnauthorized)
+	})
+	t.Run("accounts get what they are granted", func(t *testing.T) {
+		certFile, keyFile, pool := newKeyPair(t)
+		accountsFile := filepath.Join(t.TempDir(), "accounts.json")
+		accounts := new(server.Accounts)
+		alice, err := accounts.Add("alice")
+		require.Nil(t, err)
+		require.Nil(t, alice.SetPassword("s3cr3t"))
+		alice.Grants = []server.Grant{{Write: true}}
+		bob, err := accounts.Add("bob")
+		require.Nil(t, err)
+		token, err := bob.RotateToken()
+		require.Nil(t, err)
+		bob.Grants = []server.Grant{{Subtree: hex.EncodeToString([]byte("ab")), Write: true}}
+		require.Nil(t, accounts.Save(accountsFile))
+
+		address, cleanup := newDisposableServer(t,
+			server.WithKeyPair(certFile, keyFile),
+			server.WithAccountsFile(accountsFile),
+			server.WithTree(prefixTree{}),
+			server.WithSharedKeys([]byte("salt")),
+		)
+		defer cleanup()
+
+		newStore := func(user, password string) *storage.RemoteVersionedStore {
+			vs := storage.NewRemoteVersionedStore(client.New(
+				client.WithAddress("tls://"+address),
+				client.WithTLSConfig(&tls.Config{RootCAs: pool}),
+				client.WithUser(user),
+				client.WithPassword(password),
+			), storage.WithRequestTimeout(5*time.Second))
+			vs.Start()
+			t.Cleanup(vs.Stop)
+			return vs
+		}
+		aliceStore := newStore("alice", "s3cr3t")
+		require.Nil(t, aliceStore.Put(1, []byte("abc"), []byte("in")))
+		require.Nil(t, aliceStore.Put(1, []byte("xyz"), []byte("out")))
+		require.Nil(t, aliceStore.Put(1, []byte("salt"), []byte("shared")))
+		require.Nil(t, aliceStore.Put(1, []byte("notes"), []byte("private")))
+
+		bobStore := newStore("bob", token)
+		_, value, err := bobStore.Get([]byte("abc"))
+		require.Nil(t, err)
+		assert.Equal(t, []byte("in"), value)
+		assert.Nil(t, bobStore.Put(2, []byte("abc"), []byte("changed")))
+		_, _, err = bobStore.Get([]byte("xyz"))
+		assert.ErrorIs(t, err, storage.ErrForbidden)
+		assert.ErrorIs(t, bobStore.Put(2, []byte("xyz"), []byte("changed")), storage.ErrForbidden)
+		_, value, err = bobStore.Get([]byte("salt"))
+		require.Nil(t, err)
+		assert.Equal(t, []byte("shared"), value)
+		assert.ErrorIs(t, bobStore.Put(2, []byte("salt"), []byte("changed")), storage.ErrForbidden)
+		_, _, err = bobStore.Get([]byte("notes"))
+		assert.ErrorIs(t, err, storage.ErrForbidden)
+		_, _, err = bobStore.Get([]byte("\x00sequence"))
+		assert.ErrorIs(t, err, storage.ErrForbidden)
+
+		c := client.New(
+			client.WithAddress("tls://"+address),
+			client.WithTLSConfig(&tls.Config{RootCAs: pool}),
+			client.WithUser("bob"),
+			client.WithPassword("s3cr3t"),
+		)
+		defer c.Close()
+		assert.ErrorIs(t, c.Connect(), client.ErrUnauthorized)
+	})
+	t.Run("accounts can't move nodes into what they are granted", func(t *testing.T) {
+		certFile, keyFile, pool := newKeyPair(t)
+		accountsFile := filepath.Join(t.TempDir(), "accounts.json")
+		accounts := new(server.Accounts)
+		alice, err := accounts.Add("alice")
+		require.Nil(t, err)
+		require.Nil(t, alice.SetPassword("s3cr3t"))
+		alice.Grants = []server.Grant{{Write: true}}
+		bob, err := accounts.Add("bob")
+		require.Nil(t, err)
+		require.Nil(t, bob.SetPassword("s3cr3t"))
+		bob.Grants = []server.Grant{{Subtree: hex.EncodeToString([]byte("bob")), Write: true}}
+		require.Nil(t, accounts.Save(accountsFile))
+
+		address, cleanup := newDisposableServer(t,
+			server.WithKeyPair(certFile, keyFile),
+			server.WithAccountsFile(accountsFile),
+			server.WithTree(&listTree{parents: make(map[string]map[string]bool)}),
+		)
+		defer cleanup()
+
+		newStore := func(user string) *storage.RemoteVersionedStore {
+			vs := storage.NewRemoteVersionedStore(client.New(
+				client.WithAddress("tls://"+address),
+				client.WithTLSConfig(&tls.Config{RootCAs: pool}),
+				client.WithUser(user),
+				client.WithPassword("s3cr3t"),
+			), storage.WithRequestTimeout(5*time.Second))
+			vs.Start()
+			t.Cleanup(vs.Stop)
+			return vs
+		}
+		aliceStore := newStore("alice")
+		require.Nil(t, aliceStore.PutAll([]storage.Mutation{
+			{Version: 1, Key: []byte("top"), Value: []byte("/bobsec")},
+			{Version: 1, Key: []byte("bob")},
+			{Version: 1, Key: []byte("sec"), Value: []byte("secret")},
+		}))
+
+		bobStore := newStore("bob")
+		assert.ErrorIs(t, bobStore.PutAll([]storage.Mutation{
+			{Version: 2, Key: []byte("bob"), Value: []byte("/sec")},
+			{Version: 2, Key: []byte("sec"), Value: []byte("mine")},
+		}), storage.ErrForbidden)
+		assert.ErrorIs(t, bobStore.Put(2, []byte("bob"), []byte("/sec")), storage.ErrForbidden)
+		_, _, err = bobStore.Get([]byte("sec"))
+		assert.ErrorIs(t, err, storage.ErrForbidden)
+
+		// New nodes can be added, and written once committed.
+		require.Nil(t, bobStore.PutAll([]storage.Mutation{
+			{Version: 2, Key: []byte("bob"), Value: []byte("/new")},
+			{Version: 1, Key: []byte("new"), Value: []byte("mine")},
+		}))
+		assert.Nil(t, bobStore.Put(2, []byte("new"), []byte("still mine")))
+		assert.ErrorIs(t, bobStore.Put(1, []byte("odd"), []byte("orphan")), storage.ErrForbidden)
+	})
 	t.Run("should not allow a password to be transmitted in cleartext", func(t *testing.T) {
 		s := server.New(server.WithAuthHash("anything"))
 		_, err := s.Listen()
@@ -144,13 +707,113 @@ func TestServer(t *testing.T) {
 	})
 }
 
-func newDisposableServer(t *testing.T) (address string, cleanup func()) {
+// prefixTree makes three byte keys nodes, within the subtrees of the nodes
+// they start with.
+type prefixTree struct{}
+
+func (prefixTree) IsNode(key []byte) bool {
+	return len(key) == 3
+}
+
+func (prefixTree) Within(root, key []byte) bool {
+	return bytes.HasPrefix(key, root)
+}
+
+func (prefixTree) Adopted(mutations []storage.Mutation) [][]byte { return nil }
+
+func (prefixTree) Exists(key []byte) bool { return true }
+
+func (prefixTree) Commit(mutations []storage.Mutation) {}
+
+// listTree makes three byte keys nodes, with values starting with a slash
+// listing the keys of their children.
+type listTree struct {
+	mu      sync.Mutex
+	parents map[string]map[string]bool
+}
+
+func children(value []byte) (keys []string) {
+	if !bytes.HasPrefix(value, []byte("/")) {
+		return nil
+	}
+	for value = value[1:]; len(value) >= 3; value = value[3:] {
+		keys = append(keys, string(value[:3]))
+	}
+	return keys
+}
+
+func (*listTree) IsNode(key []byte) bool {
+	return len(key) == 3
+}
+
+func (t *listTree) Within(root, key []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	visited := make(map[string]bool)
+	ancestors := []string{string(key)}
+	for len(ancestors) > 0 {
+		k := ancestors[len(ancestors)-1]
+		ancestors = ancestors[:len(ancestors)-1]
+		if k == string(root) {
+			return true
+		}
+		if visited[k] {
+			continue
+		}
+		visited[k] = true
+		for parent := range t.parents[k] {
+			ancestors = append(ancestors, parent)
+		}
+	}
+	return false
+}
+
+func (t *listTree) Adopted(mutations []storage.Mutation) (adopted [][]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range mutations {
+		for _, child := range children(m.Value) {
+			if !t.parents[child][string(m.Key)] {
+				adopted = append(adopted, []byte(child))
+			}
+		}
+	}
+	return adopted
+}
+
+func (t *listTree) Exists(key []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.parents[string(key)]
+	return ok
+}
+
+func (t *listTree) Commit(mutations []storage.Mutation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, m := range mutations {
+		if t.parents[string(m.Key)] == nil {
+			t.parents[string(m.Key)] = make(map[string]bool)
+		}
+		for _, child := range children(m.Value) {
+			if t.parents[child] == nil {
+				t.parents[child] = make(map[string]bool)
+			}
+			t.parents[child][string(m.Key)] = true
+		}
+	}
+}
+
+func newDisposableServer(t *testing.T, opts ...server.Option) (address string, cleanup func()) {
 	store := storage.NewInMemoryStore()
-	versionedStore := storage.NewVersionedWrapper(store)
-	metadataServer := server.New(
-		server.WithBind("localhost:0"),
+	return newServer(t, storage.NewVersionedWrapper(store), "localhost:0", opts...)
+}
+
+func newServer(t *testing.T, versionedStore storage.VersionedStore, bind string, opts ...server.Option) (address string, cleanup func()) {
+	metadataServer := server.New(append([]server.Option{
+		server.WithBind(bind),
 		server.WithVersionedStore(versionedStore),
-	)
+	}, opts...)...)
 	address, err := metadataServer.Listen()
 	require.Nil(t, err)
 	errCh := make(chan error, 1)
@@ -163,14 +826,46 @@ func newDisposableServer(t *testing.T) (address string, cleanup func()) {
 	}
 }
 
+// newKeyPair writes a self-signed certificate for localhost and its key,
+// returning their files and a pool trusting the certificate.
+func newKeyPair(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+	parsed, err := x509.ParseCertificate(cert)
+	require.Nil(t, err)
+	pool = x509.NewCertPool()
+	pool.AddCert(parsed)
+	return certFile, keyFile, pool
+}
+
 func newAttachedClient(address string) (c *client.Client) {
 	return client.New(client.WithAddress(address), client.WithFallbackToPlainTCP())
 }
 
-func newRemoteVersionedStore(address string) (*storage.RemoteVersionedStore, chan message.Message) {
-	recv := make(chan message.Message, 1)
+func newRemoteVersionedStore(address string, opts ...client.Option) (*storage.RemoteVersionedStore, chan message.Message) {
+	recv := make(chan message.Message, 16)
 	vs := storage.NewRemoteVersionedStore(
-		client.New(client.WithAddress(address), client.WithFallbackToPlainTCP()),
+		client.New(append([]client.Option{client.WithAddress(address), client.WithFallbackToPlainTCP()}, opts...)...),
 		storage.WithRequestTimeout(5*time.Second),
 		storage.WithChangeListener(func(m message.Message) {
 			recv <- m
@@ -0,0 +1,428 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/EncrypteDL/CryptFS/pkg/bits"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// POSIX ACLs are kept with the other extended attributes, in the layout Linux
+// uses for them: a version, then one entry per tag and ID, made of the tag, the
+// permissions and the ID.
+const (
+	aclAccessXattr  = "system.posix_acl_access"
+	aclDefaultXattr = "system.posix_acl_default"
+
+	aclVersion  uint32 = 2
+	aclEntryLen        = 8
+
+	aclUserObj  uint16 = 0x01
+	aclUser     uint16 = 0x02
+	aclGroupObj uint16 = 0x04
+	aclGroup    uint16 = 0x08
+	aclMask     uint16 = 0x10
+	aclOther    uint16 = 0x20
+
+	aclUndefinedID uint32 = 0xffffffff
+)
+
+// ErrBadACL is returned when an ACL can't be decoded, or is not valid.
+var ErrBadACL = errors.New("bad ACL")
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+type acl []aclEntry
+
+// aclFromMode returns the ACL equivalent to the permission bits of the mode.
+func aclFromMode(mode uint32) acl {
+	return acl{
+		{tag: aclUserObj, perm: uint16(mode>>6) & 7, id: aclUndefinedID},
+		{tag: aclGroupObj, perm: uint16(mode>>3) & 7, id: aclUndefinedID},
+		{tag: aclOther, perm: uint16(mode) & 7, id: aclUndefinedID},
+	}
+}
+
+func parseACL(b []byte) (acl, error) {
+	if len(b) < 4 || (len(b)-4)%aclEntryLen != 0 {
+		return nil, fmt.Errorf("%d bytes: %w", len(b), ErrBadACL)
+	}
+	version, b := bits.Get32(b)
+	if version != aclVersion {
+		return nil, fmt.Errorf("unknown version %d: %w", version, ErrBadACL)
+	}
+	a := make(acl, 0, len(b)/aclEntryLen)
+	for len(b) > 0 {
+		var e aclEntry
+		e.tag, b = bits.Get16(b)
+		e.perm, b = bits.Get16(b)
+		e.id, b = bits.Get32(b)
+		a = append(a, e)
+	}
+	return a, a.validate()
+}
+
+// validate checks that there is exactly one entry for the owner, the owning
+// group and others, and a mask if there are entries for other users or groups.
+func (a acl) validate() error {
+	count := make(map[uint16]int)
+	for _, e := range a {
+		switch e.tag {
+		case aclUserObj, aclUser, aclGroupObj, aclGroup, aclMask, aclOther:
+		default:
+			return fmt.Errorf("unknown tag %#x: %w", e.tag, ErrBadACL)
+		}
+		if e.perm&^7 != 0 {
+			return fmt.Errorf("permissions %#o: %w", e.perm, ErrBadACL)
+		}
+		count[e.tag]++
+	}
+	for _, tag := range []uint16{aclUserObj, aclGroupObj, aclOther} {
+		if count[tag] != 1 {
+			return fmt.Errorf("%d entries with tag %#x: %w", count[tag], tag, ErrBadACL)
+		}
+	}
+	if count[aclMask] > 1 || count[aclMask] == 0 && count[aclUser]+count[aclGroup] > 0 {
+		return fmt.Errorf("%d mask entries: %w", count[aclMask], ErrBadACL)
+	}
+	return nil
+}
+
+func (a acl) serialize() []byte {
+	buf := make([]byte, 4+aclEntryLen*len(a))
+	b := bits.Put32(buf, aclVersion)
+	for _, e := range a {
+		b = bits.Put16(b, e.tag)
+		b = bits.Put16(b, e.perm)
+		b = bits.Put32(b, e.id)
+	}
+	return buf
+}
+
+// groupClass returns the tag of the entry reflected in the group bits of the
+// mode, i.e., the mask if any.
+func (a acl) groupClass() uint16 {
+	if _, ok := a.entry(aclMask); ok {
+		return aclMask
+	}
+	return aclGroupObj
+}
+
+// mode returns the permission bits of the mode equivalent to the ACL.
+func (a acl) mode() uint32 {
+	var mode uint32
+	class := a.groupClass()
+	for _, e := range a {
+		switch e.tag {
+		case aclUserObj:
+			mode |= uint32(e.perm) << 6
+		case class:
+			mode |= uint32(e.perm) << 3
+		case aclOther:
+			mode |= uint32(e.perm)
+		}
+	}
+	return mode
+}
+
+// withMode returns a copy of the ACL with the permissions of the owner, group
+// class and others replaced by the permission bits of the mode, as chmod does.
+func (a acl) withMode(mode uint32) acl {
+	return a.applyMode(mode, true)
+}
+
+// masked returns a copy of the ACL with the permissions of the owner, group
+// class and others restricted to the permission bits of the mode, as when
+// inheriting a default ACL.
+func (a acl) masked(mode uint32) acl {
+	return a.applyMode(mode, false)
+}
+
+func (a acl) applyMode(mode uint32, replace bool) acl {
+	b := make(acl, len(a))
+	copy(b, a)
+	class := b.groupClass()
+	for i := range b {
+		var perm uint16
+		switch b[i].tag {
+		case aclUserObj:
+			perm = uint16(mode>>6) & 7
+		case class:
+			perm = uint16(mode>>3) & 7
+		case aclOther:
+			perm = uint16(mode) & 7
+		default:
+			continue
+		}
+		if replace {
+			b[i].perm = perm
+		} else {
+			b[i].perm &= perm
+		}
+	}
+	return b
+}
+
+// entry returns the first entry with the tag.
+func (a acl) entry(tag uint16) (aclEntry, bool) {
+	for _, e := range a {
+		if e.tag == tag {
+			return e, true
+		}
+	}
+	return aclEntry{}, false
+}
+
+// permits tells whether the ACL grants all the wanted permissions, following
+// the access check algorithm described in acl(5).
+func (a acl) permits(caller *fuse.Caller, owner, group uint32, want uint16) bool {
+	if caller.Uid == owner {
+		e, _ := a.entry(aclUserObj)
+		return e.perm&want == want
+	}
+	mask := uint16(7)
+	if e, ok := a.entry(aclMask); ok {
+		mask = e.perm
+	}
+	for _, e := range a {
+		if e.tag == aclUser && e.id == caller.Uid {
+			return e.perm&mask&want == want
+		}
+	}
+
+	// Granted if any matching group entry grants all the permissions, denied
+	// if none does.
+	var groups []uint32
+	matched := false
+	for _, e := range a {
+		var gid uint32
+		switch e.tag {
+		case aclGroupObj:
+			gid = group
+		case aclGroup:
+			gid = e.id
+		default:
+			continue
+		}
+		if gid != caller.Gid {
+			if groups == nil {
+				groups = callerGroups(caller.Pid)
+			}
+			if !containsGID(groups, gid) {
+				continue
+			}
+		}
+		if e.perm&mask&want == want {
+			return true
+		}
+		matched = true
+	}
+	if matched {
+		return false
+	}
+	e, _ := a.entry(aclOther)
+	return e.perm&want == want
+}
+
+// callerGroups returns the supplementary groups of the process, which FUSE
+// doesn't pass along with the effective user and group.
+func callerGroups(pid uint32) []uint32 {
+	groups := []uint32{}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"pid": pid,
+		}).Warn("Could not get supplementary groups")
+		return groups
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "Groups:")
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			gid, err := strconv.ParseUint(field, 10, 32)
+			if err == nil {
+				groups = append(groups, uint32(gid))
+			}
+		}
+		break
+	}
+	return groups
+}
+
+func containsGID(groups []uint32, gid uint32) bool {
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// accessACL returns the access ACL of the node, or the equivalent of its mode
+// if it has none.
+// Call with lock held.
+func (node *CryptNode) accessACL() (acl, error) {
+	b, ok := node.xattrs[aclAccessXattr]
+	if !ok {
+		return aclFromMode(node.Mode), nil
+	}
+	return parseACL(b)
+}
+
+// checkAccess returns EACCES unless the caller of the operation is granted all
+// the wanted permissions, a combination of unix.R_OK, W_OK and X_OK. Calls not
+// coming through the kernel carry no caller, and are always granted, as is
+// everything unless the factory checks permissions.
+// Call with lock held.
+func (node *CryptNode) checkAccess(ctx context.Context, want uint32) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || want == 0 || !node.factory.CheckPermissions {
+		return 0
+	}
+	if caller.Uid == 0 {
+		// Root may execute only what someone may execute.
+		if want&unix.X_OK == 0 || node.Mode&syscall.S_IFMT == fuse.S_IFDIR || node.Mode&0o111 != 0 {
+			return 0
+		}
+		return syscall.EACCES
+	}
+	a, err := node.accessACL()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Error("Could not check access")
+		return syscall.EIO
+	}
+	if !a.permits(caller, node.User, node.Group, uint16(want)) {
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// checkOwner returns EPERM unless the caller of the operation owns the node or
+// is root.
+// Call with lock held.
+func (node *CryptNode) checkOwner(ctx context.Context) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || !node.factory.CheckPermissions || caller.Uid == 0 || caller.Uid == node.User {
+		return 0
+	}
+	return syscall.EPERM
+}
+
+// checkChown returns EPERM unless the caller may give the node the owner and
+// group, as chown(2) does: only root may change the owner, and the owner may
+// only change the group to one they belong to.
+// Call with lock held.
+func (node *CryptNode) checkChown(ctx context.Context, uid, gid uint32) syscall.Errno {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || !node.factory.CheckPermissions || caller.Uid == 0 {
+		return 0
+	}
+	if caller.Uid != node.User || uid != node.User {
+		return syscall.EPERM
+	}
+	if gid != node.Group && gid != caller.Gid && !containsGID(callerGroups(caller.Pid), gid) {
+		return syscall.EPERM
+	}
+	return 0
+}
+
+// checkSetTimes returns the error utimensat(2) fails with, if any: setting
+// times explicitly takes owning the node, setting them to the current time
+// takes owning it or having write permission.
+// Call with lock held.
+func (node *CryptNode) checkSetTimes(ctx context.Context, now bool) syscall.Errno {
+	errno := node.checkOwner(ctx)
+	if errno == 0 || !now {
+		return errno
+	}
+	return node.checkAccess(ctx, unix.W_OK)
+}
+
+// checkSetxattr returns the error setting or removing the extended attribute
+// fails with, if any, as described in xattr(7): ACLs are for the owner to set,
+// trusted and security attributes for root, and any other takes write
+// permission.
+// Call with lock held.
+func (node *CryptNode) checkSetxattr(ctx context.Context, attr string) syscall.Errno {
+	switch {
+	case attr == aclAccessXattr || attr == aclDefaultXattr:
+		return node.checkOwner(ctx)
+	case strings.HasPrefix(attr, "trusted.") || strings.HasPrefix(attr, "security."):
+		caller, ok := fuse.FromContext(ctx)
+		if ok && node.factory.CheckPermissions && caller.Uid != 0 {
+			return syscall.EPERM
+		}
+		return 0
+	default:
+		return node.checkAccess(ctx, unix.W_OK)
+	}
+}
+
+// inheritACL sets the ACLs of a node just created from the default ACL of its
+// parent, if any: the access ACL is the default one restricted by the mode the
+// node was created with, and directories also inherit the default ACL itself.
+// Call with both locks held.
+func (node *CryptNode) inheritACL(parent *CryptNode) error {
+	b, ok := parent.xattrs[aclDefaultXattr]
+	if !ok || node.Mode&syscall.S_IFMT == fuse.S_IFLNK {
+		return nil
+	}
+	def, err := parseACL(b)
+	if err != nil {
+		return err
+	}
+	access := def.masked(node.Mode)
+	node.Mode = node.Mode&^0o777 | access.mode()
+	if node.xattrs == nil {
+		node.xattrs = make(map[string][]byte)
+	}
+	node.xattrs[aclAccessXattr] = access.serialize()
+	if node.Mode&syscall.S_IFMT == fuse.S_IFDIR {
+		node.xattrs[aclDefaultXattr] = append([]byte{}, b...)
+	}
+	return nil
+}
+
+// setACLXattr validates an ACL about to be set, and for the access ACL returns
+// the mode reflecting it.
+// Call with lock held.
+func (node *CryptNode) setACLXattr(attr string, data []byte) (mode uint32, errno syscall.Errno) {
+	mode = node.Mode
+	a, err := parseACL(data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+			"attr": attr,
+		}).Warn("Refusing to set ACL")
+		return mode, syscall.EINVAL
+	}
+	if attr == aclDefaultXattr {
+		if node.Mode&syscall.S_IFMT != fuse.S_IFDIR {
+			return mode, syscall.EACCES
+		}
+		return mode, 0
+	}
+	return node.Mode&^0o777 | a.mode(), 0
+}
@@ -0,0 +1,147 @@
+package node
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestACL(t *testing.T) {
+	const owner, group = 1000, 4242
+	named := acl{
+		{tag: aclUserObj, perm: 7, id: aclUndefinedID},
+		{tag: aclUser, perm: 7, id: 2000},
+		{tag: aclGroupObj, perm: 5, id: aclUndefinedID},
+		{tag: aclGroup, perm: 6, id: 4243},
+		{tag: aclMask, perm: 5, id: aclUndefinedID},
+		{tag: aclOther, perm: 0, id: aclUndefinedID},
+	}
+	caller := func(uid, gid uint32) *fuse.Caller {
+		return &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: gid}, Pid: uint32(os.Getpid())}
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		got, err := parseACL(named.serialize())
+		require.NoError(t, err)
+		assert.Equal(t, named, got)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, a := range map[string]acl{
+			"no owner":     named[1:],
+			"missing mask": append(acl{}, named[:4]...),
+			"bad perm":     {{tag: aclUserObj, perm: 8}, named[2], named[5]},
+			"bad tag":      {{tag: 0x40}, named[0], named[2], named[5]},
+		} {
+			_, err := parseACL(a.serialize())
+			assert.ErrorIs(t, err, ErrBadACL, name)
+		}
+		_, err := parseACL([]byte{2, 0, 0, 0, 1})
+		assert.ErrorIs(t, err, ErrBadACL)
+		_, err = parseACL(aclFromMode(0o644).serialize()[:4])
+		assert.ErrorIs(t, err, ErrBadACL)
+	})
+
+	t.Run("mode", func(t *testing.T) {
+		assert.EqualValues(t, 0o750, named.mode())
+		assert.EqualValues(t, 0o644, aclFromMode(0o644).mode())
+		chmoded := named.withMode(0o701)
+		assert.EqualValues(t, 0o701, chmoded.mode())
+		// Named entries are kept, only limited by the mask.
+		assert.Equal(t, named[1], chmoded[1])
+		assert.EqualValues(t, 0o640, named.masked(0o664).mode())
+	})
+
+	t.Run("permits", func(t *testing.T) {
+		for _, tc := range []struct {
+			name   string
+			caller *fuse.Caller
+			want   uint16
+			ok     bool
+		}{
+			{"owner", caller(owner, 1), unix.R_OK | unix.W_OK, true},
+			{"named user limited by mask", caller(2000, 1), unix.W_OK, false},
+			{"named user", caller(2000, 1), unix.R_OK | unix.X_OK, true},
+			{"owning group", caller(1, group), unix.R_OK, true},
+			{"named group limited by mask", caller(1, 4243), unix.W_OK, false},
+			{"named group", caller(1, 4243), unix.R_OK, true},
+			{"other", caller(1, 1), unix.R_OK, false},
+		} {
+			assert.Equal(t, tc.ok, named.permits(tc.caller, owner, group, tc.want), tc.name)
+		}
+	})
+
+	t.Run("permits supplementary groups", func(t *testing.T) {
+		groups, err := os.Getgroups()
+		require.NoError(t, err)
+		if len(groups) == 0 {
+			t.Skip("no supplementary groups")
+		}
+		a := aclFromMode(0o070)
+		assert.True(t, a.permits(caller(1, 1), owner, uint32(groups[0]), unix.R_OK))
+	})
+
+	t.Run("checks access", func(t *testing.T) {
+		factory := &CryptNodeFactory{}
+		node := &CryptNode{factory: factory, User: owner, Group: group, Mode: fuse.S_IFREG | 0o600}
+		ctx := fuse.NewContext(context.Background(), caller(2000, 2000))
+		assert.EqualValues(t, 0, node.checkAccess(ctx, unix.R_OK))
+
+		factory.CheckPermissions = true
+		assert.Equal(t, syscall.EACCES, node.checkAccess(ctx, unix.R_OK))
+		assert.EqualValues(t, 0, node.checkAccess(context.Background(), unix.R_OK))
+		root := fuse.NewContext(context.Background(), caller(0, 0))
+		assert.EqualValues(t, 0, node.checkAccess(root, unix.R_OK|unix.W_OK))
+		assert.Equal(t, syscall.EACCES, node.checkAccess(root, unix.X_OK))
+
+		node.xattrs = map[string][]byte{aclAccessXattr: named.serialize()}
+		assert.EqualValues(t, 0, node.Access(ctx, unix.R_OK))
+		assert.Equal(t, syscall.EACCES, node.Access(ctx, unix.W_OK))
+	})
+
+	t.Run("inherits default ACL", func(t *testing.T) {
+		factory := &CryptNodeFactory{}
+		parent := &CryptNode{factory: factory, Mode: fuse.S_IFDIR | 0o755}
+		parent.xattrs = map[string][]byte{aclDefaultXattr: named.serialize()}
+
+		file := &CryptNode{factory: factory, Mode: fuse.S_IFREG | 0o644}
+		require.NoError(t, file.inheritACL(parent))
+		assert.EqualValues(t, fuse.S_IFREG|0o640, file.Mode)
+		access, err := file.accessACL()
+		require.NoError(t, err)
+		assert.Equal(t, named.masked(0o644), access)
+		assert.NotContains(t, file.xattrs, aclDefaultXattr)
+
+		dir := &CryptNode{factory: factory, Mode: fuse.S_IFDIR | 0o777}
+		require.NoError(t, dir.inheritACL(parent))
+		assert.EqualValues(t, fuse.S_IFDIR|0o750, dir.Mode)
+		assert.Equal(t, parent.xattrs[aclDefaultXattr], dir.xattrs[aclDefaultXattr])
+
+		link := &CryptNode{factory: factory, Mode: fuse.S_IFLNK}
+		require.NoError(t, link.inheritACL(parent))
+		assert.Empty(t, link.xattrs)
+	})
+
+	t.Run("setting ACL updates mode", func(t *testing.T) {
+		factory := &CryptNodeFactory{Metadata: storage.NewVersionedWrapper(storage.NewInMemoryStore())}
+		node, err := factory.allocateNode()
+		require.NoError(t, err)
+		node.Mode = fuse.S_IFREG | 0o644
+		errno := node.Setxattr(context.Background(), aclAccessXattr, named.serialize(), 0)
+		require.EqualValues(t, 0, errno)
+		assert.EqualValues(t, fuse.S_IFREG|0o750, node.Mode)
+
+		errno = node.Setxattr(context.Background(), aclAccessXattr, []byte("garbage"), 0)
+		assert.Equal(t, syscall.EINVAL, errno)
+		errno = node.Setxattr(context.Background(), aclDefaultXattr, named.serialize(), 0)
+		assert.Equal(t, syscall.EACCES, errno)
+		assert.EqualValues(t, fuse.S_IFREG|0o750, node.Mode)
+	})
+}
@@ -0,0 +1,350 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/EncrypteDL/CryptFS/pkg/bits"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+)
+
+const (
+	// DefaultChunkSize is the size of the chunks file contents are split in,
+	// unless the factory is configured otherwise.
+	DefaultChunkSize = 1 << 20
+
+	// Content keys referring to a manifest are the manifest blob key prefixed by
+	// this tag. Content keys of files saved before contents were chunked refer
+	// to the whole content instead, and are exactly blobKeyLen long.
+	manifestTag byte = 'M'
+
+	// Length of the keys generated by storage.BlobStore implementations.
+	blobKeyLen = 64
+
+	// Length of the shortest manifest entry, that of a hole: just the 16 bits
+	// length of its empty key.
+	manifestEntryMinLen = 2
+
+	// Number of chunks loaded only to be read that are kept in memory, so that
+	// reading a file sequentially in pieces smaller than a chunk doesn't load
+	// each chunk again for every piece, nor keep the whole file in memory.
+	cleanChunksKept = 2
+)
+
+var (
+	// ErrBadManifest is returned when a manifest blob can't be decoded.
+	ErrBadManifest = errors.New("bad manifest")
+)
+
+// chunkedContent holds the content of a regular file or symlink, split in
+// chunks of a fixed size, each saved as a separate blob. A manifest blob lists
+// the keys of all chunks. Chunks are only loaded when read or partially
+// written, and saving only uploads the chunks that changed. Modified chunks stay
+// in memory until saved, while only the last few chunks read are kept.
+type chunkedContent struct {
+	size      int64
+	chunkSize int64
+
+	// Key of each chunk as of the last save. An empty key stands for a chunk
+	// that is all zeros and was never written, i.e., a hole.
+	keys [][]byte
+
+	// Chunks loaded in memory, by index. Each is exactly chunkLen(i) long.
+	chunks map[int64][]byte
+
+	// Chunks modified since the last save, by index.
+	dirty map[int64]bool
+
+	// Indices of the chunks in memory that were read and not modified, least
+	// recently read first.
+	clean []int64
+}
+
+func newChunkedContent(chunkSize int64) *chunkedContent {
+	return &chunkedContent{
+		chunkSize: chunkSize,
+		chunks:    make(map[int64][]byte),
+		dirty:     make(map[int64]bool),
+	}
+}
+
+// loadContent loads the manifest referred to by a content key. Legacy content
+// keys, referring to the whole content, are loaded and split in dirty chunks,
+// so that the next save will store them chunked.
+func loadContent(blobs storage.BlobStore, contentKey []byte, chunkSize int64) (*chunkedContent, error) {
+	if len(contentKey) == 0 {
+		return newChunkedContent(chunkSize), nil
+	}
+	if !isManifestKey(contentKey) {
+		value, err := blobs.Get(contentKey)
+		if err != nil {
+			return nil, err
+		}
+		c := newChunkedContent(chunkSize)
+		if err := c.writeAt(blobs, value, 0); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	manifest, err := blobs.Get(contentKey[1:])
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(manifest)
+}
+
+// blobKeys returns the keys of all blobs a content key refers to: the manifest
+// and the chunks, or the whole content for legacy keys.
+func blobKeys(blobs storage.BlobStore, contentKey []byte) ([][]byte, error) {
+	if !isManifestKey(contentKey) {
+		return [][]byte{contentKey}, nil
+	}
+	manifest, err := blobs.Get(contentKey[1:])
+	if err != nil {
+		return nil, err
+	}
+	c, err := parseManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	keys := [][]byte{contentKey[1:]}
+	for _, key := range c.keys {
+		if len(key) != 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func isManifestKey(contentKey []byte) bool {
+	return len(contentKey) == 1+blobKeyLen && contentKey[0] == manifestTag
+}
+
+func (c *chunkedContent) chunkCount() int64 {
+	return (c.size + c.chunkSize - 1) / c.chunkSize
+}
+
+func (c *chunkedContent) chunkLen(i int64) int64 {
+	if rest := c.size - i*c.chunkSize; rest < c.chunkSize {
+		return rest
+	}
+	return c.chunkSize
+}
+
+// chunk returns the i-th chunk, loading it if needed.
+func (c *chunkedContent) chunk(blobs storage.BlobStore, i int64) ([]byte, error) {
+	if b, ok := c.chunks[i]; ok {
+		return b, nil
+	}
+	b := make([]byte, c.chunkLen(i))
+	if key := c.keys[i]; len(key) != 0 {
+		value, err := blobs.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		copy(b, value)
+	}
+	c.chunks[i] = b
+	return b, nil
+}
+
+func (c *chunkedContent) readAt(blobs storage.BlobStore, dest []byte, off int64) (n int, err error) {
+	if off >= c.size {
+		return 0, nil
+	}
+	end := min(off+int64(len(dest)), c.size)
+	for off < end {
+		i := off / c.chunkSize
+		b, err := c.chunk(blobs, i)
+		if err != nil {
+			return n, err
+		}
+		if !c.dirty[i] {
+			c.keepClean(i)
+		}
+		m := copy(dest[n:n+int(end-off)], b[off%c.chunkSize:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// keepClean records that the i-th chunk was just read, and drops from memory
+// the least recently read chunks beyond cleanChunksKept, unless they have been
+// modified since.
+func (c *chunkedContent) keepClean(i int64) {
+	for j, k := range c.clean {
+		if k == i {
+			c.clean = append(c.clean[:j], c.clean[j+1:]...)
+			break
+		}
+	}
+	c.clean = append(c.clean, i)
+	for len(c.clean) > cleanChunksKept {
+		if k := c.clean[0]; !c.dirty[k] {
+			delete(c.chunks, k)
+		}
+		c.clean = c.clean[1:]
+	}
+}
+
+func (c *chunkedContent) writeAt(blobs storage.BlobStore, data []byte, off int64) error {
+	if end := off + int64(len(data)); end > c.size {
+		if err := c.truncate(blobs, end); err != nil {
+			return err
+		}
+	}
+	for len(data) > 0 {
+		i := off / c.chunkSize
+		coff := off % c.chunkSize
+		n := min(int64(len(data)), c.chunkLen(i)-coff)
+		b, ok := c.chunks[i]
+		if !ok && coff == 0 && n == c.chunkLen(i) {
+			// Overwriting the whole chunk, no need to load it.
+			b = make([]byte, n)
+			c.chunks[i] = b
+		} else if !ok {
+			var err error
+			if b, err = c.chunk(blobs, i); err != nil {
+				return err
+			}
+		}
+		copy(b[coff:], data[:n])
+		c.dirty[i] = true
+		data = data[n:]
+		off += n
+	}
+	return nil
+}
+
+// truncate shrinks or grows the content. Growing adds holes, which read as
+// zeros.
+func (c *chunkedContent) truncate(blobs storage.BlobStore, size int64) error {
+	if size == c.size {
+		return nil
+	}
+	// Only the chunk with the last byte that is kept can change length, if it's
+	// a partial chunk. It's replaced rather than modified, so that clones
+	// don't see the change.
+	if kept := min(c.size, size); kept%c.chunkSize != 0 {
+		i := (kept - 1) / c.chunkSize
+		b, err := c.chunk(blobs, i)
+		if err != nil {
+			return err
+		}
+		resized := make([]byte, min(c.chunkSize, size-i*c.chunkSize))
+		copy(resized, b)
+		c.chunks[i] = resized
+		c.dirty[i] = true
+	}
+	c.size = size
+	n := c.chunkCount()
+	if int64(len(c.keys)) > n {
+		c.keys = c.keys[:n]
+	}
+	for int64(len(c.keys)) < n {
+		c.keys = append(c.keys, nil)
+	}
+	for i := range c.chunks {
+		if i >= n {
+			delete(c.chunks, i)
+			delete(c.dirty, i)
+		}
+	}
+	return nil
+}
+
+// clone returns a copy of c that is unaffected by later writes and truncations
+// on c, to be used for rolling back.
+func (c *chunkedContent) clone() *chunkedContent {
+	clone := newChunkedContent(c.chunkSize)
+	clone.size = c.size
+	clone.keys = append([][]byte{}, c.keys...)
+	for i, b := range c.chunks {
+		clone.chunks[i] = append([]byte{}, b...)
+	}
+	for i := range c.dirty {
+		clone.dirty[i] = true
+	}
+	clone.clean = append([]int64{}, c.clean...)
+	return clone
+}
+
+// save uploads the dirty chunks and a new manifest, and returns the content key
+// referring to the manifest. Chunks are dropped from memory once saved, and
+// loaded again on demand.
+func (c *chunkedContent) save(blobs storage.BlobStore) (contentKey []byte, err error) {
+	for i := range c.dirty {
+		key, err := blobs.Put(c.chunks[i])
+		if err != nil {
+			return nil, err
+		}
+		c.keys[i] = key
+		delete(c.dirty, i)
+	}
+	key, err := blobs.Put(c.manifest())
+	if err != nil {
+		return nil, err
+	}
+	c.chunks = make(map[int64][]byte)
+	c.clean = nil
+	return append([]byte{manifestTag}, key...), nil
+}
+
+func (c *chunkedContent) manifest() []byte {
+	size := 16
+	for _, key := range c.keys {
+		size += 2 + len(key)
+	}
+	buf := make([]byte, size)
+	b := bits.Put64(buf, uint64(c.size))
+	b = bits.Put32(b, uint32(c.chunkSize))
+	b = bits.Put32(b, uint32(len(c.keys)))
+	for _, key := range c.keys {
+		b = bits.Putb(b, key)
+	}
+	return buf
+}
+
+func parseManifest(b []byte) (*chunkedContent, error) {
+	if len(b) < 16 {
+		return nil, fmt.Errorf("%d bytes header: %w", len(b), ErrBadManifest)
+	}
+	var (
+		size      uint64
+		chunkSize uint32
+		count     uint32
+	)
+	size, b = bits.Get64(b)
+	chunkSize, b = bits.Get32(b)
+	count, b = bits.Get32(b)
+	if chunkSize == 0 {
+		return nil, fmt.Errorf("zero chunk size: %w", ErrBadManifest)
+	}
+	c := newChunkedContent(int64(chunkSize))
+	c.size = int64(size)
+	if int64(count) != c.chunkCount() {
+		return nil, fmt.Errorf("%d chunks for %d bytes: %w", count, size, ErrBadManifest)
+	}
+	// Every entry takes at least its key length, so a count the remaining bytes
+	// can't hold is bad, and must not be allocated for.
+	if uint64(count) > uint64(len(b)/manifestEntryMinLen) {
+		return nil, fmt.Errorf("%d chunks in %d bytes: %w", count, len(b), ErrBadManifest)
+	}
+	c.keys = make([][]byte, 0, count)
+	for ; count > 0; count-- {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("truncated key length: %w", ErrBadManifest)
+		}
+		if n, _ := bits.Get16(b); len(b) < 2+int(n) {
+			return nil, fmt.Errorf("truncated key: %w", ErrBadManifest)
+		}
+		var key []byte
+		key, b = bits.Getb(b)
+		if len(key) == 0 {
+			key = nil
+		}
+		c.keys = append(c.keys, key)
+	}
+	return c, nil
+}
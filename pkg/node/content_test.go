@@ -0,0 +1,197 @@
+package node
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/bits"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingBlobStore struct {
+	storage.BlobStore
+	puts int
+	gets int
+}
+
+func (s *countingBlobStore) Put(value []byte) ([]byte, error) {
+	s.puts++
+	return s.BlobStore.Put(value)
+}
+
+func (s *countingBlobStore) Get(key []byte) ([]byte, error) {
+	s.gets++
+	return s.BlobStore.Get(key)
+}
+
+func TestChunkedContent(t *testing.T) {
+	const chunkSize = 16
+
+	newStore := func() *countingBlobStore {
+		return &countingBlobStore{BlobStore: storage.NewBlobStore(storage.NewInMemoryStore())}
+	}
+
+	readAll := func(t *testing.T, blobs storage.BlobStore, c *chunkedContent) []byte {
+		t.Helper()
+		b := make([]byte, c.size)
+		n, err := c.readAt(blobs, b, 0)
+		require.NoError(t, err)
+		require.EqualValues(t, c.size, n)
+		return b
+	}
+
+	t.Run("write and read across chunk boundaries", func(t *testing.T) {
+		blobs := newStore()
+		c := newChunkedContent(chunkSize)
+		want := make([]byte, 5*chunkSize+3)
+		rand.Read(want)
+		require.NoError(t, c.writeAt(blobs, want, 0))
+		contentKey, err := c.save(blobs)
+		require.NoError(t, err)
+
+		loaded, err := loadContent(blobs, contentKey, chunkSize)
+		require.NoError(t, err)
+		assert.EqualValues(t, len(want), loaded.size)
+		assert.Equal(t, want, readAll(t, blobs, loaded))
+
+		dest := make([]byte, chunkSize+2)
+		n, err := loaded.readAt(blobs, dest, chunkSize-1)
+		require.NoError(t, err)
+		assert.Equal(t, len(dest), n)
+		assert.Equal(t, want[chunkSize-1:2*chunkSize+1], dest)
+
+		n, err = loaded.readAt(blobs, dest, int64(len(want))-1)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		n, err = loaded.readAt(blobs, dest, int64(len(want))+1)
+		require.NoError(t, err)
+		assert.Equal(t, 0, n)
+	})
+
+	t.Run("writing past the end leaves a hole", func(t *testing.T) {
+		blobs := newStore()
+		c := newChunkedContent(chunkSize)
+		require.NoError(t, c.writeAt(blobs, []byte("tail"), 3*chunkSize))
+		_, err := c.save(blobs)
+		require.NoError(t, err)
+		// Only the last chunk and the manifest.
+		assert.Equal(t, 2, blobs.puts)
+		want := append(make([]byte, 3*chunkSize), "tail"...)
+		assert.Equal(t, want, readAll(t, blobs, c))
+	})
+
+	t.Run("only modified chunks are uploaded", func(t *testing.T) {
+		blobs := newStore()
+		c := newChunkedContent(chunkSize)
+		want := make([]byte, 10*chunkSize)
+		rand.Read(want)
+		require.NoError(t, c.writeAt(blobs, want, 0))
+		_, err := c.save(blobs)
+		require.NoError(t, err)
+
+		blobs.puts, blobs.gets = 0, 0
+		require.NoError(t, c.writeAt(blobs, []byte("xy"), 4*chunkSize+7))
+		copy(want[4*chunkSize+7:], "xy")
+		contentKey, err := c.save(blobs)
+		require.NoError(t, err)
+		assert.Equal(t, 1, blobs.gets)
+		assert.Equal(t, 2, blobs.puts)
+
+		loaded, err := loadContent(blobs, contentKey, chunkSize)
+		require.NoError(t, err)
+		assert.Equal(t, want, readAll(t, blobs, loaded))
+	})
+
+	t.Run("only modified and recently read chunks are kept in memory", func(t *testing.T) {
+		blobs := newStore()
+		c := newChunkedContent(chunkSize)
+		want := make([]byte, 10*chunkSize)
+		rand.Read(want)
+		require.NoError(t, c.writeAt(blobs, want, 0))
+		contentKey, err := c.save(blobs)
+		require.NoError(t, err)
+		loaded, err := loadContent(blobs, contentKey, chunkSize)
+		require.NoError(t, err)
+		require.NoError(t, loaded.writeAt(blobs, []byte("xy"), 2*chunkSize))
+		copy(want[2*chunkSize:], "xy")
+
+		// Reading sequentially in small pieces loads each chunk once.
+		blobs.gets = 0
+		got := make([]byte, 0, len(want))
+		dest := make([]byte, chunkSize/4)
+		for off := int64(0); off < loaded.size; off += int64(len(dest)) {
+			n, err := loaded.readAt(blobs, dest, off)
+			require.NoError(t, err)
+			got = append(got, dest[:n]...)
+		}
+		assert.Equal(t, want, got)
+		assert.Equal(t, 9, blobs.gets)
+		assert.Len(t, loaded.chunks, 1+cleanChunksKept)
+		assert.Contains(t, loaded.chunks, int64(2))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		blobs := newStore()
+		c := newChunkedContent(chunkSize)
+		want := make([]byte, 3*chunkSize)
+		rand.Read(want)
+		require.NoError(t, c.writeAt(blobs, want, 0))
+		_, err := c.save(blobs)
+		require.NoError(t, err)
+
+		rollback := c.clone()
+		require.NoError(t, c.truncate(blobs, chunkSize+5))
+		assert.Equal(t, want[:chunkSize+5], readAll(t, blobs, c))
+		require.NoError(t, c.truncate(blobs, 2*chunkSize))
+		grown := append(append([]byte{}, want[:chunkSize+5]...), make([]byte, chunkSize-5)...)
+		assert.Equal(t, grown, readAll(t, blobs, c))
+		assert.Equal(t, want, readAll(t, blobs, rollback))
+
+		contentKey, err := c.save(blobs)
+		require.NoError(t, err)
+		loaded, err := loadContent(blobs, contentKey, chunkSize)
+		require.NoError(t, err)
+		assert.Equal(t, grown, readAll(t, blobs, loaded))
+	})
+
+	t.Run("legacy content keys", func(t *testing.T) {
+		blobs := newStore()
+		want := bytes.Repeat([]byte("legacy"), 10)
+		key, err := blobs.Put(want)
+		require.NoError(t, err)
+		require.False(t, isManifestKey(key))
+
+		c, err := loadContent(blobs, key, chunkSize)
+		require.NoError(t, err)
+		assert.Equal(t, want, readAll(t, blobs, c))
+		contentKey, err := c.save(blobs)
+		require.NoError(t, err)
+		assert.True(t, isManifestKey(contentKey))
+	})
+
+	t.Run("bad manifests", func(t *testing.T) {
+		c := newChunkedContent(chunkSize)
+		c.size = 2 * chunkSize
+		c.keys = [][]byte{[]byte("a"), []byte("b")}
+		manifest := c.manifest()
+		for i := 0; i < len(manifest); i++ {
+			_, err := parseManifest(manifest[:i])
+			assert.ErrorIs(t, err, ErrBadManifest)
+		}
+		_, err := parseManifest(manifest)
+		assert.NoError(t, err)
+
+		// A huge count, consistent with the size, must not be allocated for.
+		header := make([]byte, 16)
+		b := bits.Put64(header, math.MaxUint32*chunkSize)
+		b = bits.Put32(b, chunkSize)
+		bits.Put32(b, math.MaxUint32)
+		_, err = parseManifest(append(header, 0, 0))
+		assert.ErrorIs(t, err, ErrBadManifest)
+	})
+}
@@ -0,0 +1,219 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	sync "github.com/sasha-s/go-deadlock"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Setlkw waits for a conflicting lock to be released by polling, backing
+	// off between these.
+	minLockPollInterval = 10 * time.Millisecond
+	maxLockPollInterval = time.Second
+)
+
+// Ensure that we implement the locking interfaces.
+var (
+	_ = (fs.NodeGetlker)((*CryptNode)(nil))
+	_ = (fs.NodeSetlker)((*CryptNode)(nil))
+	_ = (fs.NodeSetlkwer)((*CryptNode)(nil))
+)
+
+// openFile is the handle of an open file. The kernel doesn't ask to release
+// flock locks, which belong to the open file, when it's closed for good, so
+// they are tracked here.
+type openFile struct {
+	// Whether the file was opened for writing.
+	writable bool
+
+	mu         sync.Mutex
+	flocked    bool
+	flockOwner uint64
+}
+
+// Getlk implements the fs.NodeGetlker interface. Both fcntl and flock locks
+// are handled here, the latter as locks on the whole file.
+func (node *CryptNode) Getlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	if node.factory.Locks == nil {
+		return syscall.ENOTSUP
+	}
+	got, err := node.factory.Locks.GetLock(node.Key[:], lockOf(owner, lk))
+	if err != nil {
+		return node.lockErrno(err)
+	}
+	out.Start, out.End, out.Typ, out.Pid = got.Start, got.End, got.Type, got.Pid
+	return 0
+}
+
+// Setlk implements the fs.NodeSetlker interface.
+func (node *CryptNode) Setlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if node.factory.Locks == nil {
+		return syscall.ENOTSUP
+	}
+	errno := node.lockErrno(node.factory.Locks.SetLock(node.Key[:], lockOf(owner, lk)))
+	if errno == 0 {
+		node.trackLock(f, owner, lk, flags)
+	}
+	return errno
+}
+
+// Setlkw implements the fs.NodeSetlkwer interface. The metadata server doesn't
+// queue lock requests, so this retries until the lock is granted or the caller
+// is interrupted.
+func (node *CryptNode) Setlkw(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	if node.factory.Locks == nil {
+		return syscall.ENOTSUP
+	}
+	l := lockOf(owner, lk)
+	interval := minLockPollInterval
+	for {
+		err := node.factory.Locks.SetLock(node.Key[:], l)
+		if err == nil {
+			node.trackLock(f, owner, lk, flags)
+		}
+		if !errors.Is(err, storage.ErrLocked) {
+			return node.lockErrno(err)
+		}
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-time.After(interval):
+		}
+		interval = min(2*interval, maxLockPollInterval)
+	}
+}
+
+// trackLock remembers who to release locks for when files are closed. Neither
+// is forgotten when unlocking, as the owner might still hold other ranges.
+func (node *CryptNode) trackLock(f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) {
+	if lk.Typ == storage.Unlock {
+		return
+	}
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		if h, ok := f.(*openFile); ok {
+			h.mu.Lock()
+			h.flocked, h.flockOwner = true, owner
+			h.mu.Unlock()
+		}
+		return
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.lockOwners == nil {
+		node.lockOwners = make(map[uint64]uint32)
+	}
+	node.lockOwners[owner] = lk.Pid
+}
+
+// releaseLocks releases the fcntl locks held on the node by the calling
+// process, which is closing the file.
+func (node *CryptNode) releaseLocks(ctx context.Context) {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok || node.factory.Locks == nil {
+		return
+	}
+	process := processOf(caller.Pid)
+	var owners []uint64
+	node.mu.Lock()
+	for owner, pid := range node.lockOwners {
+		if pid == process {
+			owners = append(owners, owner)
+			delete(node.lockOwners, owner)
+		}
+	}
+	node.mu.Unlock()
+	for _, owner := range owners {
+		node.unlockAll(owner)
+	}
+}
+
+// releaseFlock releases the flock lock taken through the file, if any.
+func (node *CryptNode) releaseFlock(f fs.FileHandle) {
+	h, ok := f.(*openFile)
+	if !ok || node.factory.Locks == nil {
+		return
+	}
+	h.mu.Lock()
+	flocked, owner := h.flocked, h.flockOwner
+	h.flocked = false
+	h.mu.Unlock()
+	if flocked {
+		node.unlockAll(owner)
+	}
+}
+
+func (node *CryptNode) unlockAll(owner uint64) {
+	err := node.factory.Locks.SetLock(node.Key[:], storage.Lock{
+		Owner: owner,
+		Type:  storage.Unlock,
+		End:   math.MaxUint64,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Warn("Could not release locks")
+	}
+}
+
+// processOf returns the process the thread with the given id belongs to. Lock
+// requests tell the process taking the lock, while others tell the calling
+// thread.
+func processOf(tid uint32) uint32 {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return tid
+	}
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if v, ok := bytes.CutPrefix(line, []byte("Tgid:")); ok {
+			pid, err := strconv.ParseUint(string(bytes.TrimSpace(v)), 10, 32)
+			if err != nil {
+				return tid
+			}
+			return uint32(pid)
+		}
+	}
+	return tid
+}
+
+func lockOf(owner uint64, lk *fuse.FileLock) storage.Lock {
+	return storage.Lock{
+		Owner: owner,
+		Pid:   lk.Pid,
+		Type:  lk.Typ,
+		Start: lk.Start,
+		End:   lk.End,
+	}
+}
+
+func (node *CryptNode) lockErrno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, storage.ErrLocked):
+		return syscall.EAGAIN
+	case errors.Is(err, storage.ErrBadLock):
+		return syscall.EINVAL
+	case errors.Is(err, storage.ErrLockLost):
+		return syscall.EIO
+	default:
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Error("Could not lock")
+		return syscall.ENOLCK
+	}
+}
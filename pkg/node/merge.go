@@ -0,0 +1,181 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrConflict is returned when the changes made to a node locally and by some
+// other client since it was last loaded can't be merged.
+var ErrConflict = errors.New("conflicting updates")
+
+// maxSaveAttempts bounds how many times a put that keeps going stale is merged
+// with the latest version and retried.
+const maxSaveAttempts = 5
+
+// merge3 returns the result of a three-way merge of a value, and false if both
+// sides changed it differently.
+func merge3[T comparable](base, ours, theirs T) (T, bool) {
+	switch {
+	case ours == base:
+		return theirs, true
+	case theirs == base || theirs == ours:
+		return ours, true
+	}
+	return ours, false
+}
+
+type optionalValue struct {
+	ok    bool
+	value string
+}
+
+type optionalKey struct {
+	ok  bool
+	key [NodeKeyLen]byte
+}
+
+// rebase loads the latest version of the node after a stale put, and applies
+// on top of it the local changes, i.e., those made since the node was last
+// loaded or saved. Changes to different children or extended attributes are
+// independent, as are changes to different attributes. Concurrent changes to
+// times keep the latest, and to the link count add up. Anything else changed
+// on both sides is a conflict, in which case the node is left as it was.
+// Call with lock held.
+func (node *CryptNode) rebase() error {
+	version, b, err := node.factory.Metadata.Get(node.Key[:])
+	if errors.Is(err, storage.ErrNotFound) && node.saved == nil {
+		// A new node, nothing to merge with.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if node.saved == nil {
+		return fmt.Errorf("%.10x: no base version: %w", node.Key[:], ErrConflict)
+	}
+	// Decoded apart from the factory, so that their children don't become known
+	// nodes.
+	base := &CryptNode{factory: &CryptNodeFactory{}}
+	if err := base.unserialize(node.saved); err != nil {
+		return err
+	}
+	theirs := &CryptNode{factory: &CryptNodeFactory{}}
+	if err := theirs.unserialize(b); err != nil {
+		return err
+	}
+
+	var conflicts []string
+	check := func(what string, ok bool) {
+		if !ok {
+			conflicts = append(conflicts, what)
+		}
+	}
+	user, ok := merge3(base.User, node.User, theirs.User)
+	check("user", ok)
+	group, ok := merge3(base.Group, node.Group, theirs.Group)
+	check("group", ok)
+	mode, ok := merge3(base.Mode, node.Mode, theirs.Mode)
+	check("mode", ok)
+	rdev, ok := merge3(base.Rdev, node.Rdev, theirs.Rdev)
+	check("rdev", ok)
+	contentKey, ok := merge3(string(base.contentKey), string(node.contentKey), string(theirs.contentKey))
+	check("content", ok && !(node.shouldSaveContent && contentKey != string(node.contentKey)))
+
+	xattrs := make(map[string]optionalValue)
+	for _, n := range []*CryptNode{base, node, theirs} {
+		for attr := range n.xattrs {
+			v, ok := merge3(xattrOf(base, attr), xattrOf(node, attr), xattrOf(theirs, attr))
+			check("xattr "+attr, ok)
+			xattrs[attr] = v
+		}
+	}
+	children := make(map[string]optionalKey)
+	for _, n := range []*CryptNode{base, node, theirs} {
+		for name := range n.Children {
+			k, ok := merge3(childOf(base, name), childOf(node, name), childOf(theirs, name))
+			check("child "+name, ok)
+			children[name] = k
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("%.10x: %v: %w", node.Key[:], conflicts, ErrConflict)
+	}
+
+	node.User, node.Group, node.Mode, node.Rdev = user, group, mode, rdev
+	if contentKey != string(node.contentKey) {
+		node.contentKey = theirs.contentKey
+		node.Size = theirs.Size
+		node.content = nil
+	}
+	node.Mtime = mergeTime(base.Mtime, node.Mtime, theirs.Mtime)
+	node.Atime = mergeTime(base.Atime, node.Atime, theirs.Atime)
+	node.Ctime = mergeTime(base.Ctime, node.Ctime, theirs.Ctime)
+	if node.Btime.IsZero() {
+		node.Btime = theirs.Btime
+	}
+	nlink := int64(node.Nlink) + int64(theirs.Nlink) - int64(base.Nlink)
+	node.Nlink = uint32(max(nlink, 0))
+	for attr, v := range xattrs {
+		if !v.ok {
+			delete(node.xattrs, attr)
+			continue
+		}
+		if node.xattrs == nil {
+			node.xattrs = make(map[string][]byte)
+		}
+		node.xattrs[attr] = []byte(v.value)
+	}
+	for name, k := range children {
+		if k == childOf(node, name) {
+			continue
+		}
+		node.RmChild(name)
+		if !k.ok {
+			delete(node.Children, name)
+			continue
+		}
+		if node.Children == nil {
+			node.Children = make(map[string]*CryptNode)
+		}
+		node.Children[name] = node.factory.ExistingNode(name, k.key)
+	}
+	log.WithFields(log.Fields{
+		"name":    node.name,
+		"version": version,
+	}).Debug("Merged concurrent update")
+	node.version = version
+	node.saved = b
+	node.shouldReloadMetadata = false
+	return nil
+}
+
+func xattrOf(node *CryptNode, attr string) optionalValue {
+	v, ok := node.xattrs[attr]
+	return optionalValue{ok: ok, value: string(v)}
+}
+
+func childOf(node *CryptNode, name string) optionalKey {
+	child, ok := node.Children[name]
+	if !ok {
+		return optionalKey{}
+	}
+	return optionalKey{ok: true, key: child.Key}
+}
+
+// mergeTime keeps the time changed on either side, or the latest if both
+// changed it.
+func mergeTime(base, ours, theirs time.Time) time.Time {
+	t, ok := merge3(base.UnixNano(), ours.UnixNano(), theirs.UnixNano())
+	if !ok && theirs.After(ours) {
+		return theirs
+	}
+	if t == ours.UnixNano() {
+		return ours
+	}
+	return theirs
+}
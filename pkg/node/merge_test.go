@@ -0,0 +1,107 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	// Two clients sharing a metadata store, each with its own copy of a
+	// directory.
+	clients := func(t *testing.T) (*CryptNode, *CryptNode) {
+		metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		first := &CryptNodeFactory{Metadata: metadata}
+		dir, err := first.allocateNode()
+		require.NoError(t, err)
+		dir.Mode = fuse.S_IFDIR | 0o755
+		dir.Children = make(map[string]*CryptNode)
+		dir.xattrs = map[string][]byte{"user.a": []byte("a")}
+		require.NoError(t, dir.saveMetadata())
+
+		second := &CryptNodeFactory{Metadata: metadata}
+		other := second.ExistingNode("dir", dir.Key)
+		require.NoError(t, other.LoadMetadata(dir.Key))
+		return dir, other
+	}
+	addChild := func(t *testing.T, dir *CryptNode, name string) *CryptNode {
+		child, err := dir.factory.allocateNode()
+		require.NoError(t, err)
+		dir.Children[name] = child
+		return child
+	}
+	reloaded := func(t *testing.T, dir *CryptNode) *CryptNode {
+		n := &CryptNode{factory: &CryptNodeFactory{Metadata: dir.factory.Metadata}}
+		require.NoError(t, n.LoadMetadata(dir.Key))
+		return n
+	}
+
+	t.Run("merges independent children", func(t *testing.T) {
+		dir, other := clients(t)
+		addChild(t, dir, "removed")
+		require.NoError(t, dir.saveMetadata())
+		require.NoError(t, other.LoadMetadata(dir.Key))
+
+		a := addChild(t, dir, "a")
+		delete(dir.Children, "removed")
+		require.NoError(t, dir.saveMetadata())
+		b := addChild(t, other, "b")
+		require.NoError(t, other.saveMetadata())
+
+		got := reloaded(t, dir)
+		assert.Len(t, got.Children, 2)
+		assert.Equal(t, a.Key, got.Children["a"].Key)
+		assert.Equal(t, b.Key, got.Children["b"].Key)
+		// The local copy has been merged too.
+		assert.NotContains(t, other.Children, "removed")
+		assert.Contains(t, other.Children, "a")
+	})
+
+	t.Run("merges independent attributes", func(t *testing.T) {
+		dir, other := clients(t)
+		dir.Mode = fuse.S_IFDIR | 0o700
+		dir.xattrs["user.b"] = []byte("b")
+		require.NoError(t, dir.saveMetadata())
+		addChild(t, other, "c")
+		other.xattrs["user.a"] = []byte("changed")
+		require.NoError(t, other.saveMetadata())
+
+		got := reloaded(t, dir)
+		assert.EqualValues(t, fuse.S_IFDIR|0o700, got.Mode)
+		assert.Contains(t, got.Children, "c")
+		assert.Equal(t, map[string][]byte{
+			"user.a": []byte("changed"),
+			"user.b": []byte("b"),
+		}, got.xattrs)
+	})
+
+	t.Run("adds up link counts", func(t *testing.T) {
+		dir, other := clients(t)
+		dir.Nlink++
+		require.NoError(t, dir.saveMetadata())
+		other.Nlink++
+		require.NoError(t, other.saveMetadata())
+		assert.EqualValues(t, 3, reloaded(t, dir).Nlink)
+	})
+
+	t.Run("fails on conflicts", func(t *testing.T) {
+		dir, other := clients(t)
+		addChild(t, dir, "same")
+		require.NoError(t, dir.saveMetadata())
+		addChild(t, other, "same")
+		assert.ErrorIs(t, other.saveMetadata(), storage.ErrStalePut)
+		assert.ErrorIs(t, other.rebase(), ErrConflict)
+
+		dir.Mode = fuse.S_IFDIR | 0o700
+		require.NoError(t, dir.saveMetadata())
+		require.NoError(t, other.LoadMetadata(dir.Key))
+		dir.Mode = fuse.S_IFDIR | 0o750
+		require.NoError(t, dir.saveMetadata())
+		other.Mode = fuse.S_IFDIR | 0o705
+		assert.ErrorIs(t, other.saveMetadata(), storage.ErrStalePut)
+		assert.EqualValues(t, fuse.S_IFDIR|0o705, other.Mode)
+	})
+}
@@ -3,6 +3,7 @@ package node
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"syscall"
 	"time"
 
@@ -13,79 +14,307 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrBadMetadata is returned when serialized node metadata can't be decoded.
+var ErrBadMetadata = errors.New("bad metadata")
+
+const (
+	// Nodes serialized in the original layout start with the owner's user ID.
+	// No file can be owned by (uid_t)-1, so that value marks later layouts and
+	// is followed by the layout version. Version 1 was never released.
+	metadataMagic    uint32 = 0xffffffff
+	metadataVersion2 uint8  = 2
+)
+
+// From version 2, metadata is a sequence of fields, each made of a tag, the
+// payload length and the payload. Decoding skips fields with unknown tags, so
+// that fields can be added without bumping the version. Tags must never be
+// reused for a different purpose.
+const (
+	fieldUser uint8 = iota + 1
+	fieldGroup
+	fieldMode
+	fieldMtime
+	fieldAtime
+	fieldCtime
+	fieldSize
+	fieldNlink
+	fieldContentKey
+	// One field per extended attribute: the name, then the value.
+	fieldXattr
+	// One field per child: the name, then the node key.
+	fieldChild
+	fieldRdev
+	fieldBtime
+
+	fieldHeaderLen = 5
+)
+
 func (node *CryptNode) serialize() []byte {
 	// Could use a pool of buffers, to be reused, instead of putting pressure on
 	// the GC.
-	size := 24 + len(node.contentKey)
+	size := 5 + 11*fieldHeaderLen + 60 + len(node.contentKey)
 	for attr, value := range node.xattrs {
-		size += 4 + len(attr) + len(value)
+		size += fieldHeaderLen + 2 + len(attr) + len(value)
 	}
 	for childName := range node.Children {
-		size += 4 + NodeKeyLen + len(childName)
+		size += fieldHeaderLen + 2 + len(childName) + NodeKeyLen
 	}
 	buf := make([]byte, size)
 	b := buf
-	b = bits.Put32(b, node.User)
-	b = bits.Put32(b, node.Group)
-	b = bits.Put32(b, node.Mode)
-	b = bits.Put64(b, uint64(node.Time.UnixNano()))
-	b = bits.Putb(b, node.contentKey)
-	b = bits.Put16(b, uint16(len(node.xattrs)))
+	b = bits.Put32(b, metadataMagic)
+	b = bits.Put8(b, metadataVersion2)
+	b = bits.Put32(putField(b, fieldUser, 4), node.User)
+	b = bits.Put32(putField(b, fieldGroup, 4), node.Group)
+	b = bits.Put32(putField(b, fieldMode, 4), node.Mode)
+	b = bits.Put64(putField(b, fieldMtime, 8), uint64(node.Mtime.UnixNano()))
+	b = bits.Put64(putField(b, fieldAtime, 8), uint64(node.Atime.UnixNano()))
+	b = bits.Put64(putField(b, fieldCtime, 8), uint64(node.Ctime.UnixNano()))
+	b = bits.Put64(putField(b, fieldBtime, 8), btimeNanos(node.Btime))
+	b = bits.Put64(putField(b, fieldSize, 8), node.Size)
+	b = bits.Put32(putField(b, fieldNlink, 4), node.Nlink)
+	b = bits.Put32(putField(b, fieldRdev, 4), node.Rdev)
+	b = putField(b, fieldContentKey, len(node.contentKey))
+	b = b[copy(b, node.contentKey):]
 	for attr, value := range node.xattrs {
+		b = putField(b, fieldXattr, 2+len(attr)+len(value))
 		b = bits.Puts(b, attr)
-		b = bits.Putb(b, value)
+		b = b[copy(b, value):]
 	}
 	for childName, childNode := range node.Children {
+		b = putField(b, fieldChild, 2+len(childName)+NodeKeyLen)
 		b = bits.Puts(b, childName)
-		b = bits.Putb(b, childNode.Key[:])
+		b = b[copy(b, childNode.Key[:]):]
 	}
 	return buf
 }
 
-func (node *CryptNode) unserialize(b []byte) {
-	node.User, b = bits.Get32(b)
-	node.Group, b = bits.Get32(b)
-	node.Mode, b = bits.Get32(b)
-	var unixnano uint64
-	unixnano, b = bits.Get64(b)
-	node.Time = time.Unix(0, int64(unixnano))
-	node.contentKey, b = bits.Getb(b)
-	if node.Mode&fuse.S_IFDIR != 0 {
+// The birth time is unset for nodes saved before it was persisted. That's a zero
+// time.Time, which isn't representable in nanoseconds, so it's saved as 0.
+func btimeNanos(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func btimeFromNanos(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ns))
+}
+
+func putField(b []byte, tag uint8, size int) []byte {
+	b = bits.Put8(b, tag)
+	return bits.Put32(b, uint32(size))
+}
+
+func (node *CryptNode) unserialize(b []byte) error {
+	d := &decoder{b: b}
+	if len(b) >= 5 {
+		if magic, _ := bits.Get32(b); magic == metadataMagic {
+			d.get32()
+			switch version := d.get8(); version {
+			case metadataVersion2:
+				node.unserializeV2(d)
+			default:
+				return fmt.Errorf("unknown version %d: %w", version, ErrBadMetadata)
+			}
+			return d.err
+		}
+	}
+	node.unserializeV0(d)
+	return d.err
+}
+
+// The original layout, which has a single timestamp and no size.
+func (node *CryptNode) unserializeV0(d *decoder) {
+	node.User = d.get32()
+	node.Group = d.get32()
+	node.Mode = d.get32()
+	node.Mtime = time.Unix(0, int64(d.get64()))
+	node.Atime = node.Mtime
+	node.Ctime = node.Mtime
+	node.Nlink = 1
+	node.contentKey = d.getb()
+	node.needsMigration = true
+	node.unserializeEntries(d)
+}
+
+// Xattrs and children as laid out in the original layout, i.e., the children
+// are whatever follows the xattrs.
+func (node *CryptNode) unserializeEntries(d *decoder) {
+	if node.Mode&syscall.S_IFMT == fuse.S_IFDIR {
 		node.Children = make(map[string]*CryptNode)
 	}
-	var nxattr uint16
-	nxattr, b = bits.Get16(b)
+	nxattr := d.get16()
 	if nxattr > 0 {
 		node.xattrs = make(map[string][]byte)
 	}
-	for ; nxattr > 0; nxattr-- {
-		var attr string
-		var value []byte
-		attr, b = bits.Gets(b)
-		value, b = bits.Getb(b)
-		node.xattrs[attr] = value
+	for ; nxattr > 0 && d.err == nil; nxattr-- {
+		attr := d.gets()
+		node.xattrs[attr] = d.getb()
 	}
-	if len(b) > 0 {
-		var childName string
-		var childKey []byte
-		for len(b) > 0 {
-			childName, b = bits.Gets(b)
-			childKey, b = bits.Getb(b)
-			var key [NodeKeyLen]byte
-			copy(key[:], childKey)
-			node.Children[childName] = node.factory.ExistingNode(childName, key)
+	for len(d.b) > 0 && d.err == nil {
+		childName := d.gets()
+		node.addChildKey(d, childName, d.getb())
+	}
+}
+
+func (node *CryptNode) unserializeV2(d *decoder) {
+	for len(d.b) > 0 && d.err == nil {
+		tag := d.get8()
+		f := &decoder{b: d.next(int(d.get32()))}
+		if d.err != nil {
+			return
 		}
+		switch tag {
+		case fieldUser:
+			node.User = f.get32()
+		case fieldGroup:
+			node.Group = f.get32()
+		case fieldMode:
+			node.Mode = f.get32()
+		case fieldMtime:
+			node.Mtime = time.Unix(0, int64(f.get64()))
+		case fieldAtime:
+			node.Atime = time.Unix(0, int64(f.get64()))
+		case fieldCtime:
+			node.Ctime = time.Unix(0, int64(f.get64()))
+		case fieldBtime:
+			node.Btime = btimeFromNanos(f.get64())
+		case fieldSize:
+			node.Size = f.get64()
+		case fieldNlink:
+			node.Nlink = f.get32()
+		case fieldRdev:
+			node.Rdev = f.get32()
+		case fieldContentKey:
+			node.contentKey = f.rest()
+		case fieldXattr:
+			attr := f.gets()
+			if node.xattrs == nil {
+				node.xattrs = make(map[string][]byte)
+			}
+			node.xattrs[attr] = f.rest()
+		case fieldChild:
+			childName := f.gets()
+			node.addChildKey(f, childName, f.rest())
+		default:
+			// Added by a later revision, which knows what to do with it.
+		}
+		if f.err != nil {
+			d.err = fmt.Errorf("field %d: %w", tag, f.err)
+		}
+	}
+	if node.Mode&syscall.S_IFMT == fuse.S_IFDIR && node.Children == nil {
+		node.Children = make(map[string]*CryptNode)
+	}
+}
+
+func (node *CryptNode) addChildKey(d *decoder, childName string, childKey []byte) {
+	if d.err != nil {
+		return
+	}
+	if len(childKey) != NodeKeyLen {
+		d.err = fmt.Errorf("child %q has a %d bytes key: %w", childName, len(childKey), ErrBadMetadata)
+		return
+	}
+	if node.Children == nil {
+		node.Children = make(map[string]*CryptNode)
+	}
+	var key [NodeKeyLen]byte
+	copy(key[:], childKey)
+	node.Children[childName] = node.factory.ExistingNode(childName, key)
+}
+
+// decoder wraps the bits.Get* functions with bounds checks. After the first
+// underflow, err is set and all methods return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = fmt.Errorf("need %d bytes, %d left: %w", n, len(d.b), ErrBadMetadata)
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) get8() uint8 {
+	if b := d.next(1); b != nil {
+		v, _ := bits.Get8(b)
+		return v
+	}
+	return 0
+}
+
+func (d *decoder) get16() uint16 {
+	if b := d.next(2); b != nil {
+		v, _ := bits.Get16(b)
+		return v
+	}
+	return 0
+}
+
+func (d *decoder) get32() uint32 {
+	if b := d.next(4); b != nil {
+		v, _ := bits.Get32(b)
+		return v
+	}
+	return 0
+}
+
+func (d *decoder) get64() uint64 {
+	if b := d.next(8); b != nil {
+		v, _ := bits.Get64(b)
+		return v
 	}
+	return 0
 }
 
+// Returns a copy, as the decoded buffer might be owned by a store.
+func (d *decoder) getb() []byte {
+	return append([]byte{}, d.next(int(d.get16()))...)
+}
+
+func (d *decoder) gets() string {
+	return string(d.next(int(d.get16())))
+}
+
+func (d *decoder) rest() []byte {
+	return append([]byte{}, d.next(len(d.b))...)
+}
+
+// saveMetadata puts the metadata. If the put is stale, the local changes are
+// merged with the latest version and put again, unless they conflict.
 func (node *CryptNode) saveMetadata() error {
-	value := node.serialize()
-	err := node.factory.Metadata.Put(node.version+1, node.Key[:], value)
-	if err != nil {
-		return err
+	for attempt := 1; ; attempt++ {
+		value := node.serialize()
+		err := node.factory.Metadata.Put(node.version+1, node.Key[:], value)
+		if err == nil {
+			node.version++
+			node.saved = value
+			return nil
+		}
+		if !errors.Is(err, storage.ErrStalePut) || attempt == maxSaveAttempts {
+			return err
+		}
+		if merr := node.rebase(); merr != nil {
+			log.WithFields(log.Fields{
+				"err":  merr,
+				"name": node.name,
+			}).Warn("Could not merge concurrent update")
+			return err
+		}
 	}
-	node.version++
-	return nil
 }
 
 // LoadMetadata loads metadata for a node
@@ -96,25 +325,13 @@ func (node *CryptNode) LoadMetadata(key [NodeKeyLen]byte) error {
 	}
 	node.Key = key
 	node.version = version
-	node.unserialize(b)
-	return nil
+	node.saved = b
+	return node.unserialize(b)
 }
 
 func (node *CryptNode) sync() syscall.Errno {
-	if node.shouldSaveContent {
-		var err error
-		prev := node.contentKey
-		node.contentKey, err = node.factory.Blobs.Put(node.content)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Error("Could not save content")
-			return syscall.EIO
-		}
-		node.shouldSaveContent = false
-		if !bytes.Equal(prev, node.contentKey) {
-			node.shouldSaveMetadata = true
-		}
+	if errno := node.saveContent(); errno != 0 {
+		return errno
 	}
 	if node.shouldSaveMetadata {
 		err := node.saveMetadata()
@@ -125,9 +342,118 @@ func (node *CryptNode) sync() syscall.Errno {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("Could not save metadata")
+			if errors.Is(err, storage.ErrForbidden) {
+				return syscall.EACCES
+			}
 			return syscall.EIO
 		}
 		node.shouldSaveMetadata = false
 	}
 	return fs.OK
 }
+
+// saveContent saves the content if needed, marking the metadata for saving if
+// the content key changed.
+func (node *CryptNode) saveContent() syscall.Errno {
+	if !node.shouldSaveContent {
+		return fs.OK
+	}
+	var err error
+	prev := node.contentKey
+	node.contentKey, err = node.content.save(node.factory.Blobs)
+	if err != nil {
+		node.contentKey = prev
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Could not save content")
+		return syscall.EIO
+	}
+	node.shouldSaveContent = false
+	node.Size = uint64(node.content.size)
+	if !bytes.Equal(prev, node.contentKey) {
+		node.shouldSaveMetadata = true
+	}
+	return fs.OK
+}
+
+// commit saves the metadata of the nodes all at once if the metadata store
+// supports transactions, and one by one otherwise, in which case a failure may
+// leave some of them saved. Content is not saved.
+// Call with the locks of all nodes held.
+func (factory *CryptNodeFactory) commit(nodes ...*CryptNode) syscall.Errno {
+	unique := make([]*CryptNode, 0, len(nodes))
+	seen := make(map[*CryptNode]bool, len(nodes))
+	for _, node := range nodes {
+		if !seen[node] {
+			seen[node] = true
+			unique = append(unique, node)
+		}
+	}
+	t, ok := factory.Metadata.(storage.TransactionalStore)
+	if !ok {
+		return commitEach(unique)
+	}
+	mutations := make([]storage.Mutation, len(unique))
+	var err error
+	for attempt := 1; ; attempt++ {
+		for i, node := range unique {
+			mutations[i] = storage.Mutation{
+				Version: node.version + 1,
+				Key:     node.Key[:],
+				Value:   node.serialize(),
+			}
+		}
+		err = t.PutAll(mutations)
+		if !errors.Is(err, storage.ErrStalePut) || attempt == maxSaveAttempts {
+			break
+		}
+		// Which nodes are stale is not known, the others merge as no-ops.
+		if merr := rebaseAll(unique); merr != nil {
+			log.WithField("err", merr).Warn("Could not merge concurrent update")
+			break
+		}
+	}
+	if errors.Is(err, storage.ErrNoTransactions) {
+		return commitEach(unique)
+	}
+	if err != nil {
+		if errors.Is(err, storage.ErrStalePut) {
+			for _, node := range unique {
+				node.shouldReloadMetadata = true
+			}
+		}
+		log.WithFields(log.Fields{
+			"err":   err,
+			"nodes": len(unique),
+		}).Error("Could not commit metadata")
+		if errors.Is(err, storage.ErrForbidden) {
+			return syscall.EACCES
+		}
+		return syscall.EIO
+	}
+	for i, node := range unique {
+		node.version++
+		node.saved = mutations[i].Value
+		node.shouldSaveMetadata = false
+	}
+	return fs.OK
+}
+
+func rebaseAll(nodes []*CryptNode) error {
+	for _, node := range nodes {
+		if err := node.rebase(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func commitEach(nodes []*CryptNode) syscall.Errno {
+	for _, node := range nodes {
+		node.shouldSaveMetadata = true
+		if errno := node.sync(); errno != 0 {
+			return errno
+		}
+	}
+	return fs.OK
+}
@@ -5,8 +5,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/EncrypteDL/CryptFS/pkg/bits"
 	"github.com/EncrypteDL/CryptFS/pkg/message"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,20 +32,153 @@ func TestNodeSerialization(t *testing.T) {
 		assert.Equal(t, before.User, after.User)
 		assert.Equal(t, before.Group, after.Group)
 		assert.Equal(t, before.Mode, after.Mode)
-		assert.Equal(t, before.Time.UnixNano(), after.Time.UnixNano())
+		assert.Equal(t, before.Mtime.UnixNano(), after.Mtime.UnixNano())
+		assert.Equal(t, before.Atime.UnixNano(), after.Atime.UnixNano())
+		assert.Equal(t, before.Ctime.UnixNano(), after.Ctime.UnixNano())
+		assert.Equal(t, before.Btime.UnixNano(), after.Btime.UnixNano())
+		assert.Equal(t, before.Size, after.Size)
+		assert.Equal(t, before.Nlink, after.Nlink)
+		assert.Equal(t, before.Rdev, after.Rdev)
+		assert.False(t, after.needsMigration)
 		assert.Equal(t, before.version, after.version)
 		assert.EqualValues(t, before.Key, after.Key)
 		assert.EqualValues(t, before.contentKey, after.contentKey)
 	}
 }
 
+func TestNodeWithoutBtimeSerialization(t *testing.T) {
+	g := NewInodeNumbersGenerator()
+	go g.Start()
+	defer g.Stop()
+	factory := &CryptNodeFactory{InodeGenerator: g}
+	before := randomNode(t, factory)
+	before.Btime = time.Time{}
+	after, err := factory.allocateNode()
+	require.Nil(t, err)
+	require.Nil(t, after.unserialize(before.serialize()))
+	assert.True(t, after.Btime.IsZero())
+	assert.Equal(t, before.Mtime.UnixNano(), after.Mtime.UnixNano())
+}
+
+func TestNodeUnserialize(t *testing.T) {
+	g := NewInodeNumbersGenerator()
+	go g.Start()
+	defer g.Stop()
+	factory := &CryptNodeFactory{InodeGenerator: g}
+
+	dir := randomNode(t, factory)
+	dir.Mode = fuse.S_IFDIR | 0o755
+	dir.Children = make(map[string]*CryptNode)
+	for i := 0; i < 3; i++ {
+		dir.Children[message.RandomString()] = randomNode(t, factory)
+	}
+	serialized := dir.serialize()
+
+	t.Run("children", func(t *testing.T) {
+		after, err := factory.allocateNode()
+		require.NoError(t, err)
+		require.NoError(t, after.unserialize(serialized))
+		require.Len(t, after.Children, len(dir.Children))
+		for name, child := range dir.Children {
+			require.Contains(t, after.Children, name)
+			assert.Equal(t, child.Key, after.Children[name].Key)
+		}
+		assert.Equal(t, len(dir.xattrs), len(after.xattrs))
+	})
+
+	t.Run("truncated input", func(t *testing.T) {
+		for i := 0; i < len(serialized); i++ {
+			after, err := factory.allocateNode()
+			require.NoError(t, err)
+			err = after.unserialize(serialized[:i])
+			if err != nil {
+				assert.ErrorIs(t, err, ErrBadMetadata)
+			}
+		}
+		after, err := factory.allocateNode()
+		require.NoError(t, err)
+		assert.ErrorIs(t, after.unserialize(serialized[:len(serialized)-1]), ErrBadMetadata)
+	})
+
+	t.Run("unknown fields are skipped", func(t *testing.T) {
+		extended := append([]byte{}, serialized...)
+		extended = append(extended, make([]byte, fieldHeaderLen+3)...)
+		bits.Put32(bits.Put8(extended[len(serialized):], 200), 3)
+		after, err := factory.allocateNode()
+		require.NoError(t, err)
+		require.NoError(t, after.unserialize(extended))
+		assert.Equal(t, dir.Mode, after.Mode)
+		assert.Len(t, after.Children, len(dir.Children))
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		b := append([]byte{}, serialized...)
+		b[4] = 42
+		after, err := factory.allocateNode()
+		require.NoError(t, err)
+		assert.ErrorIs(t, after.unserialize(b), ErrBadMetadata)
+	})
+}
+
+func TestNodeMigration(t *testing.T) {
+	g := NewInodeNumbersGenerator()
+	go g.Start()
+	defer g.Stop()
+	versioned := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	factory := &CryptNodeFactory{InodeGenerator: g, Metadata: versioned, Blobs: blobs}
+
+	content := []byte("saved before the size was persisted")
+	contentKey, err := blobs.Put(content)
+	require.NoError(t, err)
+	mtime := time.Unix(0, rand.Int63())
+
+	// The original layout: user, group, mode, time and content key, followed
+	// by the (here empty) xattrs.
+	v0 := make([]byte, 24+len(contentKey))
+	b := bits.Put32(v0, 1000)
+	b = bits.Put32(b, 1000)
+	b = bits.Put32(b, fuse.S_IFREG|0o644)
+	b = bits.Put64(b, uint64(mtime.UnixNano()))
+	b = bits.Putb(b, contentKey)
+	bits.Put16(b, 0)
+	var key [NodeKeyLen]byte
+	copy(key[:], message.RandomBytes())
+	require.NoError(t, versioned.Put(1, key[:], v0))
+
+	node := factory.ExistingNode("legacy", key)
+	require.NoError(t, node.LoadMetadata(key))
+	assert.True(t, node.needsMigration)
+	assert.EqualValues(t, 1000, node.User)
+	assert.EqualValues(t, fuse.S_IFREG|0o644, node.Mode)
+	assert.Equal(t, mtime.UnixNano(), node.Ctime.UnixNano())
+	assert.EqualValues(t, 1, node.Nlink)
+	assert.EqualValues(t, contentKey, node.contentKey)
+
+	require.Zero(t, node.migrateIfNeeded())
+	assert.EqualValues(t, len(content), node.Size)
+
+	migrated := factory.ExistingNode("legacy", key)
+	require.NoError(t, migrated.LoadMetadata(key))
+	assert.False(t, migrated.needsMigration)
+	assert.EqualValues(t, 2, migrated.version)
+	assert.EqualValues(t, len(content), migrated.Size)
+	assert.EqualValues(t, contentKey, migrated.contentKey)
+}
+
 func randomNode(t *testing.T, factory *CryptNodeFactory) *CryptNode {
 	node, err := factory.allocateNode()
 	require.Nil(t, err)
 	node.User = rand.Uint32()
 	node.Group = rand.Uint32()
 	node.Mode = rand.Uint32()
-	node.Time = time.Unix(rand.Int63(), rand.Int63())
+	node.Mtime = time.Unix(rand.Int63(), rand.Int63())
+	node.Atime = time.Unix(rand.Int63(), rand.Int63())
+	node.Ctime = time.Unix(rand.Int63(), rand.Int63())
+	node.Btime = time.Unix(rand.Int63(), rand.Int63())
+	node.Size = rand.Uint64()
+	node.Nlink = rand.Uint32()
+	node.Rdev = rand.Uint32()
 	keyLen := rand.Intn(10)
 	node.contentKey = make([]byte, keyLen)
 	rand.Read(node.contentKey)
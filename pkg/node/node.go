@@ -3,11 +3,15 @@ package node
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
 	"syscall"
 	"time"
 
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	sync "github.com/sasha-s/go-deadlock"
@@ -38,7 +42,21 @@ type CryptNode struct {
 	User  uint32
 	Group uint32
 	Mode  uint32
-	Time  time.Time
+	Mtime time.Time
+	Atime time.Time
+	Ctime time.Time
+	// Creation time, zero for nodes saved before it was persisted.
+	Btime time.Time
+	Nlink uint32
+	// Only makes sense for device nodes.
+	Rdev uint32
+
+	// Size of the content, as of the last save. Persisted so that attributes
+	// can be reported without loading the content.
+	Size uint64
+
+	// Set for nodes saved in a layout that doesn't persist the size.
+	needsMigration bool
 
 	// Not persisted, only for logging
 	name string
@@ -52,14 +70,24 @@ type CryptNode struct {
 	// server).
 	version uint64
 
+	// The metadata as of version, i.e., as last loaded or saved: the base for
+	// merging local changes with those made by other clients.
+	saved []byte
+
 	xattrs map[string][]byte
 
-	// Only makes sense for regular files or symlinks:
+	// Only makes sense for regular files or symlinks. The content is nil until
+	// loaded.
 	contentKey []byte
-	content    []byte
+	content    *chunkedContent
 
 	// Only makes sense for directories:
 	Children map[string]*CryptNode
+
+	// The owners of the fcntl locks taken on this node through this mount, and
+	// the process that took them, so that they can be released when it closes
+	// the file.
+	lockOwners map[uint64]uint32
 }
 
 // Setxattr ...
@@ -88,16 +116,29 @@ func (node *CryptNode) Setxattr(ctx context.Context, attr string, data []byte, f
 	// attribute does not already exist.
 	node.mu.Lock()
 	defer node.mu.Unlock()
+	if errno := node.checkSetxattr(ctx, attr); errno != 0 {
+		return errno
+	}
 	if node.xattrs == nil {
 		node.xattrs = make(map[string][]byte)
 	}
+	rbmode := node.Mode
+	if attr == aclAccessXattr || attr == aclDefaultXattr {
+		mode, errno := node.setACLXattr(attr, data)
+		if errno != 0 {
+			return errno
+		}
+		node.Mode = mode
+	}
 	switch flags {
 	case unix.XATTR_CREATE:
 		if _, ok := node.xattrs[attr]; ok {
+			node.Mode = rbmode
 			return syscall.EEXIST
 		}
 	case unix.XATTR_REPLACE:
 		if _, ok := node.xattrs[attr]; !ok {
+			node.Mode = rbmode
 			return syscall.ENODATA
 		}
 	}
@@ -107,6 +148,7 @@ func (node *CryptNode) Setxattr(ctx context.Context, attr string, data []byte, f
 	errno := node.sync()
 	// Rollback.
 	if errno != 0 {
+		node.Mode = rbmode
 		if rbdata != nil {
 			node.xattrs[attr] = rbdata
 		} else {
@@ -136,10 +178,58 @@ func (node *CryptNode) Getxattr(ctx context.Context, attr string, dest []byte) (
 	return uint32(copy(dest, value)), 0
 }
 
+// Listxattr should read all attributes (null terminated) into
+// `dest`. If the `dest` buffer is too small, it should return
+// ERANGE and the correct size.
+func (node *CryptNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	attrs := make([]string, 0, len(node.xattrs))
+	size := 0
+	for attr := range node.xattrs {
+		attrs = append(attrs, attr)
+		size += len(attr) + 1
+	}
+	if size > len(dest) {
+		return uint32(size), syscall.ERANGE
+	}
+	sort.Strings(attrs)
+	b := dest[:0]
+	for _, attr := range attrs {
+		b = append(b, attr...)
+		b = append(b, 0)
+	}
+	return uint32(len(b)), 0
+}
+
+// Removexattr should delete the given attribute.
+func (node *CryptNode) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	rbdata, ok := node.xattrs[attr]
+	if !ok {
+		return syscall.ENODATA
+	}
+	if errno := node.checkSetxattr(ctx, attr); errno != 0 {
+		return errno
+	}
+	delete(node.xattrs, attr)
+	node.shouldSaveMetadata = true
+	errno := node.sync()
+	// Rollback.
+	if errno != 0 {
+		node.xattrs[attr] = rbdata
+	}
+	return errno
+}
+
 // Rmdir ...
 func (node *CryptNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
+	if errno := node.checkAccess(ctx, unix.W_OK|unix.X_OK); errno != 0 {
+		return errno
+	}
 	child := node.Children[name]
 	// go-fuse should know to call into Rmdir only if the child exists.
 	// Since a panic() here would break the mount, let's be defensive anyway.
@@ -155,28 +245,72 @@ func (node *CryptNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return syscall.ENOTEMPTY
 	}
 	delete(node.Children, name)
+	restoreTimes := node.touch()
 	node.shouldSaveMetadata = true
 	errno := node.sync()
 	// Rollback.
 	if errno != 0 {
 		node.Children[name] = child
+		restoreTimes()
+		return errno
 	}
-	return errno
+	node.factory.forget(child.Key)
+	return 0
 }
 
-// Unlink ...
+// Unlink removes a name of the child. The child itself is only dropped once
+// its last name is gone.
 func (node *CryptNode) Unlink(ctx context.Context, name string) syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
+	if errno := node.checkAccess(ctx, unix.W_OK|unix.X_OK); errno != 0 {
+		return errno
+	}
 	child := node.Children[name]
+	if child == nil {
+		log.WithFields(log.Fields{
+			"name": name,
+		}).Warn("Asked to remove file that does not exist")
+		return syscall.ENOENT
+	}
+	child.mu.Lock()
+	defer child.mu.Unlock()
+	if errno := child.ensureMetadataLoaded(); errno != 0 {
+		return errno
+	}
 	delete(node.Children, name)
+	restoreTimes := node.touch()
 	node.shouldSaveMetadata = true
-	errno := node.sync()
-	// Rollback.
-	if errno != 0 && child != nil {
+	if errno := node.sync(); errno != 0 {
+		// Rollback.
 		node.Children[name] = child
+		restoreTimes()
+		return errno
+	}
+	child.dropLink()
+	return 0
+}
+
+// dropLink accounts for a name of the node being removed. With names left, the
+// link count is saved on a best-effort basis: failing that, it stays too high,
+// which only delays reclaiming the space of the node.
+// Call with lock held.
+func (node *CryptNode) dropLink() {
+	if node.Nlink > 0 {
+		node.Nlink--
+	}
+	node.Ctime = time.Now()
+	if node.Nlink == 0 {
+		node.factory.forget(node.Key)
+		return
+	}
+	node.shouldSaveMetadata = true
+	if errno := node.sync(); errno != 0 {
+		log.WithFields(log.Fields{
+			"name":  node.name,
+			"nlink": node.Nlink,
+		}).Warn("Could not save link count")
 	}
-	return errno
 }
 
 // Call with lock held.
@@ -184,6 +318,25 @@ func (node *CryptNode) fullPath() string {
 	return node.Path(node.factory.Root.EmbeddedInode())
 }
 
+// ensureMetadataLoaded loads the metadata of a node known only by its key, or
+// reloads it if it's gone stale.
+// Call with lock held.
+func (node *CryptNode) ensureMetadataLoaded() syscall.Errno {
+	if node.Mode == modeNotLoaded {
+		if err := node.LoadMetadata(node.Key); err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"name": node.name,
+			}).Error("could not load metadata")
+			if errors.Is(err, storage.ErrForbidden) {
+				return syscall.EACCES
+			}
+			return syscall.EIO
+		}
+	}
+	return node.reloadIfNeeded()
+}
+
 // Call with lock held.
 func (node *CryptNode) reloadIfNeeded() syscall.Errno {
 	if !node.shouldReloadMetadata {
@@ -201,11 +354,19 @@ func (node *CryptNode) reloadIfNeeded() syscall.Errno {
 	node.User = nn.User
 	node.Group = nn.Group
 	node.Mode = nn.Mode
-	node.Time = nn.Time
+	node.Mtime = nn.Mtime
+	node.Atime = nn.Atime
+	node.Ctime = nn.Ctime
+	node.Btime = nn.Btime
+	node.Nlink = nn.Nlink
+	node.Rdev = nn.Rdev
+	node.Size = nn.Size
+	node.needsMigration = nn.needsMigration
 	if node.version != nn.version {
 		logger.Debugf("Version changed from %d to %d", node.version, nn.version)
 		node.version = nn.version
 	}
+	node.saved = nn.saved
 	node.xattrs = nn.xattrs
 	if !bytes.Equal(node.contentKey, nn.contentKey) {
 		logger.Debug("Content changed, marking for lazy reload")
@@ -222,9 +383,11 @@ func (node *CryptNode) reloadIfNeeded() syscall.Errno {
 			if prev.Key == child.Key {
 				logger.Debug("Child kept same key - no op")
 			} else {
-				logger.Debug("Child changed key - updating that and marking for reload")
-				prev.Key = child.Key
-				prev.shouldReloadMetadata = true
+				// The previous node may have other names, e.g., be hard linked
+				// from another directory, so it's replaced rather than updated.
+				logger.Debug("Child changed key - replacing")
+				node.RmChild(name)
+				node.Children[name] = child
 			}
 		} else {
 			logger.Debug("Child is new, adding for lazy loading")
@@ -251,8 +414,11 @@ func (node *CryptNode) Opendir(ctx context.Context) syscall.Errno {
 	if errno := node.reloadIfNeeded(); errno != 0 {
 		return errno
 	}
-	for _, childNode := range node.Children {
-		if errno := node.ensureChildLoaded(ctx, childNode); errno != 0 {
+	if errno := node.checkAccess(ctx, unix.R_OK); errno != 0 {
+		return errno
+	}
+	for name, childNode := range node.Children {
+		if errno := node.ensureChildLoaded(ctx, name, childNode); errno != 0 {
 			return errno
 		}
 	}
@@ -266,58 +432,103 @@ func (node *CryptNode) Lookup(ctx context.Context, name string, out *fuse.EntryO
 	if errno := node.reloadIfNeeded(); errno != 0 {
 		return nil, errno
 	}
+	if errno := node.checkAccess(ctx, unix.X_OK); errno != 0 {
+		return nil, errno
+	}
 	child := node.Children[name]
 	if child == nil {
 		return nil, syscall.ENOENT
 	}
-	if errno := node.ensureChildLoaded(ctx, child); errno != 0 {
+	if errno := node.ensureChildLoaded(ctx, name, child); errno != 0 {
 		return nil, errno
 	}
+	child.mu.Lock()
+	defer child.mu.Unlock()
 
-	// TODO Should persist the content size in the metadata instead of having to
-	// load the contents just for lookup!
-	//
-	// In the below, if we don't report the size, any read to a mmap-ed file
-	// whose *dinoNode content hasn't been loaded would cause a SIGBUS.
-	// We wouldn't even get i/o calls to the *dinoNode.
-	if errno := child.ensureContentLoaded(); errno != 0 {
+	// If we don't report the size, any read to a mmap-ed file whose *CryptNode
+	// content hasn't been loaded would cause a SIGBUS. We wouldn't even get i/o
+	// calls to the *CryptNode.
+	if errno := child.migrateIfNeeded(); errno != 0 {
 		return nil, errno
 	}
-	out.Uid = child.User
-	out.Gid = child.Group
-	out.Mode = child.Mode
-	out.Atime = uint64(child.Time.Unix())
-	out.Mtime = uint64(child.Time.Unix())
-	out.Size = uint64(len(child.content))
+	child.fillAttr(&out.Attr)
 
 	return child.EmbeddedInode(), 0
 }
 
 // Call with lock held.
-func (node *CryptNode) ensureChildLoaded(ctx context.Context, childNode *CryptNode) syscall.Errno {
-	if childNode.Mode != modeNotLoaded {
+func (node *CryptNode) fillAttr(out *fuse.Attr) {
+	out.Uid = node.User
+	out.Gid = node.Group
+	out.Mode = node.Mode
+	out.Nlink = node.Nlink
+	out.Rdev = node.Rdev
+	out.SetTimes(&node.Atime, &node.Mtime, &node.Ctime)
+	out.Size = node.size()
+}
+
+// Nodes saved before the size was persisted need their content loaded once to
+// know it. They are then saved in the current layout on a best-effort basis:
+// failing that, the same happens again the next time they are loaded.
+// Call with lock held.
+func (node *CryptNode) migrateIfNeeded() syscall.Errno {
+	if !node.needsMigration {
 		return 0
 	}
-	if err := childNode.LoadMetadata(childNode.Key); err != nil {
+	if errno := node.ensureContentLoaded(); errno != 0 {
+		return errno
+	}
+	node.Size = node.size()
+	node.needsMigration = false
+	node.shouldSaveMetadata = true
+	if errno := node.sync(); errno != 0 {
 		log.WithFields(log.Fields{
-			"err":    err,
-			"child":  childNode.name,
-			"parent": node.fullPath(),
-		}).Error("could not load metadata")
-		return syscall.EIO
+			"name": node.name,
+		}).Warn("Could not migrate metadata")
+	}
+	return 0
+}
+
+// A child with several names may have been loaded through another one, in
+// which case it only needs adding under this name.
+// Call with lock held.
+func (node *CryptNode) ensureChildLoaded(ctx context.Context, name string, childNode *CryptNode) syscall.Errno {
+	if childNode.Mode == modeNotLoaded {
+		if err := childNode.LoadMetadata(childNode.Key); err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"child":  name,
+				"parent": node.fullPath(),
+			}).Error("could not load metadata")
+			if errors.Is(err, storage.ErrForbidden) {
+				return syscall.EACCES
+			}
+			return syscall.EIO
+		}
+	} else if node.GetChild(name) != nil {
+		return 0
 	}
-	node.AddChild(childNode.name, node.NewInode(ctx, childNode, fs.StableAttr{
+	// Returns the existing inode if the child already has one.
+	node.AddChild(name, node.NewInode(ctx, childNode, fs.StableAttr{
 		Mode: childNode.Mode,
 		Ino:  node.factory.InodeGenerator.Next(),
 	}), false)
 	return 0
 }
 
-// Flush ...
+// Flush is called each time a file is closed, which releases the fcntl locks
+// the process held on it.
 func (node *CryptNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	errno := node.flush()
+	node.releaseLocks(ctx)
+	return errno
+}
+
+func (node *CryptNode) flush() syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	prev := node.contentKey
+	prevSize := node.Size
 	errno := node.sync()
 	if errno != 0 {
 		fmt.Printf("%#v\n", prev)
@@ -327,19 +538,23 @@ func (node *CryptNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno
 		fmt.Println("rolling back...")
 		// Rollback.
 		node.contentKey = prev
+		node.Size = prevSize
 		node.content = nil
 	}
 	return errno
 }
 
-// Release would sync writes to mmap-ed files.
+// Release would sync writes to mmap-ed files. It also releases the flock lock
+// taken through the file, now that it has been closed for good.
 func (node *CryptNode) Release(ctx context.Context, f fs.FileHandle) syscall.Errno {
-	return node.Flush(ctx, f)
+	errno := node.flush()
+	node.releaseFlock(f)
+	return errno
 }
 
 // Fsync ...
 func (node *CryptNode) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
-	return node.Flush(ctx, f)
+	return node.flush()
 }
 
 // Getattr ...
@@ -349,15 +564,10 @@ func (node *CryptNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.A
 	if errno := node.reloadIfNeeded(); errno != 0 {
 		return errno
 	}
-	if errno := node.ensureContentLoaded(); errno != 0 {
+	if errno := node.migrateIfNeeded(); errno != 0 {
 		return errno
 	}
-	out.Uid = node.User
-	out.Gid = node.Group
-	out.Mode = node.Mode
-	out.Atime = uint64(node.Time.Unix())
-	out.Mtime = uint64(node.Time.Unix())
-	out.Size = uint64(len(node.content))
+	node.fillAttr(&out.Attr)
 	return 0
 }
 
@@ -370,17 +580,11 @@ func (node *CryptNode) Create(ctx context.Context, name string, flags uint32, mo
 		return nil, nil, 0, errno
 	}
 	defer child.mu.Unlock()
-	child.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
+	if errno := node.factory.commit(child, node); errno != 0 {
 		rollback()
 		return nil, nil, 0, errno
 	}
-	node.shouldSaveMetadata = true
-	if errno := node.sync(); errno != 0 {
-		rollback()
-		return nil, nil, 0, errno
-	}
-	return child.EmbeddedInode(), nil, 0, 0
+	return child.EmbeddedInode(), &openFile{writable: openAccess(flags)&unix.W_OK != 0}, 0, 0
 }
 
 // Mkdir ...
@@ -393,13 +597,7 @@ func (node *CryptNode) Mkdir(ctx context.Context, name string, mode uint32, out
 	}
 	defer child.mu.Unlock()
 	child.Children = make(map[string]*CryptNode)
-	child.shouldSaveMetadata = true
-	node.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
-		rollback()
-		return nil, errno
-	}
-	if errno := node.sync(); errno != 0 {
+	if errno := node.factory.commit(child, node); errno != 0 {
 		rollback()
 		return nil, errno
 	}
@@ -415,22 +613,99 @@ func (node *CryptNode) Symlink(ctx context.Context, target, name string, out *fu
 		return nil, errno
 	}
 	defer child.mu.Unlock()
+	child.content = newChunkedContent(node.factory.chunkSize())
+	if err := child.content.writeAt(node.factory.Blobs, []byte(target), 0); err != nil {
+		rollback()
+		return nil, syscall.EIO
+	}
 	child.shouldSaveContent = true
-	child.content = []byte(target)
-	child.shouldSaveMetadata = true
-	node.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
+	if errno := child.saveContent(); errno != 0 {
 		rollback()
 		return nil, errno
 	}
-	if errno := node.sync(); errno != 0 {
+	if errno := node.factory.commit(child, node); errno != 0 {
+		rollback()
+		return nil, errno
+	}
+	return child.EmbeddedInode(), 0
+}
+
+// Link adds a name for an existing node, i.e., a hard link. The link count and
+// the new entry are committed at once.
+func (node *CryptNode) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	targetNode := target.EmbeddedInode().Operations().(*CryptNode)
+	if targetNode == node {
+		return nil, syscall.EPERM
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if errno := node.reloadIfNeeded(); errno != 0 {
+		return nil, errno
+	}
+	if errno := node.checkAccess(ctx, unix.W_OK|unix.X_OK); errno != 0 {
+		return nil, errno
+	}
+	if node.Children[name] != nil {
+		return nil, syscall.EEXIST
+	}
+	targetNode.mu.Lock()
+	defer targetNode.mu.Unlock()
+	if errno := targetNode.reloadIfNeeded(); errno != 0 {
+		return nil, errno
+	}
+	if targetNode.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return nil, syscall.EPERM
+	}
+	if targetNode.Nlink == math.MaxUint32 {
+		return nil, syscall.EMLINK
+	}
+
+	prevCtime := targetNode.Ctime
+	targetNode.Nlink++
+	targetNode.Ctime = time.Now()
+	node.Children[name] = targetNode
+	restoreTimes := node.touch()
+	if errno := node.factory.commit(targetNode, node); errno != 0 {
+		// Rollback.
+		delete(node.Children, name)
+		restoreTimes()
+		targetNode.Nlink--
+		targetNode.Ctime = prevCtime
+		return nil, errno
+	}
+	targetNode.fillAttr(&out.Attr)
+	return targetNode.EmbeddedInode(), 0
+}
+
+// Mknod creates a device node, FIFO, socket or regular file, with no content.
+func (node *CryptNode) Mknod(ctx context.Context, name string, mode uint32, dev uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK, syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFREG:
+	default:
+		return nil, syscall.EINVAL
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	child, rollback, errno := node.createLockedChild(ctx, name, mode, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer child.mu.Unlock()
+	child.Rdev = dev
+	if errno := node.factory.commit(child, node); errno != 0 {
 		rollback()
 		return nil, errno
 	}
+	child.fillAttr(&out.Attr)
 	return child.EmbeddedInode(), 0
 }
 
+// The child is owned by the caller, and inherits the default ACL of the node if
+// any.
 func (node *CryptNode) createLockedChild(ctx context.Context, name string, mode uint32, orMode uint32) (child *CryptNode, rollback func(), errno syscall.Errno) {
+	if errno := node.checkAccess(ctx, unix.W_OK|unix.X_OK); errno != 0 {
+		return nil, nil, errno
+	}
 	id := fs.StableAttr{
 		Mode: mode | orMode,
 		Ino:  node.factory.InodeGenerator.Next(),
@@ -446,13 +721,28 @@ func (node *CryptNode) createLockedChild(ctx context.Context, name string, mode
 	}
 	child.name = name
 	child.Mode = id.Mode
+	if caller, ok := fuse.FromContext(ctx); ok {
+		child.User = caller.Uid
+		child.Group = caller.Gid
+	}
+	if err := child.inheritACL(node); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"child":  name,
+			"parent": node.fullPath(),
+		}).Error("Could not inherit ACL")
+		node.factory.forget(child.Key)
+		return nil, nil, syscall.EIO
+	}
 	node.Children[name] = child
+	restoreTimes := node.touch()
 	// Lock before adding to the tree. Caller will unlock.
 	child.mu.Lock()
 	node.AddChild(name, node.NewInode(ctx, child, id), false)
 	return child, func() {
 		node.RmChild(name)
 		delete(node.Children, name)
+		restoreTimes()
 	}, 0
 }
 
@@ -463,95 +753,244 @@ func (node *CryptNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle
 	if errno := node.reloadIfNeeded(); errno != 0 {
 		return nil, 0, errno
 	}
-	return nil, 0, node.ensureContentLoaded()
+	if errno := node.checkAccess(ctx, openAccess(flags)); errno != 0 {
+		return nil, 0, errno
+	}
+	if errno := node.ensureContentLoaded(); errno != 0 {
+		return nil, 0, errno
+	}
+	return &openFile{writable: openAccess(flags)&unix.W_OK != 0}, 0, 0
 }
 
-func (node *CryptNode) ensureContentLoaded() syscall.Errno {
-	logger := log.WithFields(log.Fields{
-		"name": node.name,
-	})
-	if node.shouldSaveContent {
-		return 0
+// openAccess returns the permissions needed to open a file with the flags.
+func openAccess(flags uint32) uint32 {
+	var want uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		want = unix.R_OK
+	case syscall.O_WRONLY:
+		want = unix.W_OK
+	case syscall.O_RDWR:
+		want = unix.R_OK | unix.W_OK
 	}
-	if node.Mode&fuse.S_IFREG == 0 && node.Mode&fuse.S_IFLNK == 0 {
-		return 0
+	if flags&syscall.O_TRUNC != 0 {
+		want |= unix.W_OK
+	}
+	return want
+}
+
+// Access implements the fs.NodeAccesser interface, for access(2) and chdir.
+func (node *CryptNode) Access(ctx context.Context, mask uint32) syscall.Errno {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if errno := node.reloadIfNeeded(); errno != 0 {
+		return errno
 	}
-	if len(node.contentKey) == 0 {
+	return node.checkAccess(ctx, mask&(unix.R_OK|unix.W_OK|unix.X_OK))
+}
+
+// Loads the manifest only, chunks are loaded as they are read or written.
+// Call with lock held.
+func (node *CryptNode) ensureContentLoaded() syscall.Errno {
+	if node.content != nil {
 		return 0
 	}
-	if len(node.content) != 0 {
+	if t := node.Mode & syscall.S_IFMT; t != fuse.S_IFREG && t != fuse.S_IFLNK {
 		return 0
 	}
-	value, err := node.factory.Blobs.Get(node.contentKey)
+	content, err := loadContent(node.factory.Blobs, node.contentKey, node.factory.chunkSize())
 	if err != nil {
-		logger.WithField("err", err).Error("Could not load content")
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Error("Could not load content")
 		return syscall.EIO
 	}
-	node.content = value
+	node.content = content
 	return 0
 }
 
+// Call with lock held.
+func (node *CryptNode) size() uint64 {
+	if node.content == nil {
+		return node.Size
+	}
+	return uint64(node.content.size)
+}
+
 func (node *CryptNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	if off > int64(len(node.content)) {
-		return fuse.ReadResultData(nil), 0
+	if errno := node.ensureContentLoaded(); errno != 0 {
+		return nil, errno
 	}
-	end := off + int64(len(dest))
-	if end > int64(len(node.content)) {
-		end = int64(len(node.content))
+	n, err := node.content.readAt(node.factory.Blobs, dest, off)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Error("Could not read content")
+		return nil, syscall.EIO
 	}
-	return fuse.ReadResultData(node.content[off:end]), 0
+	node.accessed(time.Now())
+	return fuse.ReadResultData(dest[:n]), 0
 }
 
 // Readlink ...
 func (node *CryptNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
-	return node.content, 0
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if errno := node.ensureContentLoaded(); errno != 0 {
+		return nil, errno
+	}
+	target := make([]byte, node.content.size)
+	if _, err := node.content.readAt(node.factory.Blobs, target, 0); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Error("Could not read link target")
+		return nil, syscall.EIO
+	}
+	return target, 0
 }
 
-// Rename ...
+// Rename moves the child to the new parent, as rename(2) does with the given
+// flags. The parents, the child and any target replaced are committed at once,
+// so that the child can't end up in both directories, or in neither.
 func (node *CryptNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&^(unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE) != 0 || flags == unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE {
+		return syscall.EINVAL
+	}
+	exchange := flags&unix.RENAME_EXCHANGE != 0
+
 	node.mu.Lock()
 	defer node.mu.Unlock()
-
-	child := node.GetChild(name).Operations().(*CryptNode)
-	child.mu.Lock()
-	defer child.mu.Unlock()
-	child.name = newName
-
+	if errno := node.checkAccess(ctx, unix.W_OK|unix.X_OK); errno != 0 {
+		return errno
+	}
 	newParentNode := newParent.EmbeddedInode().Operations().(*CryptNode)
 	if node.Key != newParentNode.Key {
 		newParentNode.mu.Lock()
 		defer newParentNode.mu.Unlock()
+		if errno := newParentNode.checkAccess(ctx, unix.W_OK|unix.X_OK); errno != 0 {
+			return errno
+		}
 	}
-	newParentNode.Children[newName] = child
-	delete(node.Children, name)
 
-	child.shouldSaveMetadata = true
-	newParentNode.shouldSaveMetadata = true
-	node.shouldSaveMetadata = true
-	if errno := child.sync(); errno != 0 {
-		return errno
+	child := node.Children[name]
+	if child == nil {
+		return syscall.ENOENT
+	}
+	target := newParentNode.Children[newName]
+	switch {
+	case target != nil && target.Key == child.Key:
+		// Both names are for the same node.
+		return 0
+	case child.Key == newParentNode.Key:
+		return syscall.EINVAL
+	case target != nil && (target.Key == node.Key || target.Key == newParentNode.Key):
+		// The target is an ancestor of the child, so it's not empty.
+		return syscall.ENOTEMPTY
+	case target != nil && flags&unix.RENAME_NOREPLACE != 0:
+		return syscall.EEXIST
+	case target == nil && exchange:
+		return syscall.ENOENT
+	}
+	// Locked in the order of their keys, so that renames in opposite directions
+	// agree on the order.
+	first, second := child, target
+	if target != nil && bytes.Compare(target.Key[:], child.Key[:]) < 0 {
+		first, second = target, child
 	}
-	if errno := newParentNode.sync(); errno != 0 {
+	first.mu.Lock()
+	defer first.mu.Unlock()
+	if second != nil {
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
+	if errno := child.ensureMetadataLoaded(); errno != 0 {
 		return errno
 	}
-	if errno := node.sync(); errno != 0 {
+	if target != nil {
+		if errno := target.ensureMetadataLoaded(); errno != 0 {
+			return errno
+		}
+		if !exchange {
+			if errno := checkReplace(child, target); errno != 0 {
+				return errno
+			}
+		}
+	}
+
+	restoreOld := node.touch()
+	restoreNew := newParentNode.touch()
+	now := time.Now()
+	rbctime := child.Ctime
+	child.Ctime = now
+	child.name = newName
+	delete(node.Children, name)
+	newParentNode.Children[newName] = child
+	nodes := []*CryptNode{child, node, newParentNode}
+
+	var (
+		rbtargetCtime time.Time
+		rbtargetNlink uint32
+	)
+	if target != nil {
+		rbtargetCtime, rbtargetNlink = target.Ctime, target.Nlink
+		target.Ctime = now
+		if exchange {
+			target.name = name
+			node.Children[name] = target
+			nodes = append(nodes, target)
+		} else {
+			if target.Nlink > 0 {
+				target.Nlink--
+			}
+			// A target left without names is not saved, but dropped.
+			if target.Nlink > 0 {
+				nodes = append(nodes, target)
+			}
+		}
+	}
+
+	if errno := node.factory.commit(nodes...); errno != 0 {
+		// Rollback.
+		if target != nil {
+			target.Ctime, target.Nlink = rbtargetCtime, rbtargetNlink
+			target.name = newName
+			newParentNode.Children[newName] = target
+		} else {
+			delete(newParentNode.Children, newName)
+		}
+		node.Children[name] = child
+		child.name = name
+		child.Ctime = rbctime
+		restoreNew()
+		restoreOld()
 		return errno
 	}
+	if target != nil && !exchange && target.Nlink == 0 {
+		node.factory.forget(target.Key)
+	}
 	return 0
 }
 
-func (node *CryptNode) resize(size uint64) (previous []byte) {
-	previous = node.content
-	if size > uint64(cap(node.content)) {
-		larger := make([]byte, size)
-		copy(larger, node.content)
-		node.content = larger
-	} else {
-		node.content = node.content[:size]
+// checkReplace returns the error rename(2) fails with when the child can't
+// replace the target, if any.
+// Call with both locks held.
+func checkReplace(child, target *CryptNode) syscall.Errno {
+	childIsDir := child.Mode&syscall.S_IFMT == fuse.S_IFDIR
+	targetIsDir := target.Mode&syscall.S_IFMT == fuse.S_IFDIR
+	switch {
+	case childIsDir && !targetIsDir:
+		return syscall.ENOTDIR
+	case !childIsDir && targetIsDir:
+		return syscall.EISDIR
+	case targetIsDir && len(target.Children) != 0:
+		return syscall.ENOTEMPTY
 	}
-	return previous
+	return 0
 }
 
 // Setattr ...
@@ -560,25 +999,71 @@ func (node *CryptNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.Se
 	defer node.mu.Unlock()
 
 	var (
-		rbtime    *time.Time
+		rbatime   = node.Atime
+		rbmtime   = node.Mtime
+		rbctime   = node.Ctime
 		rbuser    *uint32
 		rbgroup   *uint32
 		rbmode    *uint32
-		rbsize    *int
-		rbcontent []byte
+		rbacl     []byte
+		rbcontent *chunkedContent
 	)
 
+	if _, ok := in.GetMode(); ok {
+		if errno := node.checkOwner(ctx); errno != 0 {
+			return errno
+		}
+	}
+	uid, chown := in.GetUID()
+	gid, chgrp := in.GetGID()
+	if chown || chgrp {
+		if !chown {
+			uid = node.User
+		}
+		if !chgrp {
+			gid = node.Group
+		}
+		if errno := node.checkChown(ctx, uid, gid); errno != 0 {
+			return errno
+		}
+	}
+	_, setAtime := in.GetATime()
+	_, setMtime := in.GetMTime()
+	if setAtime || setMtime {
+		now := (!setAtime || in.Valid&fuse.FATTR_ATIME_NOW != 0) &&
+			(!setMtime || in.Valid&fuse.FATTR_MTIME_NOW != 0)
+		if errno := node.checkSetTimes(ctx, now); errno != 0 {
+			return errno
+		}
+	}
+
+	size, resize := in.GetSize()
+	if resize {
+		// Handles opened for writing were checked when opened, as ftruncate(2)
+		// only cares about how the file was opened.
+		if h, ok := f.(*openFile); !ok || !h.writable {
+			if errno := node.checkAccess(ctx, unix.W_OK); errno != 0 {
+				return errno
+			}
+		}
+		if errno := node.ensureContentLoaded(); errno != 0 {
+			return errno
+		}
+	}
+
+	// UTIME_NOW is passed as the current time, UTIME_OMIT as no time at all.
+	if t, ok := in.GetATime(); ok {
+		node.Atime = t
+	}
 	if t, ok := in.GetMTime(); ok {
-		rbtime = new(time.Time)
-		*rbtime = node.Time
-		node.Time = t
+		node.Mtime = t
 	}
-	if uid, ok := in.GetUID(); ok {
+	if chown {
 		rbuser = new(uint32)
 		*rbuser = node.User
 		node.User = uid
 	}
-	if gid, ok := in.GetGID(); ok {
+	if chgrp {
 		rbgroup = new(uint32)
 		*rbgroup = node.Group
 		node.Group = gid
@@ -593,21 +1078,37 @@ func (node *CryptNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.Se
 		rbmode = new(uint32)
 		*rbmode = node.Mode
 		node.Mode = node.Mode&0xfffff000 | mode&0x00000fff
+		// The mode and the access ACL, if any, must agree.
+		if b, ok := node.xattrs[aclAccessXattr]; ok {
+			if a, err := parseACL(b); err == nil {
+				rbacl = b
+				node.xattrs[aclAccessXattr] = a.withMode(node.Mode).serialize()
+			}
+		}
 	}
-	if size, ok := in.GetSize(); ok {
-		rbsize = new(int)
-		*rbsize = len(node.content)
-		rbcontent = node.resize(size)
-		node.Time = time.Now()
+	node.Ctime = time.Now()
+	var errno syscall.Errno
+	if resize && node.content != nil {
+		rbcontent = node.content.clone()
+		if err := node.content.truncate(node.factory.Blobs, int64(size)); err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"name": node.name,
+			}).Error("Could not resize content")
+			errno = syscall.EIO
+		}
+		node.Mtime = time.Now()
 		node.shouldSaveContent = true
 	}
-	node.shouldSaveMetadata = true
-	errno := node.sync()
+	if errno == 0 {
+		node.shouldSaveMetadata = true
+		errno = node.sync()
+	}
 	if errno != 0 {
 		// Rollback.
-		if rbtime != nil {
-			node.Time = *rbtime
-		}
+		node.Atime = rbatime
+		node.Mtime = rbmtime
+		node.Ctime = rbctime
 		if rbuser != nil {
 			node.User = *rbuser
 		}
@@ -617,11 +1118,17 @@ func (node *CryptNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.Se
 		if rbmode != nil {
 			node.Mode = *rbmode
 		}
-		if rbsize != nil {
+		if rbacl != nil {
+			node.xattrs[aclAccessXattr] = rbacl
+		}
+		if rbcontent != nil {
 			node.content = rbcontent
+			node.shouldSaveContent = false
 		}
+		return errno
 	}
-	return errno
+	node.fillAttr(&out.Attr)
+	return 0
 }
 
 func bitsOf(mode uint32) string {
@@ -632,14 +1139,21 @@ func (node *CryptNode) Write(ctx context.Context, f fs.FileHandle, data []byte,
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
+	if errno := node.ensureContentLoaded(); errno != 0 {
+		return 0, errno
+	}
 	sz := int64(len(data))
-	if off+sz > int64(len(node.content)) {
-		node.resize(uint64(off + sz))
+	if err := node.content.writeAt(node.factory.Blobs, data, off); err != nil {
+		log.WithFields(log.Fields{
+			"err":  err,
+			"name": node.name,
+		}).Error("Could not write content")
+		return 0, syscall.EIO
 	}
-	copy(node.content[off:], data)
-	node.Time = time.Now()
 	if sz > 0 {
+		node.touch()
 		node.shouldSaveContent = true
+		node.shouldSaveMetadata = true
 	}
 	return uint32(sz), 0
 }
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 	"testing"
 	"time"
@@ -17,6 +19,7 @@ import (
 	sync "github.com/sasha-s/go-deadlock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
 )
 
 type fakeVersionedStore struct {
@@ -47,6 +50,17 @@ func (s *fakeVersionedStore) Put(uint64, []byte, []byte) error {
 	return s.err
 }
 
+// PutAll fails if any of the puts would, as given by the errors set.
+func (s *fakeVersionedStore) PutAll(mutations []storage.Mutation) error {
+	var err error
+	for range mutations {
+		if perr := s.Put(0, nil, nil); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
 func (s *fakeVersionedStore) setErr(err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -107,6 +121,20 @@ func TestNodeMetadataRollback(t *testing.T) {
 		})
 	})
 
+	t.Run("Removexattr", func(t *testing.T) {
+		t.Run("adds back removed attribute", func(t *testing.T) {
+			node, err := factory.allocateNode()
+			require.NoError(err)
+			ok()
+			errno := node.Setxattr(context.Background(), "key", []byte("value"), 0)
+			require.EqualValues(0, errno)
+			ko()
+			errno = node.Removexattr(context.Background(), "key")
+			assert.Equal(syscall.EIO, errno)
+			assert.EqualValues("value", node.xattrs["key"])
+		})
+	})
+
 	t.Run("Rmdir", func(t *testing.T) {
 		t.Run("adds back removed child directory", func(t *testing.T) {
 			p := filepath.Join(rootdir, randomName())
@@ -258,8 +286,101 @@ func TestNodeMetadataRollback(t *testing.T) {
 		})
 	})
 
+	t.Run("Mknod", func(t *testing.T) {
+		t.Run("removes node just created if child sync fails", func(t *testing.T) {
+			p := filepath.Join(rootdir, randomName())
+			ko()
+			err := syscall.Mkfifo(p, 0644)
+			require.Error(err)
+			ok()
+			_, err = os.Stat(p)
+			require.Error(err)
+			assert.True(os.IsNotExist(err))
+		})
+		t.Run("removes node just created if parent sync fails", func(t *testing.T) {
+			p := filepath.Join(rootdir, randomName())
+			okko()
+			err := syscall.Mkfifo(p, 0644)
+			require.Error(err)
+			ok()
+			_, err = os.Stat(p)
+			require.Error(err)
+			assert.True(os.IsNotExist(err))
+		})
+	})
+
+	t.Run("Link", func(t *testing.T) {
+		t.Run("removes link just created if target sync fails", func(t *testing.T) {
+			oldname := filepath.Join(rootdir, randomName())
+			ok()
+			err := os.WriteFile(oldname, []byte("content"), 0644)
+			require.NoError(err)
+			newname := filepath.Join(rootdir, randomName())
+			ko()
+			err = os.Link(oldname, newname)
+			require.Error(err)
+			ok()
+			_, err = os.Stat(newname)
+			require.Error(err)
+			assert.True(os.IsNotExist(err))
+		})
+		t.Run("removes link just created if parent sync fails", func(t *testing.T) {
+			oldname := filepath.Join(rootdir, randomName())
+			ok()
+			err := os.WriteFile(oldname, []byte("content"), 0644)
+			require.NoError(err)
+			newname := filepath.Join(rootdir, randomName())
+			okko()
+			err = os.Link(oldname, newname)
+			require.Error(err)
+			ok()
+			_, err = os.Stat(newname)
+			require.Error(err)
+			assert.True(os.IsNotExist(err))
+			info, err := os.Stat(oldname)
+			require.NoError(err)
+			assert.EqualValues(1, info.Sys().(*syscall.Stat_t).Nlink)
+		})
+	})
+
 	t.Run("Rename", func(t *testing.T) {
-		t.Skip("To be able to rollback renaming, we need transactions on the metadataserver.")
+		t.Run("keeps file at old name if commit fails", func(t *testing.T) {
+			oldname := filepath.Join(rootdir, randomName())
+			newname := filepath.Join(rootdir, randomName())
+			ok()
+			err := os.WriteFile(oldname, []byte("Peggy Sue"), 0644)
+			require.NoError(err)
+			ko()
+			err = os.Rename(oldname, newname)
+			require.Error(err)
+			ok()
+			_, err = os.Stat(newname)
+			assert.True(os.IsNotExist(err))
+			b, err := os.ReadFile(oldname)
+			require.NoError(err)
+			assert.EqualValues("Peggy Sue", b)
+
+			require.NoError(os.Rename(oldname, newname))
+			_, err = os.Stat(oldname)
+			assert.True(os.IsNotExist(err))
+		})
+		t.Run("keeps replaced file if commit fails", func(t *testing.T) {
+			oldname := filepath.Join(rootdir, randomName())
+			newname := filepath.Join(rootdir, randomName())
+			ok()
+			require.NoError(os.WriteFile(oldname, []byte("old"), 0644))
+			require.NoError(os.WriteFile(newname, []byte("new"), 0644))
+			ko()
+			err := os.Rename(oldname, newname)
+			require.Error(err)
+			ok()
+			b, err := os.ReadFile(newname)
+			require.NoError(err)
+			assert.EqualValues("new", b)
+			info, err := os.Stat(newname)
+			require.NoError(err)
+			assert.EqualValues(1, info.Sys().(*syscall.Stat_t).Nlink)
+		})
 	})
 
 	t.Run("Setattr", func(t *testing.T) {
@@ -339,7 +460,410 @@ func TestNodeMetadataRollback(t *testing.T) {
 	})
 }
 
-func testMount(t *testing.T) (mountpoint string, factory *CryptNodeFactory, cleanup func()) {
+func TestHardLinks(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rootdir, factory, cleanup := testMount(t)
+	defer cleanup()
+
+	nlink := func(info os.FileInfo) uint64 {
+		return uint64(info.Sys().(*syscall.Stat_t).Nlink)
+	}
+
+	first := filepath.Join(rootdir, "first")
+	require.NoError(os.Mkdir(filepath.Join(rootdir, "dir"), 0755))
+	second := filepath.Join(rootdir, "dir", "second")
+	require.NoError(os.WriteFile(first, []byte("Peggy Sue"), 0644))
+	require.NoError(os.Link(first, second))
+
+	firstInfo, err := os.Stat(first)
+	require.NoError(err)
+	secondInfo, err := os.Stat(second)
+	require.NoError(err)
+	assert.EqualValues(2, nlink(firstInfo))
+	assert.True(os.SameFile(firstInfo, secondInfo))
+
+	require.NoError(os.WriteFile(second, []byte("Peggy Sue got married"), 0644))
+	got, err := os.ReadFile(first)
+	require.NoError(err)
+	assert.EqualValues("Peggy Sue got married", got)
+
+	assert.Error(os.Link(filepath.Join(rootdir, "dir"), filepath.Join(rootdir, "dirlink")))
+	assert.Error(os.Link(first, second))
+
+	factory.Root.mu.Lock()
+	key := factory.Root.Children["first"].Key
+	factory.Root.mu.Unlock()
+	require.NoError(os.Remove(first))
+	secondInfo, err = os.Stat(second)
+	require.NoError(err)
+	assert.EqualValues(1, nlink(secondInfo))
+	assert.NotNil(factory.getKnown(key))
+
+	require.NoError(os.Remove(second))
+	assert.Nil(factory.getKnown(key))
+}
+
+func TestRename(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t)
+	defer cleanup()
+
+	write := func(t *testing.T, name, content string) string {
+		p := filepath.Join(rootdir, name)
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		return p
+	}
+	read := func(t *testing.T, p string) string {
+		b, err := os.ReadFile(p)
+		require.NoError(t, err)
+		return string(b)
+	}
+	renameat2 := func(oldpath, newpath string, flags uint) error {
+		return unix.Renameat2(unix.AT_FDCWD, oldpath, unix.AT_FDCWD, newpath, flags)
+	}
+
+	t.Run("across directories", func(t *testing.T) {
+		dir := filepath.Join(rootdir, "dir")
+		require.NoError(t, os.Mkdir(dir, 0755))
+		p := write(t, "moved", "content")
+		require.NoError(t, os.Rename(p, filepath.Join(dir, "moved")))
+		assert.Equal(t, "content", read(t, filepath.Join(dir, "moved")))
+		factory.Root.mu.Lock()
+		_, ok := factory.Root.Children["moved"]
+		dirNode := factory.Root.Children["dir"]
+		factory.Root.mu.Unlock()
+		assert.False(t, ok)
+		dirNode.mu.Lock()
+		assert.Contains(t, dirNode.Children, "moved")
+		dirNode.mu.Unlock()
+	})
+
+	t.Run("replaces target", func(t *testing.T) {
+		from := write(t, "from", "from")
+		to := write(t, "to", "to")
+		require.NoError(t, os.Rename(from, to))
+		assert.Equal(t, "from", read(t, to))
+		_, err := os.Stat(from)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("keeps other names of replaced target", func(t *testing.T) {
+		from := write(t, "from", "from")
+		to := write(t, "to", "to")
+		other := filepath.Join(rootdir, "other")
+		require.NoError(t, os.Link(to, other))
+		require.NoError(t, os.Rename(from, to))
+		info, err := os.Stat(other)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, info.Sys().(*syscall.Stat_t).Nlink)
+		assert.Equal(t, "to", read(t, other))
+	})
+
+	t.Run("does not replace with no replace flag", func(t *testing.T) {
+		from := write(t, "from", "from")
+		to := write(t, "to", "to")
+		assert.ErrorIs(t, renameat2(from, to, unix.RENAME_NOREPLACE), syscall.EEXIST)
+		assert.Equal(t, "from", read(t, from))
+		assert.Equal(t, "to", read(t, to))
+	})
+
+	t.Run("exchanges", func(t *testing.T) {
+		from := write(t, "from", "from")
+		to := write(t, "to", "to")
+		require.NoError(t, renameat2(from, to, unix.RENAME_EXCHANGE))
+		assert.Equal(t, "to", read(t, from))
+		assert.Equal(t, "from", read(t, to))
+		assert.ErrorIs(t, renameat2(from, filepath.Join(rootdir, "missing"), unix.RENAME_EXCHANGE), syscall.ENOENT)
+	})
+
+	t.Run("checks replaced directories", func(t *testing.T) {
+		empty := filepath.Join(rootdir, "empty")
+		full := filepath.Join(rootdir, "full")
+		require.NoError(t, os.Mkdir(empty, 0755))
+		require.NoError(t, os.Mkdir(full, 0755))
+		write(t, "full/file", "content")
+		// os.Rename refuses to replace directories by itself.
+		assert.ErrorIs(t, renameat2(empty, full, 0), syscall.ENOTEMPTY)
+		assert.ErrorIs(t, renameat2(write(t, "file", ""), empty, 0), syscall.EISDIR)
+		require.NoError(t, renameat2(full, empty, 0))
+		assert.Equal(t, "content", read(t, filepath.Join(empty, "file")))
+	})
+}
+
+func TestMknod(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t)
+	defer cleanup()
+
+	t.Run("fifo", func(t *testing.T) {
+		p := filepath.Join(rootdir, "fifo")
+		require.NoError(t, syscall.Mkfifo(p, 0640))
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeNamedPipe|0640, info.Mode())
+	})
+
+	t.Run("socket", func(t *testing.T) {
+		p := filepath.Join(rootdir, "socket")
+		require.NoError(t, syscall.Mknod(p, syscall.S_IFSOCK|0600, 0))
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.Equal(t, os.ModeSocket|0600, info.Mode())
+	})
+
+	t.Run("device", func(t *testing.T) {
+		// Creating device nodes needs CAP_MKNOD, so this calls into the node
+		// directly.
+		var out fuse.EntryOut
+		dev := uint32(unix.Mkdev(1, 3))
+		_, errno := factory.Root.Mknod(context.Background(), "null", syscall.S_IFCHR|0666, dev, &out)
+		require.EqualValues(t, 0, errno)
+		assert.Equal(t, dev, out.Rdev)
+
+		factory.Root.mu.Lock()
+		child := factory.Root.Children["null"]
+		factory.Root.mu.Unlock()
+		after := &CryptNode{factory: factory}
+		child.mu.Lock()
+		serialized := child.serialize()
+		child.mu.Unlock()
+		require.NoError(t, after.unserialize(serialized))
+		assert.EqualValues(t, syscall.S_IFCHR|0666, after.Mode)
+		assert.Equal(t, dev, after.Rdev)
+		assert.Nil(t, after.Children)
+	})
+
+	t.Run("rejects directories", func(t *testing.T) {
+		var out fuse.EntryOut
+		_, errno := factory.Root.Mknod(context.Background(), "dir", syscall.S_IFDIR|0755, 0, &out)
+		assert.Equal(t, syscall.EINVAL, errno)
+	})
+}
+
+func TestXattrs(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rootdir, _, cleanup := testMount(t)
+	defer cleanup()
+
+	p := filepath.Join(rootdir, "file")
+	require.NoError(os.WriteFile(p, nil, 0644))
+	require.NoError(unix.Setxattr(p, "user.b", []byte("second"), 0))
+	require.NoError(unix.Setxattr(p, "user.a", []byte("first"), 0))
+
+	t.Run("list", func(t *testing.T) {
+		size, err := unix.Listxattr(p, nil)
+		require.NoError(err)
+		assert.Equal(len("user.a\x00user.b\x00"), size)
+
+		_, err = unix.Listxattr(p, make([]byte, size-1))
+		assert.ErrorIs(err, syscall.ERANGE)
+
+		dest := make([]byte, size)
+		n, err := unix.Listxattr(p, dest)
+		require.NoError(err)
+		assert.Equal("user.a\x00user.b\x00", string(dest[:n]))
+	})
+
+	t.Run("get", func(t *testing.T) {
+		size, err := unix.Getxattr(p, "user.b", nil)
+		require.NoError(err)
+		assert.Equal(len("second"), size)
+		_, err = unix.Getxattr(p, "user.b", make([]byte, 1))
+		assert.ErrorIs(err, syscall.ERANGE)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(unix.Removexattr(p, "user.a"))
+		_, err := unix.Getxattr(p, "user.a", nil)
+		assert.ErrorIs(err, syscall.ENODATA)
+		assert.ErrorIs(unix.Removexattr(p, "user.a"), syscall.ENODATA)
+
+		dest := make([]byte, 64)
+		n, err := unix.Listxattr(p, dest)
+		require.NoError(err)
+		assert.Equal("user.b\x00", string(dest[:n]))
+	})
+}
+
+func TestSetattrPermissions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can act as other users")
+	}
+	rootdir, _, cleanup := testMount(t, func(factory *CryptNodeFactory) {
+		factory.CheckPermissions = true
+	})
+	defer cleanup()
+
+	const other = 2000
+	// asOther runs fn with the file system user and group of the thread set to
+	// those of another user, which is what FUSE passes along as the caller.
+	asOther := func(fn func()) {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		unix.Setfsgid(other)
+		unix.Setfsuid(other)
+		defer unix.Setfsgid(0)
+		defer unix.Setfsuid(0)
+		fn()
+	}
+	now := []unix.Timespec{{Nsec: unix.UTIME_NOW}, {Nsec: unix.UTIME_NOW}}
+
+	p := filepath.Join(rootdir, "file")
+	require.NoError(t, os.WriteFile(p, []byte("content"), 0644))
+
+	t.Run("only root changes the owner", func(t *testing.T) {
+		asOther(func() {
+			assert.ErrorIs(t, os.Chown(p, other, -1), syscall.EPERM)
+		})
+		require.NoError(t, os.Chown(p, other, other))
+		asOther(func() {
+			assert.ErrorIs(t, os.Chown(p, 0, -1), syscall.EPERM)
+		})
+		require.NoError(t, os.Chown(p, 0, 0))
+	})
+
+	t.Run("owner changes the group to their own", func(t *testing.T) {
+		require.NoError(t, os.Chown(p, other, 0))
+		asOther(func() {
+			assert.ErrorIs(t, os.Chown(p, -1, other+1), syscall.EPERM)
+			assert.NoError(t, os.Chown(p, -1, other))
+		})
+		require.NoError(t, os.Chown(p, 0, 0))
+		asOther(func() {
+			assert.ErrorIs(t, os.Chown(p, -1, other), syscall.EPERM)
+		})
+	})
+
+	t.Run("truncate needs write permission", func(t *testing.T) {
+		asOther(func() {
+			assert.ErrorIs(t, os.Truncate(p, 0), syscall.EACCES)
+		})
+		b, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.Equal(t, "content", string(b))
+
+		// Handles opened for writing can truncate, whatever the mode now.
+		require.NoError(t, os.Chmod(p, 0666))
+		var f *os.File
+		asOther(func() {
+			var err error
+			f, err = os.OpenFile(p, os.O_WRONLY, 0)
+			require.NoError(t, err)
+		})
+		defer f.Close()
+		require.NoError(t, os.Chmod(p, 0644))
+		asOther(func() {
+			assert.NoError(t, f.Truncate(0))
+		})
+		require.NoError(t, os.WriteFile(p, []byte("content"), 0644))
+	})
+
+	t.Run("times need ownership", func(t *testing.T) {
+		asOther(func() {
+			assert.ErrorIs(t, os.Chtimes(p, time.Unix(1, 0), time.Unix(1, 0)), syscall.EPERM)
+			assert.ErrorIs(t, unix.UtimesNanoAt(unix.AT_FDCWD, p, now, 0), syscall.EACCES)
+		})
+		require.NoError(t, os.Chmod(p, 0666))
+		defer os.Chmod(p, 0644)
+		asOther(func() {
+			assert.ErrorIs(t, os.Chtimes(p, time.Unix(1, 0), time.Unix(1, 0)), syscall.EPERM)
+			assert.NoError(t, unix.UtimesNanoAt(unix.AT_FDCWD, p, now, 0))
+		})
+	})
+
+	t.Run("xattrs need write permission", func(t *testing.T) {
+		require.NoError(t, unix.Setxattr(p, "user.a", []byte("a"), 0))
+		asOther(func() {
+			assert.ErrorIs(t, unix.Setxattr(p, "user.b", []byte("b"), 0), syscall.EACCES)
+			assert.ErrorIs(t, unix.Removexattr(p, "user.a"), syscall.EACCES)
+		})
+		require.NoError(t, os.Chown(p, other, other))
+		defer os.Chown(p, 0, 0)
+		asOther(func() {
+			assert.NoError(t, unix.Setxattr(p, "user.b", []byte("b"), 0))
+			assert.ErrorIs(t, unix.Setxattr(p, "trusted.b", []byte("b"), 0), syscall.EPERM)
+		})
+	})
+}
+
+func TestLocks(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t)
+	defer cleanup()
+
+	// Another client is given its own session.
+	table := storage.NewLockTable()
+	factory.Locks = table.Session(1)
+	other := table.Session(2)
+
+	p := filepath.Join(rootdir, "file")
+	require.NoError(t, os.WriteFile(p, nil, 0644))
+	factory.Root.mu.Lock()
+	key := factory.Root.Children["file"].Key[:]
+	factory.Root.mu.Unlock()
+
+	t.Run("flock", func(t *testing.T) {
+		first, err := os.Open(p)
+		require.NoError(t, err)
+		defer first.Close()
+		second, err := os.Open(p)
+		require.NoError(t, err)
+		defer second.Close()
+
+		require.NoError(t, unix.Flock(int(first.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+		assert.ErrorIs(t, unix.Flock(int(second.Fd()), unix.LOCK_SH|unix.LOCK_NB), syscall.EWOULDBLOCK)
+		// Closing the file releases the lock, although the kernel might tell us
+		// only after close returns.
+		require.NoError(t, first.Close())
+		assert.Eventually(t, func() bool {
+			return unix.Flock(int(second.Fd()), unix.LOCK_SH|unix.LOCK_NB) == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("fcntl", func(t *testing.T) {
+		f, err := os.OpenFile(p, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		held := storage.Lock{Owner: 1, Pid: 42, Type: storage.WriteLock, Start: 10, End: 19}
+		// The flock lock of the previous test may be released only once the
+		// kernel gets around to it.
+		require.Eventually(t, func() bool {
+			return other.SetLock(key, held) == nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		lk := unix.Flock_t{Type: unix.F_RDLCK, Whence: io.SeekStart, Start: 15, Len: 10}
+		require.NoError(t, unix.FcntlFlock(f.Fd(), unix.F_GETLK, &lk))
+		assert.EqualValues(t, unix.F_WRLCK, lk.Type)
+		assert.EqualValues(t, 10, lk.Start)
+		assert.EqualValues(t, 10, lk.Len)
+
+		lk = unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart, Start: 15, Len: 10}
+		assert.ErrorIs(t, unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lk), syscall.EAGAIN)
+		lk = unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart, Start: 20, Len: 10}
+		require.NoError(t, unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lk))
+
+		// Waits until the other client releases its lock.
+		unlock := held
+		unlock.Type = storage.Unlock
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			assert.NoError(t, other.SetLock(key, unlock))
+		}()
+		lk = unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart, Start: 0, Len: 20}
+		require.NoError(t, unix.FcntlFlock(f.Fd(), unix.F_SETLKW, &lk))
+		held.Type = storage.ReadLock
+		assert.ErrorIs(t, other.SetLock(key, held), storage.ErrLocked)
+
+		// Closing the file releases the locks of the process.
+		require.NoError(t, f.Close())
+		require.NoError(t, other.SetLock(key, held))
+	})
+}
+
+// testMount mounts a file system backed by in memory stores. The factory is
+// configured before mounting, as it can't be changed while serving requests.
+func testMount(t *testing.T, configure ...func(*CryptNodeFactory)) (mountpoint string, factory *CryptNodeFactory, cleanup func()) {
 	t.Helper()
 
 	dir, err := os.MkdirTemp("", "dinofs-test-")
@@ -353,17 +877,25 @@ func testMount(t *testing.T) (mountpoint string, factory *CryptNodeFactory, clea
 
 	factory.Metadata = &fakeVersionedStore{}
 	factory.Blobs = storage.NewBlobStore(storage.NewInMemoryStore())
+	factory.Locks = storage.NewLockTable().Session(1)
 
 	var zero [NodeKeyLen]byte
 	root := factory.ExistingNode("root", zero)
 	root.Mode |= fuse.S_IFDIR
 	root.Children = make(map[string]*CryptNode)
 	factory.Root = root
+	for _, c := range configure {
+		c(factory)
+	}
 
-	server, err := fs.Mount(dir, root, &fs.Options{
+	opts := &fs.Options{
 		UID: uint32(os.Getuid()),
 		GID: uint32(os.Getgid()),
-	})
+	}
+	opts.EnableLocks = true
+	// Where there's no fusermount, root can still mount.
+	opts.DirectMount = true
+	server, err := fs.Mount(dir, root, opts)
 	if err != nil {
 		factory.InodeGenerator.Stop()
 		t.Skipf("skipping due to fuse mount errors: %s", err)
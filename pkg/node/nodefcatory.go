@@ -7,6 +7,7 @@ import (
 
 	"github.com/EncrypteDL/CryptFS/pkg/message"
 	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	sync "github.com/sasha-s/go-deadlock"
 	log "github.com/sirupsen/logrus"
 )
@@ -16,15 +17,50 @@ type CryptNodeFactory struct {
 	Root           *CryptNode
 	InodeGenerator *InodeNumbersGenerator
 	Metadata       storage.VersionedStore
-	Blobs          *storage.BlobStoreWrapper
-	mu             sync.Mutex
-	known          map[[NodeKeyLen]byte]*CryptNode
+	Blobs          storage.BlobStore
+	ChunkSize      int64
+
+	// If set, operations are checked against the mode and ACLs of the nodes
+	// for the user and groups of the calling process. Otherwise, anyone who
+	// can reach the mount can do anything.
+	CheckPermissions bool
+
+	// When reads update the access time of files.
+	Atime AtimePolicy
+
+	// If set, Statfs reports the usage of these stores.
+	BlobUsage     storage.UsageReporter
+	MetadataUsage storage.UsageReporter
+	// If non-zero, Statfs reports these limits instead of the capacity of the
+	// stores.
+	QuotaBytes uint64
+	QuotaFiles uint64
+
+	// If set, advisory locks taken with fcntl and flock are kept here, so that
+	// they are seen by every client. Otherwise, locking is not supported.
+	Locks storage.Locker
+
+	mu        sync.Mutex
+	known     map[[NodeKeyLen]byte]*CryptNode
+	statfsAt  time.Time
+	statfsOut fuse.StatfsOut
+}
+
+func (factory *CryptNodeFactory) chunkSize() int64 {
+	if factory.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return factory.ChunkSize
 }
 
 func (factory *CryptNodeFactory) allocateNode() (*CryptNode, error) {
 	var node CryptNode
 	node.factory = factory
-	node.Time = time.Now()
+	node.Mtime = time.Now()
+	node.Atime = node.Mtime
+	node.Ctime = node.Mtime
+	node.Btime = node.Mtime
+	node.Nlink = 1
 	n, err := rand.Read(node.Key[:])
 	if err != nil {
 		return nil, err
@@ -36,25 +72,31 @@ func (factory *CryptNodeFactory) allocateNode() (*CryptNode, error) {
 	return &node, nil
 }
 
-// ExistingNode adds a new node
+// ExistingNode returns the node with the given key, adding it if not known yet.
+// A node with several names, i.e., hard links, is the same node under each.
 func (factory *CryptNodeFactory) ExistingNode(name string, key [NodeKeyLen]byte) *CryptNode {
+	if node := factory.getKnown(key); node != nil {
+		return node
+	}
 	var node CryptNode
 	node.factory = factory
 	node.Key = key
 	node.name = name
 	node.Mode = modeNotLoaded
-	factory.addKnown(&node)
-	return &node
+	node.Nlink = 1
+	return factory.addKnown(&node)
 }
 
-func (factory *CryptNodeFactory) addKnown(node *CryptNode) {
+// addKnown returns the node already known with the same key, if any, or else
+// the given one.
+func (factory *CryptNodeFactory) addKnown(node *CryptNode) *CryptNode {
 	factory.mu.Lock()
 	defer factory.mu.Unlock()
 	if factory.known == nil {
 		factory.known = make(map[[NodeKeyLen]byte]*CryptNode)
 	}
-	if _, ok := factory.known[node.Key]; ok {
-		return
+	if prev, ok := factory.known[node.Key]; ok {
+		return prev
 	}
 	factory.known[node.Key] = node
 	logger := log.WithField("key", fmt.Sprintf("%.10x", node.Key[:]))
@@ -63,6 +105,15 @@ func (factory *CryptNodeFactory) addKnown(node *CryptNode) {
 	} else {
 		logger.Debug("Added node")
 	}
+	return node
+}
+
+// forget drops a node that no longer has any name.
+func (factory *CryptNodeFactory) forget(key [NodeKeyLen]byte) {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	delete(factory.known, key)
+	log.WithField("key", fmt.Sprintf("%.10x", key[:])).Debug("Forgot node")
 }
 
 func (factory *CryptNodeFactory) getKnown(key [NodeKeyLen]byte) *CryptNode {
@@ -74,7 +125,9 @@ func (factory *CryptNodeFactory) getKnown(key [NodeKeyLen]byte) *CryptNode {
 	return factory.known[key]
 }
 
-// InvalidateCache invalidates a cached node
+// InvalidateCache invalidates a cached node, given the revocation of the lease
+// on its metadata. Revocations of version zero, sent when leases are lost,
+// invalidate it whatever its version.
 func (factory *CryptNodeFactory) InvalidateCache(mutation message.Message) {
 	logger := log.WithFields(log.Fields{
 		"op":       "import",
@@ -97,7 +150,7 @@ func (factory *CryptNodeFactory) InvalidateCache(mutation message.Message) {
 		"localVersion": node.version,
 		"localName":    node.name,
 	})
-	if mutation.Version() <= node.version {
+	if mutation.Version() != 0 && mutation.Version() <= node.version {
 		logger.Debug("Not updating (stale update)")
 		return
 	}
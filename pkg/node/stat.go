@@ -3,9 +3,25 @@ package node
 import (
 	"context"
 	"syscall"
+	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	statfsBlockSize = 4096
+	statfsNameLen   = 255
+
+	// Lower bound of the size of a serialized node, for estimating how many
+	// more nodes fit in the metadata store.
+	minNodeSize = 64
+
+	// Statfs is called often, e.g., by shells and file managers showing free
+	// space, while asking the stores may mean walking their whole directory.
+	statfsCacheTTL = 10 * time.Second
 )
 
 // Ensure that we implement NodeStatfser
@@ -13,6 +29,87 @@ var _ = (fs.NodeStatfser)((*CryptNode)(nil))
 
 // Statfs implements the fs.NodeStatfser interface
 func (node *CryptNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	// TODO: Not implemented (yet_
+	*out = node.factory.statfs()
 	return 0
 }
+
+func (factory *CryptNodeFactory) statfs() fuse.StatfsOut {
+	factory.mu.Lock()
+	if !factory.statfsAt.IsZero() && time.Since(factory.statfsAt) < statfsCacheTTL {
+		out := factory.statfsOut
+		factory.mu.Unlock()
+		return out
+	}
+	factory.mu.Unlock()
+
+	blobs := usageOf("blobs", factory.BlobUsage)
+	metadata := usageOf("metadata", factory.MetadataUsage)
+	out := statfsOut(blobs, metadata, factory.QuotaBytes, factory.QuotaFiles)
+
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	factory.statfsAt = time.Now()
+	factory.statfsOut = out
+	return out
+}
+
+// usageOf returns the usage of the store, or zero if unknown.
+func usageOf(name string, reporter storage.UsageReporter) storage.Usage {
+	if reporter == nil {
+		return storage.Usage{}
+	}
+	u, err := reporter.Usage()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"op":    "statfs",
+			"store": name,
+			"err":   err,
+		}).Warn("Could not get usage")
+		return storage.Usage{}
+	}
+	return u
+}
+
+// statfsOut reports the capacity of the file system as that of the blob store,
+// and the number of files as the number of nodes in the metadata store. If
+// set, quotas take the place of the capacity of the stores, while still not
+// reporting more free space than the stores have.
+func statfsOut(blobs, metadata storage.Usage, quotaBytes, quotaFiles uint64) (out fuse.StatfsOut) {
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.NameLen = statfsNameLen
+
+	capacity, available := blobs.Capacity, blobs.Available
+	if quotaBytes > 0 {
+		capacity = quotaBytes
+		available = remaining(quotaBytes, blobs.Used, blobs.Capacity > 0, blobs.Available)
+	}
+	out.Blocks = capacity / statfsBlockSize
+	out.Bfree = available / statfsBlockSize
+	out.Bavail = out.Bfree
+
+	nodeSize := uint64(minNodeSize)
+	if metadata.Count > 0 {
+		nodeSize = max(nodeSize, metadata.Used/metadata.Count)
+	}
+	out.Ffree = metadata.Available / nodeSize
+	out.Files = metadata.Count + out.Ffree
+	if quotaFiles > 0 {
+		out.Files = quotaFiles
+		out.Ffree = remaining(quotaFiles, metadata.Count, metadata.Capacity > 0, out.Ffree)
+	}
+	return out
+}
+
+// remaining returns what is left of the quota, bounded by what is available in
+// the store if its capacity is known.
+func remaining(quota, used uint64, known bool, available uint64) uint64 {
+	var left uint64
+	if used < quota {
+		left = quota - used
+	}
+	if known {
+		left = min(left, available)
+	}
+	return left
+}
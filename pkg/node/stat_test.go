@@ -0,0 +1,81 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeUsageReporter struct {
+	usage storage.Usage
+	err   error
+	calls int
+}
+
+func (r *fakeUsageReporter) Usage() (storage.Usage, error) {
+	r.calls++
+	return r.usage, r.err
+}
+
+func TestStatfs(t *testing.T) {
+	const mib = 1 << 20
+	blobs := storage.Usage{Capacity: 100 * mib, Available: 60 * mib, Used: 30 * mib, Count: 10}
+	metadata := storage.Usage{Capacity: 100 * mib, Available: 1 * mib, Used: 1000, Count: 10}
+
+	t.Run("reports usage of the stores", func(t *testing.T) {
+		out := statfsOut(blobs, metadata, 0, 0)
+		assert.EqualValues(t, 4096, out.Bsize)
+		assert.EqualValues(t, 25600, out.Blocks)
+		assert.EqualValues(t, 15360, out.Bfree)
+		assert.EqualValues(t, 15360, out.Bavail)
+		// 100 bytes per node.
+		assert.EqualValues(t, 10485, out.Ffree)
+		assert.EqualValues(t, 10495, out.Files)
+	})
+
+	t.Run("quotas override capacity", func(t *testing.T) {
+		out := statfsOut(blobs, metadata, 40*mib, 100)
+		assert.EqualValues(t, 10240, out.Blocks)
+		assert.EqualValues(t, 2560, out.Bfree)
+		assert.EqualValues(t, 100, out.Files)
+		assert.EqualValues(t, 90, out.Ffree)
+	})
+
+	t.Run("quotas bounded by available space", func(t *testing.T) {
+		out := statfsOut(blobs, metadata, 1000*mib, 0)
+		assert.EqualValues(t, 256000, out.Blocks)
+		assert.EqualValues(t, 15360, out.Bfree)
+	})
+
+	t.Run("quotas exceeded", func(t *testing.T) {
+		out := statfsOut(blobs, metadata, 10*mib, 5)
+		assert.EqualValues(t, 0, out.Bfree)
+		assert.EqualValues(t, 0, out.Ffree)
+	})
+
+	t.Run("unknown usage", func(t *testing.T) {
+		blobs := &fakeUsageReporter{err: errors.New("unavailable")}
+		factory := &CryptNodeFactory{BlobUsage: blobs, QuotaBytes: 4 * mib}
+		node := &CryptNode{factory: factory}
+		var out fuse.StatfsOut
+		assert.EqualValues(t, 0, node.Statfs(context.Background(), &out))
+		assert.EqualValues(t, 1024, out.Blocks)
+		assert.EqualValues(t, 1024, out.Bfree)
+		assert.EqualValues(t, 0, out.Files)
+	})
+
+	t.Run("caches usage", func(t *testing.T) {
+		blobs := &fakeUsageReporter{usage: blobs}
+		factory := &CryptNodeFactory{BlobUsage: blobs}
+		node := &CryptNode{factory: factory}
+		var first, second fuse.StatfsOut
+		node.Statfs(context.Background(), &first)
+		node.Statfs(context.Background(), &second)
+		assert.Equal(t, first, second)
+		assert.Equal(t, 1, blobs.calls)
+	})
+}
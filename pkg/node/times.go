@@ -0,0 +1,66 @@
+package node
+
+import (
+	"fmt"
+	"time"
+)
+
+// AtimePolicy tells when reading a file updates its access time.
+type AtimePolicy int
+
+const (
+	// AtimeRelative updates the access time only if it's not later than the
+	// modification or change time, or if it's older than a day, like the
+	// relatime mount option.
+	AtimeRelative AtimePolicy = iota
+	// AtimeStrict updates the access time on every read.
+	AtimeStrict
+	// AtimeNever never updates the access time on reads.
+	AtimeNever
+)
+
+var atimePolicies = map[string]AtimePolicy{
+	"relatime":    AtimeRelative,
+	"strictatime": AtimeStrict,
+	"noatime":     AtimeNever,
+}
+
+// ParseAtimePolicy returns the policy named like the equivalent mount option:
+// relatime, strictatime or noatime.
+func ParseAtimePolicy(name string) (AtimePolicy, error) {
+	p, ok := atimePolicies[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown atime policy %q, expecting relatime, strictatime or noatime", name)
+	}
+	return p, nil
+}
+
+// The access time is saved along with the next change, or flush, so that reads
+// don't wait on the metadata server.
+// Call with lock held.
+func (node *CryptNode) accessed(now time.Time) {
+	switch node.factory.Atime {
+	case AtimeNever:
+		return
+	case AtimeRelative:
+		if node.Atime.After(node.Mtime) && node.Atime.After(node.Ctime) && now.Sub(node.Atime) < 24*time.Hour {
+			return
+		}
+	}
+	node.Atime = now
+	node.shouldSaveMetadata = true
+}
+
+// touch sets the modification and change times to now, as when the content of
+// a file or the entries of a directory change. It returns a function restoring
+// the previous times, for rollbacks.
+// Call with lock held.
+func (node *CryptNode) touch() (restore func()) {
+	mtime, ctime := node.Mtime, node.Ctime
+	node.Mtime = time.Now()
+	node.Ctime = node.Mtime
+	return func() {
+		node.Mtime = mtime
+		node.Ctime = ctime
+	}
+}
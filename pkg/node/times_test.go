@@ -0,0 +1,95 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestAtimePolicy(t *testing.T) {
+	now := time.Now()
+	hourAgo := now.Add(-time.Hour)
+	twoDaysAgo := now.Add(-48 * time.Hour)
+
+	for _, tc := range []struct {
+		policy  string
+		atime   time.Time
+		mtime   time.Time
+		updated bool
+	}{
+		{"strictatime", hourAgo, twoDaysAgo, true},
+		{"noatime", twoDaysAgo, hourAgo, false},
+		{"relatime", twoDaysAgo, hourAgo, true},
+		{"relatime", hourAgo, twoDaysAgo, false},
+		{"relatime", twoDaysAgo.Add(-time.Hour), twoDaysAgo.Add(-2 * time.Hour), true},
+	} {
+		policy, err := ParseAtimePolicy(tc.policy)
+		require.NoError(t, err)
+		node := &CryptNode{
+			factory: &CryptNodeFactory{Atime: policy},
+			Atime:   tc.atime,
+			Mtime:   tc.mtime,
+			Ctime:   tc.mtime,
+		}
+		node.accessed(now)
+		assert.Equal(t, tc.updated, node.Atime.Equal(now), "%s, atime %v, mtime %v", tc.policy, tc.atime, tc.mtime)
+		assert.Equal(t, tc.updated, node.shouldSaveMetadata)
+	}
+
+	_, err := ParseAtimePolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestTimes(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	rootdir, _, cleanup := testMount(t)
+	defer cleanup()
+
+	stat := func(p string) *syscall.Stat_t {
+		info, err := os.Stat(p)
+		require.NoError(err)
+		return info.Sys().(*syscall.Stat_t)
+	}
+
+	dir := filepath.Join(rootdir, "dir")
+	require.NoError(os.Mkdir(dir, 0755))
+	p := filepath.Join(dir, "file")
+
+	t.Run("creating a file changes the directory", func(t *testing.T) {
+		before := stat(dir)
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(os.WriteFile(p, []byte("content"), 0644))
+		after := stat(dir)
+		assert.NotEqual(before.Mtim, after.Mtim)
+		assert.NotEqual(before.Ctim, after.Ctim)
+	})
+
+	t.Run("utimensat with nanoseconds", func(t *testing.T) {
+		atime := time.Unix(1000, 123456789)
+		mtime := time.Unix(2000, 987654321)
+		require.NoError(os.Chtimes(p, atime, mtime))
+		st := stat(p)
+		assert.Equal(unix.NsecToTimespec(atime.UnixNano()), unix.Timespec(st.Atim))
+		assert.Equal(unix.NsecToTimespec(mtime.UnixNano()), unix.Timespec(st.Mtim))
+	})
+
+	t.Run("utimensat omitting atime", func(t *testing.T) {
+		before := stat(p)
+		ts := []unix.Timespec{
+			{Nsec: unix.UTIME_OMIT},
+			{Nsec: unix.UTIME_NOW},
+		}
+		require.NoError(unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, 0))
+		after := stat(p)
+		assert.Equal(before.Atim, after.Atim)
+		assert.WithinDuration(time.Now(), time.Unix(after.Mtim.Unix()), time.Minute)
+	})
+}
@@ -0,0 +1,173 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	sync "github.com/sasha-s/go-deadlock"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tree indexes the parents of the nodes in a metadata store, so that the
+// metadata server can tell whether a node is within a subtree. Only metadata
+// stored in clear can be indexed: encrypted nodes seem to have no children, so
+// that only their subtree roots are within subtrees.
+type Tree struct {
+	store storage.VersionedStore
+
+	mu     sync.Mutex
+	loaded bool
+	// Nodes not found, or that couldn't be got, have no children.
+	children map[[NodeKeyLen]byte][][NodeKeyLen]byte
+	parents  map[[NodeKeyLen]byte]map[[NodeKeyLen]byte]bool
+}
+
+// NewTree creates an index of the nodes in the given metadata store. The nodes
+// are walked from the root when the index is first used.
+func NewTree(store storage.VersionedStore) *Tree {
+	return &Tree{
+		store:    store,
+		children: make(map[[NodeKeyLen]byte][][NodeKeyLen]byte),
+		parents:  make(map[[NodeKeyLen]byte]map[[NodeKeyLen]byte]bool),
+	}
+}
+
+// IsNode tells whether the key is that of a node, as opposed to, e.g., that of
+// the salt for passphrases.
+func (t *Tree) IsNode(key []byte) bool {
+	return len(key) == NodeKeyLen
+}
+
+// Within tells whether the node with the given key is the given root or one of
+// its descendants, as committed.
+func (t *Tree) Within(root, key []byte) bool {
+	if !t.IsNode(root) || !t.IsNode(key) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.load()
+	visited := make(map[[NodeKeyLen]byte]bool)
+	ancestors := [][NodeKeyLen]byte{[NodeKeyLen]byte(key)}
+	for len(ancestors) > 0 {
+		k := ancestors[len(ancestors)-1]
+		ancestors = ancestors[:len(ancestors)-1]
+		if k == [NodeKeyLen]byte(root) {
+			return true
+		}
+		if visited[k] {
+			continue
+		}
+		visited[k] = true
+		for parent := range t.parents[k] {
+			ancestors = append(ancestors, parent)
+		}
+	}
+	return false
+}
+
+// Adopted returns the keys of the nodes the given mutations add as children of
+// nodes they aren't committed children of.
+func (t *Tree) Adopted(mutations []storage.Mutation) [][]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.load()
+	var adopted [][]byte
+	for _, m := range mutations {
+		if !t.IsNode(m.Key) {
+			continue
+		}
+		parent := [NodeKeyLen]byte(m.Key)
+		for _, child := range childKeys(m.Value) {
+			if !t.parents[child][parent] {
+				adopted = append(adopted, child[:])
+			}
+		}
+	}
+	return adopted
+}
+
+// Exists tells whether a node with the given key is committed. Nodes that
+// can't be got are taken as existing.
+func (t *Tree) Exists(key []byte) bool {
+	_, _, err := t.store.Get(key)
+	return !errors.Is(err, storage.ErrNotFound)
+}
+
+// Commit updates the index with the given mutations, once committed.
+func (t *Tree) Commit(mutations []storage.Mutation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		// They'll be got along with the rest.
+		return
+	}
+	for _, m := range mutations {
+		if t.IsNode(m.Key) {
+			t.setChildren([NodeKeyLen]byte(m.Key), childKeys(m.Value))
+		}
+	}
+}
+
+// Call with lock held.
+func (t *Tree) load() {
+	if t.loaded {
+		return
+	}
+	t.loaded = true
+	var root [NodeKeyLen]byte
+	pending := [][NodeKeyLen]byte{root}
+	for len(pending) > 0 {
+		key := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, visited := t.children[key]; visited {
+			continue
+		}
+		_, value, err := t.store.Get(key[:])
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.WithFields(log.Fields{
+				"err": err,
+				"key": fmt.Sprintf("%.10x", key[:]),
+			}).Warn("Could not index node, its children are out of any subtree")
+		}
+		children := childKeys(value)
+		t.setChildren(key, children)
+		pending = append(pending, children...)
+	}
+	log.WithField("nodes", len(t.children)).Info("Indexed file system tree")
+}
+
+// Call with lock held.
+func (t *Tree) setChildren(key [NodeKeyLen]byte, children [][NodeKeyLen]byte) {
+	for _, old := range t.children[key] {
+		delete(t.parents[old], key)
+		if len(t.parents[old]) == 0 {
+			delete(t.parents, old)
+		}
+	}
+	for _, child := range children {
+		if t.parents[child] == nil {
+			t.parents[child] = make(map[[NodeKeyLen]byte]bool)
+		}
+		t.parents[child][key] = true
+	}
+	t.children[key] = children
+}
+
+// childKeys returns the keys of the children listed in serialized metadata, or
+// none if it can't be decoded.
+func childKeys(value []byte) [][NodeKeyLen]byte {
+	if value == nil {
+		return nil
+	}
+	node := &CryptNode{factory: &CryptNodeFactory{}}
+	if err := node.unserialize(value); err != nil {
+		return nil
+	}
+	keys := make([][NodeKeyLen]byte, 0, len(node.Children))
+	for _, child := range node.Children {
+		keys = append(keys, child.Key)
+	}
+	return keys
+}
@@ -0,0 +1,91 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/crypt"
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTree(t *testing.T) {
+	// root -> dir -> file, and root -> other.
+	setup := func(t *testing.T, encrypted bool) (tree *Tree, metadata storage.VersionedStore, root, dir, file, other *CryptNode) {
+		metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		tree = NewTree(metadata)
+		if encrypted {
+			metadata = storage.NewEncryptedVersionedStore(metadata, crypt.KeyFromPassphrase([]byte("s3cr3t"), []byte("salt")))
+		}
+		factory := &CryptNodeFactory{Metadata: metadata}
+		newNode := func(mode uint32) *CryptNode {
+			n, err := factory.allocateNode()
+			require.NoError(t, err)
+			n.Mode = mode
+			if mode&fuse.S_IFDIR != 0 {
+				n.Children = make(map[string]*CryptNode)
+			}
+			return n
+		}
+		root = factory.ExistingNode("root", [NodeKeyLen]byte{})
+		root.Mode = fuse.S_IFDIR | 0o755
+		root.Children = make(map[string]*CryptNode)
+		dir = newNode(fuse.S_IFDIR | 0o755)
+		file = newNode(fuse.S_IFREG | 0o644)
+		other = newNode(fuse.S_IFREG | 0o644)
+		root.Children["dir"] = dir
+		root.Children["other"] = other
+		dir.Children["file"] = file
+		for _, n := range []*CryptNode{root, dir, file, other} {
+			require.NoError(t, n.saveMetadata())
+		}
+		return tree, metadata, root, dir, file, other
+	}
+
+	t.Run("tells nodes within a subtree", func(t *testing.T) {
+		tree, _, root, dir, file, other := setup(t, false)
+		assert.True(t, tree.Within(dir.Key[:], dir.Key[:]))
+		assert.True(t, tree.Within(dir.Key[:], file.Key[:]))
+		assert.True(t, tree.Within(root.Key[:], file.Key[:]))
+		assert.False(t, tree.Within(dir.Key[:], other.Key[:]))
+		assert.False(t, tree.Within(dir.Key[:], root.Key[:]))
+		assert.False(t, tree.Within(dir.Key[:], []byte("cryptfs.salt")))
+	})
+
+	t.Run("tells nodes adopted by pending mutations", func(t *testing.T) {
+		tree, _, _, dir, file, other := setup(t, false)
+		dir.Children["moved"] = other
+		pending := []storage.Mutation{{Version: dir.version + 1, Key: dir.Key[:], Value: dir.serialize()}}
+		assert.Equal(t, [][]byte{other.Key[:]}, tree.Adopted(pending))
+		// Only once committed.
+		assert.False(t, tree.Within(dir.Key[:], other.Key[:]))
+		assert.True(t, tree.Within(dir.Key[:], file.Key[:]))
+	})
+
+	t.Run("tells nodes that exist", func(t *testing.T) {
+		tree, _, _, dir, _, _ := setup(t, false)
+		assert.True(t, tree.Exists(dir.Key[:]))
+		unused := [NodeKeyLen]byte{1}
+		assert.False(t, tree.Exists(unused[:]))
+	})
+
+	t.Run("is kept up to date with commits", func(t *testing.T) {
+		tree, metadata, _, dir, file, other := setup(t, false)
+		require.True(t, tree.Within(dir.Key[:], file.Key[:]))
+
+		delete(dir.Children, "file")
+		dir.Children["moved"] = other
+		mutation := storage.Mutation{Version: dir.version + 1, Key: dir.Key[:], Value: dir.serialize()}
+		require.NoError(t, metadata.Put(mutation.Version, mutation.Key, mutation.Value))
+		tree.Commit([]storage.Mutation{mutation})
+		assert.False(t, tree.Within(dir.Key[:], file.Key[:]))
+		assert.True(t, tree.Within(dir.Key[:], other.Key[:]))
+	})
+
+	t.Run("can't tell the children of encrypted nodes", func(t *testing.T) {
+		tree, _, _, dir, file, _ := setup(t, true)
+		assert.True(t, tree.Within(dir.Key[:], dir.Key[:]))
+		assert.False(t, tree.Within(dir.Key[:], file.Key[:]))
+	})
+}
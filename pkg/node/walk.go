@@ -0,0 +1,41 @@
+package node
+
+import "fmt"
+
+// WalkBlobs calls fn with the key of every blob referenced by the tree rooted
+// at the given node key, loading nodes from the metadata store and manifests
+// from the blob store. Nodes reachable by more than one path are visited once.
+// WalkBlobs stops at the first error, be it from loading or from fn, so that a
+// partial walk is never mistaken for a complete one.
+func (factory *CryptNodeFactory) WalkBlobs(root [NodeKeyLen]byte, fn func(key []byte) error) error {
+	visited := make(map[[NodeKeyLen]byte]bool)
+	pending := [][NodeKeyLen]byte{root}
+	for len(pending) > 0 {
+		key := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if visited[key] {
+			continue
+		}
+		visited[key] = true
+		node := &CryptNode{factory: factory}
+		if err := node.LoadMetadata(key); err != nil {
+			return fmt.Errorf("could not load node %x: %w", key, err)
+		}
+		for _, child := range node.Children {
+			pending = append(pending, child.Key)
+		}
+		if len(node.contentKey) == 0 {
+			continue
+		}
+		keys, err := blobKeys(factory.Blobs, node.contentKey)
+		if err != nil {
+			return fmt.Errorf("could not list blobs of node %x: %w", key, err)
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
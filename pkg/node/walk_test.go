@@ -0,0 +1,86 @@
+package node
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/storage"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkBlobs(t *testing.T) {
+	g := NewInodeNumbersGenerator()
+	go g.Start()
+	defer g.Stop()
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	factory := &CryptNodeFactory{
+		InodeGenerator: g,
+		Metadata:       storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+		Blobs:          blobs,
+		ChunkSize:      4,
+	}
+
+	newNode := func(mode uint32) *CryptNode {
+		node, err := factory.allocateNode()
+		require.NoError(t, err)
+		node.Mode = mode
+		if mode&syscall.S_IFMT == fuse.S_IFDIR {
+			node.Children = make(map[string]*CryptNode)
+		}
+		return node
+	}
+	want := make(map[string]bool)
+
+	var rootKey [NodeKeyLen]byte
+	root := factory.ExistingNode("root", rootKey)
+	root.Mode = fuse.S_IFDIR | 0o755
+	root.Children = make(map[string]*CryptNode)
+	dir := newNode(fuse.S_IFDIR | 0o755)
+	root.Children["dir"] = dir
+
+	// Chunked content: the manifest and each chunk.
+	file := newNode(fuse.S_IFREG | 0o644)
+	file.content = newChunkedContent(factory.chunkSize())
+	require.NoError(t, file.content.writeAt(blobs, []byte("0123456789"), 0))
+	file.shouldSaveContent = true
+	require.Zero(t, file.sync())
+	want[string(file.contentKey[1:])] = true
+	for _, key := range file.content.keys {
+		want[string(key)] = true
+	}
+	dir.Children["file"] = file
+	// Reachable twice, listed once.
+	root.Children["again"] = file
+
+	// Legacy content: the whole blob.
+	legacy := newNode(fuse.S_IFREG | 0o644)
+	legacyKey, err := blobs.Put([]byte("legacy"))
+	require.NoError(t, err)
+	legacy.contentKey = legacyKey
+	want[string(legacyKey)] = true
+	dir.Children["legacy"] = legacy
+
+	for _, node := range []*CryptNode{legacy, dir, root} {
+		node.shouldSaveMetadata = true
+		require.Zero(t, node.sync())
+	}
+
+	walked := make(map[string]bool)
+	err = factory.WalkBlobs(rootKey, func(key []byte) error {
+		assert.False(t, walked[string(key)], "walked twice")
+		walked[string(key)] = true
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Len(t, want, 5)
+	assert.Equal(t, want, walked)
+
+	t.Run("missing node", func(t *testing.T) {
+		var missing [NodeKeyLen]byte
+		missing[0] = 1
+		err := factory.WalkBlobs(missing, func([]byte) error { return nil })
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+}
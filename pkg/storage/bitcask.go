@@ -9,7 +9,7 @@ import (
 
 // BitcaskStore is a bitcask based storege engine
 type BitcaskStore struct {
-	db BitcaskStore.DB
+	db *bitcask.Bitcask
 }
 
 // NewBitcaskStore creates a new store using Bitcask
@@ -38,5 +38,48 @@ func (s *BitcaskStore) Get(key []byte) (value []byte, err error) {
 	if err == bitcask.ErrKeyNotFound {
 		return nil, fmt.Errorf("%.40q: %w", key, ErrNotFound)
 	}
-	return value, nil
+	return value, err
+}
+
+// Delete implements the Store interface
+func (s *BitcaskStore) Delete(key []byte) (err error) {
+	return s.db.Delete(key)
+}
+
+// Has implements the Store interface
+func (s *BitcaskStore) Has(key []byte) (ok bool, err error) {
+	return s.db.Has(key), nil
+}
+
+// Usage implements the UsageReporter interface
+func (s *BitcaskStore) Usage() (u Usage, err error) {
+	if err := deviceUsage(s.db.Path(), &u); err != nil {
+		return u, err
+	}
+	stats, err := s.db.Stats()
+	if err != nil {
+		return u, err
+	}
+	u.Used = uint64(stats.Size)
+	u.Count = uint64(stats.Keys)
+	return u, nil
+}
+
+// Scan implements the Store interface
+func (s *BitcaskStore) Scan(prefix []byte, fn func(key []byte) error) (err error) {
+	// Collect first, as bitcask holds a lock while scanning.
+	var keys [][]byte
+	err = s.db.Scan(prefix, func(key bitcask.Key) error {
+		keys = append(keys, dup(key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheStoreOption is a functional option for configuring a CacheStore
+type CacheStoreOption func(*cacheStoreOptions)
+
+type cacheStoreOptions struct {
+	maxBytes int64
+	maxAge   time.Duration
+}
+
+// WithMaxBytes sets the total size of the values above which the least
+// recently used ones are evicted. Zero means no limit.
+func WithMaxBytes(value int64) CacheStoreOption {
+	return func(o *cacheStoreOptions) {
+		o.maxBytes = value
+	}
+}
+
+// WithMaxAge sets for how long a value can go unused before being evicted.
+// Zero means no limit.
+func WithMaxAge(value time.Duration) CacheStoreOption {
+	return func(o *cacheStoreOptions) {
+		o.maxAge = value
+	}
+}
+
+// CacheStats holds counters about a CacheStore since it was created.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+
+	// Current number and total size of the values in the cache.
+	Count int
+	Bytes int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+	used time.Time
+}
+
+// CacheStore implements Store keeping values in a directory like DiskStore,
+// evicting the least recently used ones when they grow above a size or go
+// unused for too long. The modification time of each file is updated when its
+// value is used, so that the order of use survives restarts.
+type CacheStore struct {
+	opts cacheStoreOptions
+	disk *DiskStore
+
+	mu sync.Mutex
+	// Of *cacheEntry, most recently used first.
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+// NewCacheStore creates a cache in the given directory, indexing the values
+// already there.
+func NewCacheStore(dir string, opts ...CacheStoreOption) (*CacheStore, error) {
+	s := &CacheStore{
+		disk:    NewDiskStore(dir),
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	for _, o := range opts {
+		o(&s.opts)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not make dir %q: %w", dir, err)
+	}
+	var found []*cacheEntry
+	err := s.disk.Walk(func(key []byte, info fs.FileInfo) error {
+		found = append(found, &cacheEntry{
+			key:  string(key),
+			size: info.Size(),
+			used: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not index %q: %w", dir, err)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].used.After(found[j].used)
+	})
+	for _, e := range found {
+		s.entries[e.key] = s.lru.PushBack(e)
+		s.stats.Bytes += e.size
+	}
+	s.stats.Count = len(found)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	return s, nil
+}
+
+// Put implements the Store interface
+func (s *CacheStore) Put(key, value []byte) error {
+	if err := s.disk.Put(key, value); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(string(key))
+	s.add(&cacheEntry{
+		key:  string(key),
+		size: int64(len(value)),
+		used: time.Now(),
+	})
+	s.evict()
+	return nil
+}
+
+// Get implements the Store interface. Values gone unused for too long are
+// evicted first, as there may be no puts to evict them on mounts mostly read.
+func (s *CacheStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	s.evict()
+	el, ok := s.entries[string(key)]
+	if !ok || s.expired(el.Value.(*cacheEntry), time.Now()) {
+		s.stats.Misses++
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%x: %w", key, ErrNotFound)
+	}
+	s.mu.Unlock()
+
+	value, err := s.disk.Get(key)
+
+	s.mu.Lock()
+	if err != nil {
+		// Evicted meanwhile, or removed from the directory behind our back.
+		s.remove(string(key))
+		s.stats.Misses++
+		s.mu.Unlock()
+		return nil, err
+	}
+	s.stats.Hits++
+	now := time.Now()
+	if el, ok := s.entries[string(key)]; ok {
+		el.Value.(*cacheEntry).used = now
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+
+	if err := os.Chtimes(s.disk.pathFor(key), now, now); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"err": err,
+			"key": fmt.Sprintf("%.10x", key),
+		}).Warn("Could not record use of cached value")
+	}
+	return value, nil
+}
+
+// Delete implements the Store interface
+func (s *CacheStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(string(key))
+	return s.disk.Delete(key)
+}
+
+// Has implements the Store interface
+func (s *CacheStore) Has(key []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.entries[string(key)]
+	return ok && !s.expired(el.Value.(*cacheEntry), time.Now()), nil
+}
+
+// Scan implements the Store interface
+func (s *CacheStore) Scan(prefix []byte, fn func(key []byte) error) error {
+	return s.disk.Scan(prefix, fn)
+}
+
+// Stats returns the counters of the cache.
+func (s *CacheStore) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Call with lock held.
+func (s *CacheStore) add(e *cacheEntry) {
+	s.entries[e.key] = s.lru.PushFront(e)
+	s.stats.Count++
+	s.stats.Bytes += e.size
+}
+
+// Call with lock held.
+func (s *CacheStore) remove(key string) {
+	el, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.entries, key)
+	s.stats.Count--
+	s.stats.Bytes -= el.Value.(*cacheEntry).size
+}
+
+// Call with lock held.
+func (s *CacheStore) expired(e *cacheEntry, now time.Time) bool {
+	return s.opts.maxAge > 0 && now.Sub(e.used) > s.opts.maxAge
+}
+
+// Evicts from the least recently used, while over the size limit or expired.
+// Call with lock held.
+func (s *CacheStore) evict() {
+	now := time.Now()
+	for el := s.lru.Back(); el != nil; el = s.lru.Back() {
+		e := el.Value.(*cacheEntry)
+		overSize := s.opts.maxBytes > 0 && s.stats.Bytes > s.opts.maxBytes
+		if !overSize && !s.expired(e, now) {
+			return
+		}
+		s.remove(e.key)
+		s.stats.Evictions++
+		if err := s.disk.Delete([]byte(e.key)); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"key": fmt.Sprintf("%.10x", e.key),
+			}).Warn("Could not evict cached value")
+		}
+	}
+}
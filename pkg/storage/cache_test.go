@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheStore(t *testing.T) {
+	value := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 10)
+	}
+
+	t.Run("evicts least recently used above max bytes", func(t *testing.T) {
+		store, err := NewCacheStore(t.TempDir(), WithMaxBytes(30))
+		require.NoError(t, err)
+		require.NoError(t, store.Put([]byte("a"), value('a')))
+		require.NoError(t, store.Put([]byte("b"), value('b')))
+		require.NoError(t, store.Put([]byte("c"), value('c')))
+		_, err = store.Get([]byte("a"))
+		require.NoError(t, err)
+		require.NoError(t, store.Put([]byte("d"), value('d')))
+
+		_, err = store.Get([]byte("b"))
+		assert.ErrorIs(t, err, ErrNotFound)
+		for _, key := range []string{"a", "c", "d"} {
+			got, err := store.Get([]byte(key))
+			require.NoError(t, err)
+			assert.Equal(t, value(key[0]), got)
+		}
+		stats := store.Stats()
+		assert.EqualValues(t, 4, stats.Hits)
+		assert.EqualValues(t, 1, stats.Misses)
+		assert.EqualValues(t, 1, stats.Evictions)
+		assert.Equal(t, 3, stats.Count)
+		assert.EqualValues(t, 30, stats.Bytes)
+	})
+
+	t.Run("evicts unused for max age", func(t *testing.T) {
+		store, err := NewCacheStore(t.TempDir(), WithMaxAge(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, store.Put([]byte("a"), value('a')))
+		store.lru.Front().Value.(*cacheEntry).used = time.Now().Add(-2 * time.Hour)
+		ok, err := store.Has([]byte("a"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+		require.NoError(t, store.Put([]byte("b"), value('b')))
+		assert.EqualValues(t, 1, store.Stats().Evictions)
+		assert.Equal(t, 1, store.Stats().Count)
+	})
+
+	t.Run("evicts unused for max age on get", func(t *testing.T) {
+		store, err := NewCacheStore(t.TempDir(), WithMaxAge(time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, store.Put([]byte("a"), value('a')))
+		require.NoError(t, store.Put([]byte("b"), value('b')))
+		store.lru.Back().Value.(*cacheEntry).used = time.Now().Add(-2 * time.Hour)
+
+		_, err = store.Get([]byte("b"))
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, store.Stats().Evictions)
+		assert.Equal(t, 1, store.Stats().Count)
+		_, err = store.disk.Get([]byte("a"))
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("rebuilds index from directory", func(t *testing.T) {
+		dir := t.TempDir()
+		before, err := NewCacheStore(dir)
+		require.NoError(t, err)
+		for i, key := range []string{"a", "b", "c"} {
+			require.NoError(t, before.Put([]byte(key), value(key[0])))
+			// Older first.
+			used := time.Now().Add(time.Duration(i-10) * time.Minute)
+			require.NoError(t, os.Chtimes(before.disk.pathFor([]byte(key)), used, used))
+		}
+
+		after, err := NewCacheStore(dir, WithMaxBytes(20))
+		require.NoError(t, err)
+		assert.Equal(t, 2, after.Stats().Count)
+		assert.EqualValues(t, 20, after.Stats().Bytes)
+		ok, err := after.Has([]byte("a"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+		got, err := after.Get([]byte("c"))
+		require.NoError(t, err)
+		assert.Equal(t, value('c'), got)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store, err := NewCacheStore(t.TempDir())
+		require.NoError(t, err)
+		require.NoError(t, store.Put([]byte("a"), value('a')))
+		require.NoError(t, store.Delete([]byte("a")))
+		_, err = store.Get([]byte("a"))
+		assert.ErrorIs(t, err, ErrNotFound)
+		assert.Equal(t, CacheStats{Misses: 1}, store.Stats())
+	})
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Change is a put or transaction committed to a store keeping a change log,
+// along with its sequence number.
+type Change struct {
+	Sequence  uint64
+	Mutations []Mutation
+}
+
+// ChangeLog is implemented by stores that number the puts and transactions
+// they commit, one after the other, and keep them. Commits are numbered from
+// one.
+type ChangeLog interface {
+	// Sequence should return the sequence number of the last change committed,
+	// or zero if there's none.
+	Sequence() (uint64, error)
+
+	// First should return the sequence number of the first change kept, or one
+	// if none was dropped.
+	First() (uint64, error)
+
+	// Changes should call fn with each change committed from the given sequence
+	// number up to the last one, in order. It should stop at the first error
+	// returned by fn and return it, and return ErrChangesDropped if the changes
+	// from the given one are no longer kept.
+	Changes(from uint64, fn func(Change) error) error
+}
+
+var (
+	// ErrNoChangeLog is returned when asking for changes to a store that doesn't
+	// keep them.
+	ErrNoChangeLog = errors.New("no change log")
+
+	// ErrChangesDropped is returned when asking for changes dropped from the
+	// change log to bound its size.
+	ErrChangesDropped = errors.New("changes dropped")
+)
+
+// VersionedWrapperOption is a functional option for configuring a
+// VersionedWrapper
+type VersionedWrapperOption func(*versionedWrapperOptions)
+
+type versionedWrapperOptions struct {
+	changeLog      bool
+	changeLogLimit uint64
+}
+
+// WithChangeLog makes the VersionedWrapper keep a change log in the delegate.
+// Each change is recorded along with the puts it commits, so puts are as
+// costly as transactions. Unless limited with WithChangeLogLimit, the change
+// log grows with every change.
+func WithChangeLog() VersionedWrapperOption {
+	return func(o *versionedWrapperOptions) {
+		o.changeLog = true
+	}
+}
+
+// WithChangeLogLimit makes the VersionedWrapper keep only the given number of
+// latest changes in its change log, dropping the oldest as new ones are
+// committed. Zero, the default, keeps them all.
+func WithChangeLogLimit(value uint64) VersionedWrapperOption {
+	return func(o *versionedWrapperOptions) {
+		o.changeLogLimit = value
+	}
+}
+
+// Where VersionedWrapper keeps the sequence number of the last change, as the
+// version of an empty value, and the changes themselves, as the version of
+// their encoded mutations. Node keys never have these lengths.
+var (
+	sequenceKey     = []byte("\x00sequence")
+	changeKeyPrefix = []byte("\x00change-")
+)
+
+// Reserved tells whether VersionedWrapper keeps the key for itself, for its
+// change log or the transaction being applied. Messages can't read or write
+// such keys.
+func Reserved(key []byte) bool {
+	return bytes.Equal(key, sequenceKey) ||
+		bytes.Equal(key, txnIntentKey) ||
+		len(key) == len(changeKeyPrefix)+8 && bytes.HasPrefix(key, changeKeyPrefix)
+}
+
+func changeKey(sequence uint64) []byte {
+	key := make([]byte, len(changeKeyPrefix)+8)
+	binary.BigEndian.PutUint64(key[copy(key, changeKeyPrefix):], sequence)
+	return key
+}
+
+// withChange adds the mutations recording the change they make to the given
+// ones, along with the values they overwrite, so that they're all committed
+// together.
+// Call with lock held.
+func (s *VersionedWrapper) withChange(mutations []Mutation, previous [][]byte) ([]Mutation, [][]byte, error) {
+	last, err := s.delegate.Get(sequenceKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, nil, fmt.Errorf("could not get sequence number: %w", err)
+	}
+	var sequence uint64 = 1
+	if last != nil {
+		sequence = binary.BigEndian.Uint64(last[0:8]) + 1
+	}
+	mutations = append(mutations[:len(mutations):len(mutations)],
+		Mutation{Version: sequence, Key: changeKey(sequence), Value: encodeIntent(mutations)},
+		Mutation{Version: sequence, Key: sequenceKey},
+	)
+	previous = append(previous[:len(previous):len(previous)], nil, last)
+	return mutations, previous, nil
+}
+
+// dropChange drops from the change log the change no longer kept now that the
+// given one is committed, if limited.
+// Call with lock held.
+func (s *VersionedWrapper) dropChange(committed uint64) {
+	limit := s.opts.changeLogLimit
+	if limit == 0 || committed <= limit {
+		return
+	}
+	if err := s.delegate.Delete(changeKey(committed - limit)); err != nil && !errors.Is(err, ErrNotFound) {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"sequence": committed - limit,
+		}).Warn("Could not drop change")
+	}
+}
+
+// Sequence implements the ChangeLog interface. It returns ErrNoChangeLog unless
+// created with the WithChangeLog option.
+func (s *VersionedWrapper) Sequence() (uint64, error) {
+	if !s.opts.changeLog {
+		return 0, ErrNoChangeLog
+	}
+	s.Lock()
+	defer s.Unlock()
+	last, err := s.delegate.Get(sequenceKey)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(last[0:8]), nil
+}
+
+// First implements the ChangeLog interface. It returns ErrNoChangeLog unless
+// created with the WithChangeLog option.
+func (s *VersionedWrapper) First() (uint64, error) {
+	last, err := s.Sequence()
+	if err != nil {
+		return 0, err
+	}
+	return s.first(last), nil
+}
+
+func (s *VersionedWrapper) first(last uint64) uint64 {
+	if limit := s.opts.changeLogLimit; limit != 0 && last > limit {
+		return last - limit + 1
+	}
+	return 1
+}
+
+// Changes implements the ChangeLog interface. It returns ErrNoChangeLog unless
+// created with the WithChangeLog option. The lock isn't held while calling fn,
+// so changes committed meanwhile are not passed to it.
+func (s *VersionedWrapper) Changes(from uint64, fn func(Change) error) error {
+	last, err := s.Sequence()
+	if err != nil {
+		return err
+	}
+	if first := s.first(last); max(from, 1) < first {
+		return fmt.Errorf("from %d, first kept is %d: %w", from, first, ErrChangesDropped)
+	}
+	for sequence := max(from, 1); sequence <= last; sequence++ {
+		s.Lock()
+		recorded, err := s.delegate.Get(changeKey(sequence))
+		s.Unlock()
+		if errors.Is(err, ErrNotFound) && s.opts.changeLogLimit != 0 {
+			// Dropped since, by changes committed meanwhile.
+			return fmt.Errorf("change %d: %w", sequence, ErrChangesDropped)
+		}
+		if err != nil {
+			return fmt.Errorf("could not get change %d: %w", sequence, err)
+		}
+		mutations, err := decodeIntent(recorded[8:])
+		if err != nil {
+			return fmt.Errorf("could not decode change %d: %w", sequence, err)
+		}
+		if err := fn(Change{Sequence: sequence, Mutations: mutations}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
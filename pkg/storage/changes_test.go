@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionedWrapperChanges(t *testing.T) {
+	changes := func(t *testing.T, log ChangeLog, from uint64) []Change {
+		var got []Change
+		require.NoError(t, log.Changes(from, func(c Change) error {
+			got = append(got, c)
+			return nil
+		}))
+		return got
+	}
+
+	t.Run("numbers puts and transactions", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore(), WithChangeLog())
+		sequence, err := store.Sequence()
+		require.NoError(t, err)
+		assert.Zero(t, sequence)
+
+		require.NoError(t, store.Put(1, []byte("a"), []byte("a1")))
+		require.NoError(t, store.PutAll([]Mutation{
+			{Version: 2, Key: []byte("a"), Value: []byte("a2")},
+			{Version: 1, Key: []byte("b"), Value: []byte("b1")},
+		}))
+		assert.ErrorIs(t, store.Put(1, []byte("a"), []byte("stale")), ErrStalePut)
+
+		sequence, err = store.Sequence()
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, sequence)
+		want := []Change{
+			{Sequence: 1, Mutations: []Mutation{
+				{Version: 1, Key: []byte("a"), Value: []byte("a1")},
+			}},
+			{Sequence: 2, Mutations: []Mutation{
+				{Version: 2, Key: []byte("a"), Value: []byte("a2")},
+				{Version: 1, Key: []byte("b"), Value: []byte("b1")},
+			}},
+		}
+		assert.Equal(t, want, changes(t, store, 0))
+		assert.Equal(t, want[1:], changes(t, store, 2))
+		assert.Empty(t, changes(t, store, 3))
+	})
+
+	t.Run("doesn't number failed transactions", func(t *testing.T) {
+		delegate := &failingKeyStore{InMemorySTore: NewInMemoryStore(), key: "b"}
+		store := NewVersionedWrapper(delegate, WithChangeLog())
+		require.NoError(t, store.Put(1, []byte("a"), []byte("a1")))
+		assert.Error(t, store.PutAll([]Mutation{
+			{Version: 2, Key: []byte("a"), Value: []byte("a2")},
+			{Version: 1, Key: []byte("b"), Value: []byte("b1")},
+		}))
+		sequence, err := store.Sequence()
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, sequence)
+		ok, err := delegate.Has(changeKey(2))
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		require.NoError(t, store.Put(2, []byte("a"), []byte("a2")))
+		got := changes(t, store, 2)
+		require.Len(t, got, 1)
+		assert.Equal(t, []Mutation{{Version: 2, Key: []byte("a"), Value: []byte("a2")}}, got[0].Mutations)
+	})
+
+	t.Run("drops the oldest changes when limited", func(t *testing.T) {
+		delegate := NewInMemoryStore()
+		store := NewVersionedWrapper(delegate, WithChangeLog(), WithChangeLogLimit(2))
+		for version := uint64(1); version <= 3; version++ {
+			require.NoError(t, store.Put(version, []byte("a"), []byte("a")))
+		}
+		first, err := store.First()
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, first)
+		ok, err := delegate.Has(changeKey(1))
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		got := changes(t, store, 2)
+		require.Len(t, got, 2)
+		assert.EqualValues(t, 2, got[0].Sequence)
+		assert.ErrorIs(t, store.Changes(1, func(Change) error { return nil }), ErrChangesDropped)
+	})
+
+	t.Run("keeps no change log unless asked to", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		require.NoError(t, store.Put(1, []byte("a"), []byte("a1")))
+		_, err := store.Sequence()
+		assert.ErrorIs(t, err, ErrNoChangeLog)
+		assert.ErrorIs(t, store.Changes(0, func(Change) error { return nil }), ErrNoChangeLog)
+	})
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 )
@@ -20,7 +23,7 @@ func NewDiskStore(dir string) *DiskStore {
 func (s *DiskStore) Put(key, value []byte) (err error) {
 	p := s.pathFor(key)
 	err = os.WriteFile(p, value, 0600)
-	if err != nil {
+	if err == nil {
 		return nil
 	}
 
@@ -42,6 +45,77 @@ func (s *DiskStore) Get(key []byte) (value []byte, err error) {
 	return
 }
 
+// Delete implements the Store interface
+func (s *DiskStore) Delete(key []byte) error {
+	p := s.pathFor(key)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove %q: %w", p, err)
+	}
+	return nil
+}
+
+// Has implements the Store interface
+func (s *DiskStore) Has(key []byte) (bool, error) {
+	_, err := os.Stat(s.pathFor(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Scan implements the Store interface
+func (s *DiskStore) Scan(prefix []byte, fn func(key []byte) error) error {
+	return s.Walk(func(key []byte, _ fs.FileInfo) error {
+		if !bytes.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// Usage implements the UsageReporter interface. It walks the whole directory,
+// so callers should not call it often.
+func (s *DiskStore) Usage() (Usage, error) {
+	var u Usage
+	if err := deviceUsage(s.dir, &u); err != nil {
+		return u, err
+	}
+	err := s.Walk(func(_ []byte, info fs.FileInfo) error {
+		u.Used += uint64(info.Size())
+		u.Count++
+		return nil
+	})
+	return u, err
+}
+
+// Walk calls fn with each key in the store and the info of the file holding its
+// value, in no particular order. Walk stops at the first error returned by fn
+// and returns it.
+func (s *DiskStore) Walk(fn func(key []byte, info fs.FileInfo) error) error {
+	return filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		key, err := hex.DecodeString(d.Name())
+		if err != nil || len(key) == 0 {
+			// Not written by the store.
+			return nil
+		}
+		info, err := d.Info()
+		if os.IsNotExist(err) {
+			// Deleted since listed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(key, info)
+	})
+}
+
 func (s *DiskStore) pathFor(key []byte) string {
 	hex := fmt.Sprintf("%02x", key)
 	return filepath.Join(s.dir, hex[:2], hex)
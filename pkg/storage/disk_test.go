@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir := t.TempDir()
+	store := NewDiskStore(dir)
+	keys := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, key := range keys {
+		require.NoError(store.Put(key, key))
+	}
+	// Not written by the store, must be skipped.
+	require.NoError(os.WriteFile(filepath.Join(dir, "README"), nil, 0600))
+
+	t.Run("walk", func(t *testing.T) {
+		walked := make(map[string]bool)
+		err := store.Walk(func(key []byte, info fs.FileInfo) error {
+			walked[string(key)] = true
+			assert.WithinDuration(time.Now(), info.ModTime(), time.Minute)
+			assert.EqualValues(len(key), info.Size())
+			return nil
+		})
+		require.NoError(err)
+		assert.Equal(map[string]bool{"first": true, "second": true, "third": true}, walked)
+	})
+	t.Run("walk stops at first error", func(t *testing.T) {
+		stop := errors.New("stop")
+		calls := 0
+		err := store.Walk(func([]byte, fs.FileInfo) error {
+			calls++
+			return stop
+		})
+		assert.ErrorIs(err, stop)
+		assert.Equal(1, calls)
+	})
+	t.Run("usage", func(t *testing.T) {
+		u, err := store.Usage()
+		require.NoError(err)
+		assert.EqualValues(3, u.Count)
+		assert.EqualValues(len("first")+len("second")+len("third"), u.Used)
+		assert.NotZero(u.Capacity)
+		assert.LessOrEqual(u.Available, u.Capacity)
+	})
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(store.Delete(keys[0]))
+		_, err := store.Get(keys[0])
+		assert.ErrorIs(err, ErrNotFound)
+		value, err := store.Get(keys[1])
+		require.NoError(err)
+		assert.Equal(keys[1], value)
+		assert.NoError(store.Delete(keys[0]))
+	})
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/EncrypteDL/CryptFS/pkg/crypt"
+	"golang.org/x/crypto/blake2b"
+)
+
+// EncryptedBlobStore is a BlobStore that encrypts values before handing them
+// to its delegate Store, so that the delegate (e.g., a blob server and its
+// disk) only ever sees ciphertext.
+//
+// By default every Put uses a random nonce, and the key of a value is the
+// Blake2b hash of its ciphertext, so that the same content put twice gets
+// stored twice. In convergent mode the nonce and the key are instead derived
+// from a keyed hash of the plaintext, so that the same content always yields
+// the same ciphertext and gets deduplicated by the delegate. Only clients
+// holding the same master key can tell two convergent blobs have the same
+// content.
+type EncryptedBlobStore struct {
+	delegate   Store
+	contentKey crypt.Key
+	addressKey crypt.Key
+	convergent bool
+}
+
+// NewEncryptedBlobStore creates a blob store encrypting values with a key
+// derived from the given master key, using random nonces.
+func NewEncryptedBlobStore(delegate Store, master crypt.Key) *EncryptedBlobStore {
+	return &EncryptedBlobStore{
+		delegate:   delegate,
+		contentKey: master.Derive("blob content"),
+		addressKey: master.Derive("blob address"),
+	}
+}
+
+// NewConvergentBlobStore creates a blob store encrypting values with a key
+// derived from the given master key, using nonces derived from the values, so
+// that equal values are stored only once.
+func NewConvergentBlobStore(delegate Store, master crypt.Key) *EncryptedBlobStore {
+	s := NewEncryptedBlobStore(delegate, master)
+	s.convergent = true
+	return s
+}
+
+// Put implements the BlobStore interface
+func (s *EncryptedBlobStore) Put(value []byte) (key []byte, err error) {
+	var (
+		nonce  []byte
+		sealed []byte
+	)
+	if s.convergent {
+		key = s.address(value)
+		nonce = key[:crypt.NonceSize]
+	}
+	sealed, err = crypt.Seal(s.contentKey, nonce, value, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !s.convergent {
+		hash := blake2b.Sum512(sealed)
+		key = hash[:]
+	}
+	err = s.delegate.Put(key, sealed)
+	return
+}
+
+// Get implements the BlobStore interface. Besides decrypting, it checks that
+// the value is the one that was put at the given key, in either mode, so that
+// the delegate can't swap a blob for another one.
+func (s *EncryptedBlobStore) Get(key []byte) (value []byte, err error) {
+	sealed, err := s.delegate.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err = crypt.Open(s.contentKey, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%.10x: %w", key, err)
+	}
+	if hash := blake2b.Sum512(sealed); bytes.Equal(key, hash[:]) {
+		return value, nil
+	}
+	if bytes.Equal(key, s.address(value)) {
+		return value, nil
+	}
+	return nil, fmt.Errorf("%.10x: content does not match key: %w", key, crypt.ErrDecrypt)
+}
+
+func (s *EncryptedBlobStore) address(value []byte) []byte {
+	h, err := blake2b.New512(s.addressKey[:])
+	if err != nil {
+		// Can only happen if the key is too long.
+		panic(err)
+	}
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// EncryptedVersionedStore is a VersionedStore that encrypts values before
+// handing them to its delegate. Keys and version numbers are left in clear, so
+// that the delegate can still check versions and notify clients of changes.
+// Each value is bound to its key and version, so the delegate can neither serve
+// a value under another key, nor an old value as a newer version.
+type EncryptedVersionedStore struct {
+	delegate VersionedStore
+	key      crypt.Key
+}
+
+// NewEncryptedVersionedStore creates a versioned store encrypting values with
+// a key derived from the given master key.
+func NewEncryptedVersionedStore(delegate VersionedStore, master crypt.Key) *EncryptedVersionedStore {
+	return &EncryptedVersionedStore{
+		delegate: delegate,
+		key:      master.Derive("metadata"),
+	}
+}
+
+// Put implements the VersionedStore interface
+func (s *EncryptedVersionedStore) Put(version uint64, key []byte, value []byte) error {
+	sealed, err := crypt.Seal(s.key, nil, value, additionalData(version, key))
+	if err != nil {
+		return err
+	}
+	return s.delegate.Put(version, key, sealed)
+}
+
+// PutAll implements the TransactionalStore interface, if the delegate does.
+func (s *EncryptedVersionedStore) PutAll(mutations []Mutation) error {
+	t, ok := s.delegate.(TransactionalStore)
+	if !ok {
+		return ErrNoTransactions
+	}
+	sealed := make([]Mutation, len(mutations))
+	for i, m := range mutations {
+		value, err := crypt.Seal(s.key, nil, m.Value, additionalData(m.Version, m.Key))
+		if err != nil {
+			return err
+		}
+		sealed[i] = Mutation{Version: m.Version, Key: m.Key, Value: value}
+	}
+	return t.PutAll(sealed)
+}
+
+// Get implements the VersionedStore interface
+func (s *EncryptedVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
+	version, sealed, err := s.delegate.Get(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	value, err = crypt.Open(s.key, sealed, additionalData(version, key))
+	if err != nil {
+		return 0, nil, fmt.Errorf("%.10x: %w", key, err)
+	}
+	return version, value, nil
+}
+
+func additionalData(version uint64, key []byte) []byte {
+	ad := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(ad, version)
+	copy(ad[8:], key)
+	return ad
+}
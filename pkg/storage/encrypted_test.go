@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/crypt"
+	"github.com/EncrypteDL/CryptFS/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedBlobStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	master := crypt.KeyFromPassphrase([]byte("s3cr3t"), []byte("salt"))
+	t.Run("delegate never sees plaintext", func(t *testing.T) {
+		delegate := NewInMemoryStore()
+		store := NewEncryptedBlobStore(delegate, master)
+		value := []byte("some very secret plaintext")
+		key, err := store.Put(value)
+		require.NoError(err)
+		stored, err := delegate.Get(key)
+		require.NoError(err)
+		assert.NotContains(string(stored), string(value))
+	})
+	t.Run("random mode, same value, different keys", func(t *testing.T) {
+		store := NewEncryptedBlobStore(NewInMemoryStore(), master)
+		value := message.RandomBytes()
+		key1, err := store.Put(value)
+		require.NoError(err)
+		key2, err := store.Put(value)
+		require.NoError(err)
+		assert.Len(key1, 64)
+		assert.NotEqual(key1, key2)
+	})
+	t.Run("convergent mode, same value, same key", func(t *testing.T) {
+		store := NewConvergentBlobStore(NewInMemoryStore(), master)
+		value := message.RandomBytes()
+		key1, err := store.Put(value)
+		require.NoError(err)
+		key2, err := store.Put(value)
+		require.NoError(err)
+		assert.Len(key1, 64)
+		assert.Equal(key1, key2)
+	})
+	t.Run("what you put is what you get", func(t *testing.T) {
+		delegate := NewInMemoryStore()
+		for _, store := range []*EncryptedBlobStore{
+			NewEncryptedBlobStore(delegate, master),
+			NewConvergentBlobStore(delegate, master),
+		} {
+			for _, before := range [][]byte{message.RandomBytes(), {}} {
+				key, err := store.Put(before)
+				require.NoError(err)
+				after, err := store.Get(key)
+				require.NoError(err)
+				assert.Equal(before, after)
+			}
+		}
+	})
+	t.Run("wrong master key cannot read", func(t *testing.T) {
+		delegate := NewInMemoryStore()
+		key, err := NewEncryptedBlobStore(delegate, master).Put([]byte("value"))
+		require.NoError(err)
+		other := crypt.KeyFromPassphrase([]byte("guess"), []byte("salt"))
+		_, err = NewEncryptedBlobStore(delegate, other).Get(key)
+		assert.ErrorIs(err, crypt.ErrDecrypt)
+	})
+	t.Run("swapped blobs are detected", func(t *testing.T) {
+		delegate := NewInMemoryStore()
+		store := NewEncryptedBlobStore(delegate, master)
+		key1, err := store.Put([]byte("first"))
+		require.NoError(err)
+		key2, err := store.Put([]byte("second"))
+		require.NoError(err)
+		sealed2, err := delegate.Get(key2)
+		require.NoError(err)
+		require.NoError(delegate.Put(key1, sealed2))
+		_, err = store.Get(key1)
+		assert.ErrorIs(err, crypt.ErrDecrypt)
+	})
+}
+
+func TestEncryptedVersionedStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	master := crypt.KeyFromPassphrase([]byte("s3cr3t"), []byte("salt"))
+	t.Run("delegate sees keys and versions but no values", func(t *testing.T) {
+		delegate := NewVersionedWrapper(NewInMemoryStore())
+		store := NewEncryptedVersionedStore(delegate, master)
+		require.NoError(store.Put(1, []byte("key"), []byte("secret value")))
+		version, stored, err := delegate.Get([]byte("key"))
+		require.NoError(err)
+		assert.EqualValues(1, version)
+		assert.NotContains(string(stored), "secret value")
+	})
+	t.Run("what you put is what you get", func(t *testing.T) {
+		store := NewEncryptedVersionedStore(NewVersionedWrapper(NewInMemoryStore()), master)
+		for i, before := range [][]byte{message.RandomBytes(), {}} {
+			key := []byte(fmt.Sprint("key", i))
+			require.NoError(store.Put(7, key, before))
+			version, after, err := store.Get(key)
+			require.NoError(err)
+			assert.EqualValues(7, version)
+			assert.Equal(before, after)
+		}
+	})
+	t.Run("versioning still works", func(t *testing.T) {
+		store := NewEncryptedVersionedStore(NewVersionedWrapper(NewInMemoryStore()), master)
+		require.NoError(store.Put(1, []byte("key"), []byte("one")))
+		assert.ErrorIs(store.Put(1, []byte("key"), []byte("two")), ErrStalePut)
+	})
+	t.Run("values are bound to keys and versions", func(t *testing.T) {
+		delegate := NewVersionedWrapper(NewInMemoryStore())
+		store := NewEncryptedVersionedStore(delegate, master)
+		require.NoError(store.Put(1, []byte("a"), []byte("value")))
+		_, sealed, err := delegate.Get([]byte("a"))
+		require.NoError(err)
+
+		require.NoError(delegate.Put(1, []byte("b"), sealed))
+		_, _, err = store.Get([]byte("b"))
+		assert.ErrorIs(err, crypt.ErrDecrypt)
+
+		require.NoError(delegate.Put(2, []byte("a"), sealed))
+		_, _, err = store.Get([]byte("a"))
+		assert.ErrorIs(err, crypt.ErrDecrypt)
+	})
+}
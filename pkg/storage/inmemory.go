@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"sync"
 )
@@ -37,3 +38,49 @@ func (s *InMemorySTore) Get(key []byte) (value []byte, err error) {
 	}
 	return value, nil
 }
+
+// Delete implements the Store interface
+func (s *InMemorySTore) Delete(key []byte) (err error) {
+	s.Lock()
+	delete(s.m, string(key))
+	s.Unlock()
+	return nil
+}
+
+// Has implements the Store interface
+func (s *InMemorySTore) Has(key []byte) (ok bool, err error) {
+	s.Lock()
+	_, ok = s.m[string(key)]
+	s.Unlock()
+	return ok, nil
+}
+
+// Usage implements the UsageReporter interface
+func (s *InMemorySTore) Usage() (u Usage, err error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, value := range s.m {
+		u.Used += uint64(len(value))
+	}
+	u.Count = uint64(len(s.m))
+	return u, nil
+}
+
+// Scan implements the Store interface
+func (s *InMemorySTore) Scan(prefix []byte, fn func(key []byte) error) (err error) {
+	// Collect first, so that fn can modify the store.
+	var keys [][]byte
+	s.Lock()
+	for key := range s.m {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, []byte(key))
+		}
+	}
+	s.Unlock()
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Types of locks, as in fcntl(2).
+const (
+	ReadLock  uint32 = unix.F_RDLCK
+	WriteLock uint32 = unix.F_WRLCK
+	Unlock    uint32 = unix.F_UNLCK
+)
+
+// Lock is an advisory lock on a range of bytes of a node.
+type Lock struct {
+	// Identifies the holder of the lock among those sharing a Locker, and the
+	// process that took it.
+	Owner uint64
+	Pid   uint32
+
+	// One of ReadLock, WriteLock and Unlock.
+	Type uint32
+
+	// The first and last byte locked, inclusive.
+	Start uint64
+	End   uint64
+}
+
+func (l Lock) overlaps(other Lock) bool {
+	return l.Start <= other.End && other.Start <= l.End
+}
+
+func (l Lock) conflicts(other Lock) bool {
+	return l.overlaps(other) && (l.Type == WriteLock || other.Type == WriteLock)
+}
+
+// Locker is implemented by whatever keeps track of advisory locks on nodes,
+// identified by their key. Locks follow POSIX semantics: any number of owners
+// can hold read locks on a byte, but a write lock excludes any other lock;
+// locking again a range held by the same owner replaces the lock.
+type Locker interface {
+	// GetLock returns the first lock held by someone else that conflicts with
+	// the given one, or the given one with type Unlock if there is none.
+	GetLock(key []byte, l Lock) (Lock, error)
+
+	// SetLock takes or, if its type is Unlock, releases the given lock. It
+	// should return ErrLocked if it conflicts with a lock held by someone else.
+	SetLock(key []byte, l Lock) error
+}
+
+var (
+	// ErrLocked is returned when a lock can't be taken because someone else
+	// holds a conflicting one.
+	ErrLocked = errors.New("locked")
+
+	// ErrBadLock is returned for locks of an unknown type, or ending before
+	// they start.
+	ErrBadLock = errors.New("bad lock")
+
+	// ErrLockLost is returned to the owner of locks that were released while
+	// disconnected from whoever keeps track of them, and could not be taken
+	// again.
+	ErrLockLost = errors.New("lock lost")
+)
+
+type lockSession struct {
+	table *LockTable
+	id    uint16
+}
+
+type heldLock struct {
+	session uint16
+	Lock
+}
+
+// LockTable keeps track of the locks taken over a number of sessions, e.g., a
+// metadata server's connections, in memory. Owners are only told apart within
+// a session, and all the locks held in a session are released together when
+// it ends.
+type LockTable struct {
+	mu    sync.Mutex
+	locks map[string][]heldLock
+}
+
+// NewLockTable creates an empty lock table.
+func NewLockTable() *LockTable {
+	return &LockTable{locks: make(map[string][]heldLock)}
+}
+
+// Session returns a Locker for the locks held in the session with the given id.
+func (t *LockTable) Session(id uint16) Locker {
+	return &lockSession{table: t, id: id}
+}
+
+// Release releases all the locks held in the session with the given id.
+func (t *LockTable) Release(id uint16) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key, held := range t.locks {
+		var kept []heldLock
+		for _, h := range held {
+			if h.session != id {
+				kept = append(kept, h)
+			}
+		}
+		t.set(key, kept)
+	}
+}
+
+// Held returns the locks held in the session with the given id, by key.
+func (t *LockTable) Held(id uint16) map[string][]Lock {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	held := make(map[string][]Lock)
+	for key, locks := range t.locks {
+		for _, h := range locks {
+			if h.session == id {
+				held[key] = append(held[key], h.Lock)
+			}
+		}
+	}
+	return held
+}
+
+// GetLock implements the Locker interface.
+func (s *lockSession) GetLock(key []byte, l Lock) (Lock, error) {
+	if err := checkLock(l); err != nil {
+		return Lock{}, err
+	}
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+	if h, ok := s.table.conflict(s.id, string(key), l); ok {
+		return h.Lock, nil
+	}
+	l.Type = Unlock
+	return l, nil
+}
+
+// SetLock implements the Locker interface.
+func (s *lockSession) SetLock(key []byte, l Lock) error {
+	if err := checkLock(l); err != nil {
+		return err
+	}
+	s.table.mu.Lock()
+	defer s.table.mu.Unlock()
+	if l.Type != Unlock {
+		if _, ok := s.table.conflict(s.id, string(key), l); ok {
+			return ErrLocked
+		}
+	}
+	// Whatever the owner held in the range is replaced, splitting the locks that
+	// stick out of it.
+	var kept []heldLock
+	for _, h := range s.table.locks[string(key)] {
+		if h.session != s.id || h.Owner != l.Owner || !h.overlaps(l) {
+			kept = append(kept, h)
+			continue
+		}
+		if h.Start < l.Start {
+			before := h
+			before.End = l.Start - 1
+			kept = append(kept, before)
+		}
+		if h.End > l.End {
+			after := h
+			after.Start = l.End + 1
+			kept = append(kept, after)
+		}
+	}
+	if l.Type != Unlock {
+		kept = append(kept, heldLock{session: s.id, Lock: l})
+	}
+	s.table.set(string(key), kept)
+	return nil
+}
+
+// Call with lock held.
+func (t *LockTable) conflict(session uint16, key string, l Lock) (heldLock, bool) {
+	for _, h := range t.locks[key] {
+		if h.session == session && h.Owner == l.Owner {
+			continue
+		}
+		if h.conflicts(l) {
+			return h, true
+		}
+	}
+	return heldLock{}, false
+}
+
+// Call with lock held.
+func (t *LockTable) set(key string, held []heldLock) {
+	if len(held) == 0 {
+		delete(t.locks, key)
+		return
+	}
+	t.locks[key] = held
+}
+
+func checkLock(l Lock) error {
+	switch {
+	case l.Type != ReadLock && l.Type != WriteLock && l.Type != Unlock:
+		return fmt.Errorf("type %d: %w", l.Type, ErrBadLock)
+	case l.End < l.Start:
+		return fmt.Errorf("range %d-%d: %w", l.Start, l.End, ErrBadLock)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockTable(t *testing.T) {
+	key := []byte("node")
+	lock := func(owner uint64, typ uint32, start, end uint64) Lock {
+		return Lock{Owner: owner, Pid: uint32(owner), Type: typ, Start: start, End: end}
+	}
+
+	t.Run("read locks are shared", func(t *testing.T) {
+		table := NewLockTable()
+		first, second := table.Session(1), table.Session(2)
+		require.NoError(t, first.SetLock(key, lock(1, ReadLock, 0, 99)))
+		require.NoError(t, second.SetLock(key, lock(1, ReadLock, 50, 149)))
+		assert.ErrorIs(t, second.SetLock(key, lock(1, WriteLock, 0, 9)), ErrLocked)
+		require.NoError(t, second.SetLock(key, lock(1, WriteLock, 100, 149)))
+	})
+
+	t.Run("write locks are exclusive", func(t *testing.T) {
+		table := NewLockTable()
+		first, second := table.Session(1), table.Session(2)
+		require.NoError(t, first.SetLock(key, lock(1, WriteLock, 0, math.MaxUint64)))
+		assert.ErrorIs(t, second.SetLock(key, lock(1, ReadLock, 10, 10)), ErrLocked)
+		// Owners are told apart within a session too.
+		assert.ErrorIs(t, first.SetLock(key, lock(2, ReadLock, 10, 10)), ErrLocked)
+		// Other nodes aren't affected.
+		require.NoError(t, second.SetLock([]byte("other"), lock(1, WriteLock, 0, 9)))
+
+		got, err := second.GetLock(key, lock(1, ReadLock, 10, 10))
+		require.NoError(t, err)
+		assert.Equal(t, lock(1, WriteLock, 0, math.MaxUint64), got)
+		got, err = first.GetLock(key, lock(1, ReadLock, 10, 10))
+		require.NoError(t, err)
+		assert.Equal(t, lock(1, Unlock, 10, 10), got)
+	})
+
+	t.Run("unlocking splits ranges", func(t *testing.T) {
+		table := NewLockTable()
+		first, second := table.Session(1), table.Session(2)
+		require.NoError(t, first.SetLock(key, lock(1, WriteLock, 0, 99)))
+		require.NoError(t, first.SetLock(key, lock(1, Unlock, 40, 59)))
+		require.NoError(t, second.SetLock(key, lock(1, WriteLock, 40, 59)))
+		assert.ErrorIs(t, second.SetLock(key, lock(1, WriteLock, 39, 39)), ErrLocked)
+		assert.ErrorIs(t, second.SetLock(key, lock(1, WriteLock, 60, 60)), ErrLocked)
+	})
+
+	t.Run("relocking replaces the lock", func(t *testing.T) {
+		table := NewLockTable()
+		first, second := table.Session(1), table.Session(2)
+		require.NoError(t, first.SetLock(key, lock(1, WriteLock, 0, 99)))
+		require.NoError(t, first.SetLock(key, lock(1, ReadLock, 0, 99)))
+		require.NoError(t, second.SetLock(key, lock(1, ReadLock, 0, 99)))
+	})
+
+	t.Run("releases the locks of a session", func(t *testing.T) {
+		table := NewLockTable()
+		first, second := table.Session(1), table.Session(2)
+		require.NoError(t, first.SetLock(key, lock(1, WriteLock, 0, 99)))
+		require.NoError(t, first.SetLock(key, lock(2, WriteLock, 100, 199)))
+		table.Release(1)
+		require.NoError(t, second.SetLock(key, lock(1, WriteLock, 0, 199)))
+	})
+
+	t.Run("lists the locks of a session", func(t *testing.T) {
+		table := NewLockTable()
+		first, second := table.Session(1), table.Session(2)
+		require.NoError(t, first.SetLock(key, lock(1, WriteLock, 0, 99)))
+		require.NoError(t, first.SetLock(key, lock(1, Unlock, 40, 59)))
+		require.NoError(t, second.SetLock(key, lock(2, ReadLock, 200, 299)))
+		assert.Equal(t, map[string][]Lock{
+			string(key): {lock(1, WriteLock, 0, 39), lock(1, WriteLock, 60, 99)},
+		}, table.Held(1))
+		assert.Empty(t, table.Held(3))
+	})
+
+	t.Run("rejects bad locks", func(t *testing.T) {
+		session := NewLockTable().Session(1)
+		assert.ErrorIs(t, session.SetLock(key, lock(1, 42, 0, 9)), ErrBadLock)
+		assert.ErrorIs(t, session.SetLock(key, lock(1, ReadLock, 9, 0)), ErrBadLock)
+		_, err := session.GetLock(key, lock(1, 42, 0, 9))
+		assert.ErrorIs(t, err, ErrBadLock)
+	})
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/EncrypteDL/CryptFS/pkg/message"
@@ -8,28 +9,179 @@ import (
 )
 
 // ApplyMessage applies the message to the store
-func ApplyMessage(store VersionedStore, in message.Message) (out message.Message) {
+func ApplyMessage(store VersionedStore, in message.Message, opts ...ApplyOption) (out message.Message) {
+	var o applyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	inTag := in.Tag()
 	switch kind := in.Kind(); kind {
 	case message.KindGet:
+		if !o.canRead([]byte(in.Key())) {
+			return errorMessage(inTag, ErrForbidden)
+		}
 		version, value, err := store.Get([]byte(in.Key()))
 		if err != nil {
-			return message.NewErrorMessage(inTag, err.Error())
+			return errorMessage(inTag, err)
 		}
 		return message.NewPutMessage(inTag, in.Key(), string(value), version)
+	case message.KindLease:
+		// Only the value, granting the lease is up to the server.
+		if !o.canRead([]byte(in.Key())) {
+			return errorMessage(inTag, ErrForbidden)
+		}
+		version, value, err := store.Get([]byte(in.Key()))
+		if err != nil {
+			return errorMessage(inTag, err)
+		}
+		return message.NewLeaseMessage(inTag, in.Key(), string(value), version)
+	case message.KindRevalidate:
+		// Only the versions, granting leases is up to the server.
+		versions := in.Puts()
+		latest := make([]message.Message, len(versions))
+		for i, v := range versions {
+			version, _, err := store.Get([]byte(v.Key()))
+			switch {
+			case !o.canRead([]byte(v.Key())):
+				// As if gone, so that no lease is granted.
+				version = 0
+			case errors.Is(err, ErrNotFound):
+				version = 0
+			case err != nil:
+				return errorMessage(inTag, err)
+			}
+			latest[i] = message.NewPutMessage(0, v.Key(), "", version)
+		}
+		return message.NewRevalidateMessage(inTag, latest)
 	case message.KindPut:
+		if !o.canWrite([]Mutation{{Version: in.Version(), Key: []byte(in.Key()), Value: []byte(in.Value())}}) {
+			return errorMessage(inTag, ErrForbidden)
+		}
 		err := store.Put(in.Version(), []byte(in.Key()), []byte(in.Value()))
 		if err != nil {
-			return message.NewErrorMessage(inTag, err.Error())
+			return errorMessage(inTag, err)
 		}
 		log.WithFields(log.Fields{
 			"key":     fmt.Sprintf("%.10x", in.Key()),
 			"version": in.Version(),
 		}).Debug("Applied put message")
 		return in
-	case message.KindAuth, message.KindError:
+	case message.KindTxn:
+		t, ok := store.(TransactionalStore)
+		if !ok {
+			return errorMessage(inTag, ErrNoTransactions)
+		}
+		puts := in.Puts()
+		mutations := make([]Mutation, len(puts))
+		for i, p := range puts {
+			mutations[i] = Mutation{Version: p.Version(), Key: []byte(p.Key()), Value: []byte(p.Value())}
+		}
+		if !o.canWrite(mutations) {
+			return errorMessage(inTag, ErrForbidden)
+		}
+		if err := t.PutAll(mutations); err != nil {
+			return errorMessage(inTag, err)
+		}
+		log.WithFields(log.Fields{
+			"puts": len(puts),
+		}).Debug("Applied txn message")
+		return in
+	case message.KindSubscribe:
+		// Only the last sequence number, streaming changes, and leaving out the
+		// puts that can't be read, is up to the server.
+		l, ok := store.(ChangeLog)
+		if !ok {
+			return errorMessage(inTag, ErrNoChangeLog)
+		}
+		sequence, err := l.Sequence()
+		if err != nil {
+			return errorMessage(inTag, err)
+		}
+		first, err := l.First()
+		if err != nil {
+			return errorMessage(inTag, err)
+		}
+		if max(in.Sequence(), 1) < first {
+			return errorMessage(inTag, ErrChangesDropped)
+		}
+		return message.NewSubscribeMessage(inTag, sequence)
+	case message.KindUsage:
+		r, ok := store.(UsageReporter)
+		if !ok {
+			return errorMessage(inTag, ErrUsageUnknown)
+		}
+		u, err := r.Usage()
+		if err != nil {
+			return errorMessage(inTag, err)
+		}
+		return message.NewUsageMessage(inTag, message.Usage(u))
+	case message.KindAuth, message.KindError, message.KindGetLock, message.KindSetLock, message.KindRevoke, message.KindChange:
 		return message.NewErrorMessage(inTag, fmt.Sprintf("messages of kind %s cannot be applied", kind))
 	default:
 		return message.NewErrorMessage(inTag, "unknown message kind")
 	}
 }
+
+// ApplyLockMessage applies the lock message to the locker. Nodes that can be
+// read can be locked.
+func ApplyLockMessage(locker Locker, in message.Message, opts ...ApplyOption) (out message.Message) {
+	var o applyOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	inTag := in.Tag()
+	switch kind := in.Kind(); kind {
+	case message.KindGetLock:
+		if !o.canRead([]byte(in.Key())) {
+			return errorMessage(inTag, ErrForbidden)
+		}
+		l, err := locker.GetLock([]byte(in.Key()), Lock(in.Lock()))
+		if err != nil {
+			return errorMessage(inTag, err)
+		}
+		return message.NewGetLockMessage(inTag, in.Key(), message.Lock(l))
+	case message.KindSetLock:
+		if !o.canRead([]byte(in.Key())) {
+			return errorMessage(inTag, ErrForbidden)
+		}
+		if err := locker.SetLock([]byte(in.Key()), Lock(in.Lock())); err != nil {
+			return errorMessage(inTag, err)
+		}
+		log.WithFields(log.Fields{
+			"key":  fmt.Sprintf("%.10x", in.Key()),
+			"lock": in.Lock(),
+		}).Debug("Applied lock message")
+		return in
+	default:
+		return message.NewErrorMessage(inTag, fmt.Sprintf("messages of kind %s are not about locks", kind))
+	}
+}
+
+// errorMessage constructs an error message for the given error. Errors clients
+// need to tell apart are sent verbatim, without any wrapping context.
+func errorMessage(tag uint16, err error) message.Message {
+	switch {
+	case errors.Is(err, ErrStalePut):
+		return message.NewErrorMessage(tag, ErrStalePut.Error())
+	case errors.Is(err, ErrNotFound):
+		return message.NewErrorMessage(tag, ErrNotFound.Error())
+	case errors.Is(err, ErrUsageUnknown):
+		return message.NewErrorMessage(tag, ErrUsageUnknown.Error())
+	case errors.Is(err, ErrNoTransactions):
+		return message.NewErrorMessage(tag, ErrNoTransactions.Error())
+	case errors.Is(err, ErrBadTransaction):
+		return message.NewErrorMessage(tag, ErrBadTransaction.Error())
+	case errors.Is(err, ErrLocked):
+		return message.NewErrorMessage(tag, ErrLocked.Error())
+	case errors.Is(err, ErrBadLock):
+		return message.NewErrorMessage(tag, ErrBadLock.Error())
+	case errors.Is(err, ErrNoChangeLog):
+		return message.NewErrorMessage(tag, ErrNoChangeLog.Error())
+	case errors.Is(err, ErrChangesDropped):
+		return message.NewErrorMessage(tag, ErrChangesDropped.Error())
+	case errors.Is(err, ErrForbidden):
+		return message.NewErrorMessage(tag, ErrForbidden.Error())
+	default:
+		return message.NewErrorMessage(tag, err.Error())
+	}
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/EncrypteDL/CryptFS/pkg/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noUsageStore struct {
+	VersionedStore
+}
+
+func TestApplyUsageMessage(t *testing.T) {
+	t.Run("reports usage", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		require.NoError(t, store.Put(1, []byte("key"), []byte("value")))
+		out := ApplyMessage(store, message.NewUsageMessage(42, message.Usage{}))
+		require.Equal(t, message.KindUsage, out.Kind())
+		assert.EqualValues(t, 42, out.Tag())
+		assert.Equal(t, message.Usage{Used: 8 + 5, Count: 1}, out.Usage())
+	})
+
+	t.Run("unknown usage", func(t *testing.T) {
+		store := noUsageStore{NewVersionedWrapper(NewInMemoryStore())}
+		out := ApplyMessage(store, message.NewUsageMessage(42, message.Usage{}))
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrUsageUnknown.Error(), out.Value())
+	})
+}
+
+func TestApplyTxnMessage(t *testing.T) {
+	puts := []message.Message{
+		message.NewPutMessage(0, "a", "1", 1),
+		message.NewPutMessage(0, "b", "2", 1),
+	}
+
+	t.Run("applies all puts", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		in := message.NewTxnMessage(42, puts)
+		out := ApplyMessage(store, in)
+		require.Equal(t, in, out)
+		for _, p := range puts {
+			version, value, err := store.Get([]byte(p.Key()))
+			require.NoError(t, err)
+			assert.EqualValues(t, 1, version)
+			assert.Equal(t, p.Value(), string(value))
+		}
+	})
+
+	t.Run("applies no put if any is stale", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		require.NoError(t, store.Put(1, []byte("b"), []byte("0")))
+		out := ApplyMessage(store, message.NewTxnMessage(42, puts))
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrStalePut.Error(), out.Value())
+		_, _, err := store.Get([]byte("a"))
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("needs a transactional store", func(t *testing.T) {
+		store := noUsageStore{NewVersionedWrapper(NewInMemoryStore())}
+		out := ApplyMessage(store, message.NewTxnMessage(42, puts))
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrNoTransactions.Error(), out.Value())
+	})
+}
+
+func TestApplySubscribeMessage(t *testing.T) {
+	t.Run("responds with the last sequence number", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore(), WithChangeLog())
+		require.NoError(t, store.Put(1, []byte("key"), []byte("value")))
+		out := ApplyMessage(store, message.NewSubscribeMessage(42, 0))
+		assert.Equal(t, message.NewSubscribeMessage(42, 1), out)
+	})
+
+	t.Run("refuses changes already dropped", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore(), WithChangeLog(), WithChangeLogLimit(1))
+		require.NoError(t, store.Put(1, []byte("key"), []byte("value")))
+		require.NoError(t, store.Put(2, []byte("key"), []byte("value")))
+		out := ApplyMessage(store, message.NewSubscribeMessage(42, 1))
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrChangesDropped.Error(), out.Value())
+		assert.Equal(t, message.NewSubscribeMessage(42, 2), ApplyMessage(store, message.NewSubscribeMessage(42, 2)))
+	})
+
+	t.Run("needs a change log", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		out := ApplyMessage(store, message.NewSubscribeMessage(42, 0))
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrNoChangeLog.Error(), out.Value())
+	})
+}
+
+func TestApplyLockMessage(t *testing.T) {
+	l := message.Lock{Owner: 1, Type: WriteLock, End: 99}
+
+	t.Run("grants locks", func(t *testing.T) {
+		table := NewLockTable()
+		in := message.NewSetLockMessage(42, "key", l)
+		require.Equal(t, in, ApplyLockMessage(table.Session(1), in))
+		out := ApplyLockMessage(table.Session(2), message.NewGetLockMessage(43, "key", l))
+		require.Equal(t, message.KindGetLock, out.Kind())
+		assert.EqualValues(t, 43, out.Tag())
+		assert.Equal(t, l, out.Lock())
+	})
+
+	t.Run("refuses conflicting locks", func(t *testing.T) {
+		table := NewLockTable()
+		require.NoError(t, table.Session(1).SetLock([]byte("key"), Lock(l)))
+		out := ApplyLockMessage(table.Session(2), message.NewSetLockMessage(42, "key", l))
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrLocked.Error(), out.Value())
+	})
+}
+
+// prefixPermissions allow reading keys with any of the given prefixes, and
+// writing those starting with "rw".
+type prefixPermissions []string
+
+func (p prefixPermissions) CanRead(key []byte) bool {
+	for _, prefix := range p {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p prefixPermissions) CanWrite(mutations []Mutation) bool {
+	for _, m := range mutations {
+		if !p.CanRead(m.Key) || !bytes.HasPrefix(m.Key, []byte("rw")) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestApplyMessageWithPermissions(t *testing.T) {
+	store := NewVersionedWrapper(NewInMemoryStore())
+	for _, key := range []string{"ro", "rw", "no"} {
+		require.NoError(t, store.Put(1, []byte(key), []byte("value")))
+	}
+	perms := WithPermissions(prefixPermissions{"ro", "rw"})
+	forbidden := func(t *testing.T, out message.Message) {
+		t.Helper()
+		require.Equal(t, message.KindError, out.Kind())
+		assert.Equal(t, ErrForbidden.Error(), out.Value())
+	}
+
+	t.Run("gets what can be read", func(t *testing.T) {
+		assert.Equal(t, message.KindPut, ApplyMessage(store, message.NewGetMessage(42, "ro"), perms).Kind())
+		assert.Equal(t, message.KindLease, ApplyMessage(store, message.NewLeaseMessage(42, "ro", "", 0), perms).Kind())
+		forbidden(t, ApplyMessage(store, message.NewGetMessage(42, "no"), perms))
+		forbidden(t, ApplyMessage(store, message.NewLeaseMessage(42, "no", "", 0), perms))
+	})
+
+	t.Run("revalidates what can be read", func(t *testing.T) {
+		out := ApplyMessage(store, message.NewRevalidateMessage(42, []message.Message{
+			message.NewPutMessage(0, "ro", "", 1),
+			message.NewPutMessage(0, "no", "", 1),
+		}), perms)
+		require.Equal(t, message.KindRevalidate, out.Kind())
+		assert.EqualValues(t, 1, out.Puts()[0].Version())
+		assert.EqualValues(t, 0, out.Puts()[1].Version())
+	})
+
+	t.Run("puts what can be written", func(t *testing.T) {
+		in := message.NewPutMessage(42, "rw", "new", 2)
+		assert.Equal(t, in, ApplyMessage(store, in, perms))
+		forbidden(t, ApplyMessage(store, message.NewPutMessage(42, "ro", "new", 2), perms))
+		forbidden(t, ApplyMessage(store, message.NewTxnMessage(42, []message.Message{
+			message.NewPutMessage(0, "rw", "newer", 3),
+			message.NewPutMessage(0, "ro", "new", 2),
+		}), perms))
+		_, value, err := store.Get([]byte("rw"))
+		require.NoError(t, err)
+		assert.Equal(t, "new", string(value))
+	})
+
+	t.Run("neither reads nor writes reserved keys", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore(), WithChangeLog())
+		require.NoError(t, store.Put(1, []byte("key"), []byte("value")))
+		for _, key := range []string{string(sequenceKey), string(changeKey(1)), string(txnIntentKey)} {
+			forbidden(t, ApplyMessage(store, message.NewGetMessage(42, key)))
+			forbidden(t, ApplyMessage(store, message.NewLeaseMessage(42, key, "", 0)))
+			forbidden(t, ApplyMessage(store, message.NewPutMessage(42, key, "forged", 100)))
+			forbidden(t, ApplyMessage(store, message.NewTxnMessage(42, []message.Message{
+				message.NewPutMessage(0, "key", "value", 2),
+				message.NewPutMessage(0, key, "forged", 100),
+			})))
+			out := ApplyMessage(store, message.NewRevalidateMessage(42, []message.Message{
+				message.NewPutMessage(0, key, "", 1),
+			}))
+			require.Equal(t, message.KindRevalidate, out.Kind())
+			assert.EqualValues(t, 0, out.Puts()[0].Version())
+		}
+		// Node keys may start as reserved keys do.
+		assert.Equal(t, message.KindPut, ApplyMessage(store, message.NewPutMessage(42, "\x00change-", "value", 1)).Kind())
+		sequence, err := store.Sequence()
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, sequence)
+	})
+
+	t.Run("locks what can be read", func(t *testing.T) {
+		table := NewLockTable()
+		l := message.Lock{Owner: 1, Type: ReadLock, End: 99}
+		in := message.NewSetLockMessage(42, "ro", l)
+		assert.Equal(t, in, ApplyLockMessage(table.Session(1), in, perms))
+		forbidden(t, ApplyLockMessage(table.Session(1), message.NewSetLockMessage(42, "no", l), perms))
+	})
+}
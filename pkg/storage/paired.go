@@ -1,44 +1,128 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// PairedOption is a functional option for configuring a Paired store
+type PairedOption func(*pairedOptions)
+
+type pairedOptions struct {
+	journal    Store
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// WithJournal sets the store recording the values not yet written back to the
+// slow store. With a persistent journal, pending write backs survive restarts.
+// By default, the journal is kept in memory.
+func WithJournal(value Store) PairedOption {
+	return func(o *pairedOptions) {
+		o.journal = value
+	}
+}
+
+// WithBackoff sets the bounds of the exponential backoff between attempts to
+// write back a value to the slow store.
+func WithBackoff(min, max time.Duration) PairedOption {
+	return func(o *pairedOptions) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
 // Paired implements Store wrapping a pair of stores, one fast, one slow. It
 // will handle puts storing data in the fast store and syncing that to the slow
 // store in the background. It will handle gets from the fast store if possible,
 // otherwise from the slow store (and in this case also propagate the data from
 // the slow to the fast store, for next time that piece of data is requested).
+//
+// Values are recorded in a journal until written back, as the fast store may be
+// a cache evicting them. Values already in the journal when the store is
+// created, e.g., by a previous process, are written back too.
 type Paired struct {
+	opts pairedOptions
 	fast Store
 	slow Store
 
-	wbc chan [2][]byte
+	mu sync.Mutex
+	// Signaled when the queue changes.
+	cond *sync.Cond
+	// Keys to write back, oldest first.
+	queue   [][]byte
+	pending map[string]bool
 }
 
-func NewPaired(fast, slow Store) Paired {
-	p := Paired{
-		fast: fast,
-		slow: slow,
-		wbc:  make(chan [2][]byte, 42),
+// NewPaired creates a Paired store and starts writing back the values already
+// in the journal.
+func NewPaired(fast, slow Store, opts ...PairedOption) (*Paired, error) {
+	p := &Paired{
+		fast:    fast,
+		slow:    slow,
+		pending: make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.opts.minBackoff = time.Second
+	p.opts.maxBackoff = time.Minute
+	for _, o := range opts {
+		o(&p.opts)
+	}
+	if p.opts.journal == nil {
+		p.opts.journal = NewInMemoryStore()
+	}
+
+	err := p.opts.journal.Scan(nil, func(key []byte) error {
+		p.enqueue(key)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not replay journal: %w", err)
+	}
+	if n := p.Pending(); n > 0 {
+		log.WithField("pending", n).Info("Resuming write back from journal")
 	}
 
 	//Exits only when the process is terminited
 	go p.writeback()
-	return p
+	return p, nil
 }
 
-func (s Paired) Get(Key []byte) (value []byte, err error) {
+// Put stores the value in the fast store and in the journal, and queues it for
+// being written back to the slow store.
+func (s *Paired) Put(key, value []byte) error {
+	if err := s.fast.Put(key, value); err != nil {
+		return err
+	}
+	if err := s.opts.journal.Put(key, value); err != nil {
+		return fmt.Errorf("could not journal %x: %w", key, err)
+	}
+	s.enqueue(dup(key))
+	return nil
+}
+
+func (s *Paired) Get(Key []byte) (value []byte, err error) {
 	value, err = s.fast.Get(Key)
-	if err != nil {
-		return
+	if err == nil {
+		return value, nil
 	}
 	if !errors.Is(err, ErrNotFound) {
-		return
+		return nil, err
+	}
+
+	// Evicted from the fast store before being written back.
+	value, err = s.opts.journal.Get(Key)
+	if err == nil {
+		return value, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
 	}
 
 	value, err = s.slow.Get(Key)
@@ -57,32 +141,141 @@ func (s Paired) Get(Key []byte) (value []byte, err error) {
 	return value, nil
 }
 
-func (s Paired) writeback() {
-	for kv := range s.wbc {
-		key := kv[0]
-		value := kv[1]
-		s.writeback1(key, value)
+// Delete removes the key from both stores, and cancels its write back if
+// pending.
+func (s *Paired) Delete(key []byte) error {
+	if err := s.opts.journal.Delete(key); err != nil {
+		return err
+	}
+	if err := s.slow.Delete(key); err != nil {
+		return err
 	}
+	return s.fast.Delete(key)
 }
 
-func (s Paired) writeback1(key, value []byte) {
+func (s *Paired) Has(key []byte) (bool, error) {
+	for _, store := range []Store{s.fast, s.opts.journal, s.slow} {
+		ok, err := store.Has(key)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// Scan calls fn once with each key in either store.
+func (s *Paired) Scan(prefix []byte, fn func(key []byte) error) error {
+	seen := make(map[string]bool)
+	scan := func(key []byte) error {
+		if seen[string(key)] {
+			return nil
+		}
+		seen[string(key)] = true
+		return fn(key)
+	}
+	for _, store := range []Store{s.fast, s.opts.journal, s.slow} {
+		if err := store.Scan(prefix, scan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns the number of values not yet written back.
+func (s *Paired) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Flush waits until all values are written back, or the context is done.
+func (s *Paired) Flush(ctx context.Context) error {
+	// Wake up the wait below once the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("%d values not written back: %w", len(s.queue), err)
+		}
+		s.cond.Wait()
+	}
+	return nil
+}
+
+func (s *Paired) enqueue(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[string(key)] {
+		return
+	}
+	s.pending[string(key)] = true
+	s.queue = append(s.queue, key)
+	s.cond.Broadcast()
+}
+
+func (s *Paired) writeback() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 {
+			s.cond.Wait()
+		}
+		key := s.queue[0]
+		s.mu.Unlock()
+
+		s.writeback1(key)
+
+		s.mu.Lock()
+		s.queue = s.queue[1:]
+		delete(s.pending, string(key))
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+func (s *Paired) writeback1(key []byte) {
 	logger := log.WithFields(log.Fields{
 		"key": fmt.Sprintf("%.10x", key),
 	})
+	backoff := s.opts.minBackoff
 	for {
-		err := s.slow.Put(key, value)
+		value, err := s.opts.journal.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			logger.Debug("Deleted before being propagated from fast to slow")
+			return
+		}
 		if err == nil {
+			err = s.slow.Put(key, value)
+		}
+		if err == nil {
+			if err := s.opts.journal.Delete(key); err != nil {
+				logger.WithField("err", err).Warn("Could not remove from journal")
+			}
 			logger.Debug("Propagated from fast to slow")
-			break
+			return
 		}
+		wait := jitter(backoff)
 		logger.WithFields(log.Fields{
-			"err": err,
+			"err":     err,
+			"pending": s.Pending(),
+			"retryIn": wait,
 		}).Warn("Could not propagate from fast to slow")
-		// Should randomize.
-		time.Sleep(time.Second)
+		time.Sleep(wait)
+		backoff = min(2*backoff, s.opts.maxBackoff)
 	}
 }
 
+// jitter returns a random duration between half d and d, so that clients
+// failing at the same time don't retry at the same time.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
 func dup(p []byte) []byte {
 	q := make([]byte, len(p))
 	copy(q, p)
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyStore fails puts until told otherwise.
+type flakyStore struct {
+	*InMemorySTore
+	mu       sync.Mutex
+	failing  bool
+	attempts int
+}
+
+func (s *flakyStore) Put(key, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.failing {
+		return errors.New("unavailable")
+	}
+	return s.InMemorySTore.Put(key, value)
+}
+
+func (s *flakyStore) putAttempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+func (s *flakyStore) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func TestPaired(t *testing.T) {
+	withTimeout := func(t *testing.T) context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	t.Run("writes back and empties the journal", func(t *testing.T) {
+		slow := NewInMemoryStore()
+		journal := NewInMemoryStore()
+		p, err := NewPaired(NewInMemoryStore(), slow, WithJournal(journal))
+		require.NoError(t, err)
+		require.NoError(t, p.Put([]byte("k"), []byte("v")))
+		require.NoError(t, p.Flush(withTimeout(t)))
+		assert.Equal(t, 0, p.Pending())
+		value, err := slow.Get([]byte("k"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v"), value)
+		ok, err := journal.Has([]byte("k"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("retries with backoff", func(t *testing.T) {
+		slow := &flakyStore{InMemorySTore: NewInMemoryStore(), failing: true}
+		p, err := NewPaired(NewInMemoryStore(), slow, WithBackoff(time.Millisecond, 4*time.Millisecond))
+		require.NoError(t, err)
+		require.NoError(t, p.Put([]byte("k"), []byte("v")))
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, p.Flush(ctx), context.DeadlineExceeded)
+		assert.Equal(t, 1, p.Pending())
+
+		// Flushes timing out leave nothing behind.
+		goroutines := runtime.NumGoroutine()
+		for i := 0; i < 10; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			assert.ErrorIs(t, p.Flush(ctx), context.DeadlineExceeded)
+			cancel()
+		}
+		// Let the flushes wind down, then count.
+		deadline := time.Now().Add(time.Second)
+		for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+
+		slow.setFailing(false)
+		require.NoError(t, p.Flush(withTimeout(t)))
+		assert.Greater(t, slow.putAttempts(), 2)
+		value, err := slow.Get([]byte("k"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v"), value)
+	})
+
+	t.Run("replays journal", func(t *testing.T) {
+		slow := NewInMemoryStore()
+		journal := NewInMemoryStore()
+		require.NoError(t, journal.Put([]byte("k1"), []byte("v1")))
+		require.NoError(t, journal.Put([]byte("k2"), []byte("v2")))
+		p, err := NewPaired(NewInMemoryStore(), slow, WithJournal(journal))
+		require.NoError(t, err)
+		require.NoError(t, p.Flush(withTimeout(t)))
+		for _, key := range []string{"k1", "k2"} {
+			_, err := slow.Get([]byte(key))
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("gets from journal if evicted from fast", func(t *testing.T) {
+		slow := &flakyStore{InMemorySTore: NewInMemoryStore(), failing: true}
+		fast := NewInMemoryStore()
+		p, err := NewPaired(fast, slow, WithBackoff(time.Hour, time.Hour))
+		require.NoError(t, err)
+		require.NoError(t, p.Put([]byte("k"), []byte("v")))
+		require.NoError(t, fast.Delete([]byte("k")))
+		value, err := p.Get([]byte("k"))
+		require.NoError(t, err)
+		assert.Equal(t, []byte("v"), value)
+	})
+
+	t.Run("delete cancels write back", func(t *testing.T) {
+		slow := &flakyStore{InMemorySTore: NewInMemoryStore(), failing: true}
+		p, err := NewPaired(NewInMemoryStore(), slow, WithBackoff(time.Millisecond, time.Millisecond))
+		require.NoError(t, err)
+		require.NoError(t, p.Put([]byte("k"), []byte("v")))
+		require.NoError(t, p.Delete([]byte("k")))
+		slow.setFailing(false)
+		require.NoError(t, p.Flush(withTimeout(t)))
+		ok, err := slow.Has([]byte("k"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+}
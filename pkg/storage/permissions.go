@@ -0,0 +1,48 @@
+package storage
+
+import "errors"
+
+// Permissions tell what the principal a message is applied for may do.
+type Permissions interface {
+	// CanRead should tell whether the value at the given key may be got.
+	CanRead(key []byte) bool
+
+	// CanWrite should tell whether the given mutations may be committed
+	// together.
+	CanWrite(mutations []Mutation) bool
+}
+
+var (
+	// ErrForbidden is returned when applying a message its principal doesn't
+	// have the permissions for.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// ApplyOption is a functional option for ApplyMessage and ApplyLockMessage
+type ApplyOption func(*applyOptions)
+
+type applyOptions struct {
+	perms Permissions
+}
+
+// WithPermissions makes messages be applied only if the given permissions
+// allow. Nil permissions allow everything, as if the option wasn't given, but
+// reserved keys, which can't be read or written whatever the permissions.
+func WithPermissions(value Permissions) ApplyOption {
+	return func(o *applyOptions) {
+		o.perms = value
+	}
+}
+
+func (o *applyOptions) canRead(key []byte) bool {
+	return !Reserved(key) && (o.perms == nil || o.perms.CanRead(key))
+}
+
+func (o *applyOptions) canWrite(mutations []Mutation) bool {
+	for _, m := range mutations {
+		if Reserved(m.Key) {
+			return false
+		}
+	}
+	return o.perms == nil || o.perms.CanWrite(mutations)
+}
@@ -1,22 +1,81 @@
 package storage
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 )
 
+// adminUser is the user name sent along with the admin password. The blob
+// server only checks the password.
+const adminUser = "admin"
+
+var (
+	// ErrAdminPasswordInClear is returned when an admin request would send the
+	// admin password to a blob server that isn't on a loopback address. The blob
+	// server speaks plain HTTP, so anyone on the path could read it.
+	ErrAdminPasswordInClear = errors.New("admin password is only sent to blob servers on loopback addresses")
+)
+
+// RemoteStoreOption is a functional option for configuring a RemoteStore
+type RemoteStoreOption func(*remoteStoreOptions)
+
+type remoteStoreOptions struct {
+	adminPassword string
+}
+
+// WithAdminPassword sets the password the blob server asks for before deleting
+// or listing blobs. As it would be sent in clear, it's only sent if the blob
+// server address is a loopback one.
+func WithAdminPassword(value string) RemoteStoreOption {
+	return func(o *remoteStoreOptions) {
+		o.adminPassword = value
+	}
+}
+
 // RemoteStore implement Store. It requires to connect to a blobserver
 type RemoteStore struct {
 	address string
+	opts    remoteStoreOptions
 }
 
-func NewRemoteStore(address string) *RemoteStore {
-	return &RemoteStore{
+func NewRemoteStore(address string, opts ...RemoteStoreOption) *RemoteStore {
+	r := &RemoteStore{
 		address: address,
 	}
+	for _, o := range opts {
+		o(&r.opts)
+	}
+	return r
+}
+
+// doAdmin sends a request only the administrator of the blob server may send.
+func (r *RemoteStore) doAdmin(request *http.Request) (*http.Response, error) {
+	if r.opts.adminPassword != "" {
+		if !isLoopback(r.address) {
+			return nil, fmt.Errorf("%q: %w", r.address, ErrAdminPasswordInClear)
+		}
+		request.SetBasicAuth(adminUser, r.opts.adminPassword)
+	}
+	return http.DefaultClient.Do(request)
+}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
 }
 
 func (r *RemoteStore) pathFor(key []byte) string {
@@ -70,4 +129,97 @@ func (r *RemoteStore) Get(key []byte) (value []byte, err error) {
 		return nil, errors.New(string(body))
 	}
 	return body, nil
-}
\ No newline at end of file
+}
+
+func (r *RemoteStore) Delete(key []byte) (err error) {
+	request, err := http.NewRequest(http.MethodDelete, r.pathFor(key), nil)
+	if err != nil {
+		return err
+	}
+	response, err := r.doAdmin(request)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return errors.New(string(body))
+	}
+	return nil
+}
+
+func (r *RemoteStore) Has(key []byte) (ok bool, err error) {
+	response, err := http.Head(r.pathFor(key))
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return false, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%x: unexpected status %q", key, response.Status)
+	}
+}
+
+// Usage implements the UsageReporter interface, asking the blob server.
+func (r *RemoteStore) Usage() (u Usage, err error) {
+	response, err := http.Get(fmt.Sprintf("http://%s/stats", r.address))
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return u, err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return u, errors.New(string(body))
+	}
+	err = json.NewDecoder(response.Body).Decode(&u)
+	return u, err
+}
+
+// Scan lists the keys from the blob server, which sends them hex encoded, one
+// per line.
+func (r *RemoteStore) Scan(prefix []byte, fn func(key []byte) error) (err error) {
+	request, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/?prefix=%x", r.address, prefix), nil)
+	if err != nil {
+		return err
+	}
+	response, err := r.doAdmin(request)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return errors.New(string(body))
+	}
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		key, err := hex.DecodeString(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%q: bad key in listing: %w", scanner.Text(), err)
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteStore(t *testing.T) {
+	var password string
+	blobServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		password = ""
+		if _, p, ok := r.BasicAuth(); ok {
+			password = p
+		}
+	}))
+	defer blobServer.Close()
+	address := strings.TrimPrefix(blobServer.URL, "http://")
+
+	t.Run("admin password is sent to loopback addresses", func(t *testing.T) {
+		store := NewRemoteStore(address, WithAdminPassword("s3cr3t"))
+		require.NoError(t, store.Delete([]byte("key")))
+		assert.Equal(t, "s3cr3t", password)
+	})
+	t.Run("admin password is not sent in clear to other addresses", func(t *testing.T) {
+		for _, address := range []string{"192.0.2.1:8080", "blob.example:8080"} {
+			store := NewRemoteStore(address, WithAdminPassword("s3cr3t"))
+			assert.ErrorIs(t, store.Delete([]byte("key")), ErrAdminPasswordInClear)
+			assert.ErrorIs(t, store.Scan(nil, func([]byte) error { return nil }), ErrAdminPasswordInClear)
+		}
+	})
+}
@@ -0,0 +1,684 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/EncrypteDL/CryptFS/pkg/message"
+	"github.com/EncrypteDL/CryptFS/pkg/network/client"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrUnexpectedResponse is returned when the metadata server responds with a
+	// message of a kind that doesn't make sense for the request.
+	ErrUnexpectedResponse = errors.New("unexpected response")
+)
+
+// RemoteVersionedStoreOption is a functional option for configuring a
+// RemoteVersionedStore
+type RemoteVersionedStoreOption func(*remoteVersionedStoreOptions)
+
+type remoteVersionedStoreOptions struct {
+	requestTimeout time.Duration
+	listeners      []func(message.Message)
+}
+
+// WithRequestTimeout sets how long to wait for the metadata server to respond
+// to a request
+func WithRequestTimeout(value time.Duration) RemoteVersionedStoreOption {
+	return func(o *remoteVersionedStoreOptions) {
+		o.requestTimeout = value
+	}
+}
+
+// WithChangeListener registers a function to be called with each revocation
+// sent by the metadata server, i.e., with each change made by some other client
+// to a value this one holds a lease on. When the connection to the server is
+// lost, so are all leases: once reconnected, listeners are called with a
+// revocation for each value that changed meanwhile, of its latest version, or
+// of version zero if it's gone or unknown. Listeners are called from a single
+// goroutine, in order, except that revocations of a key not yet passed to them
+// are merged into one.
+func WithChangeListener(listener func(message.Message)) RemoteVersionedStoreOption {
+	return func(o *remoteVersionedStoreOptions) {
+		o.listeners = append(o.listeners, listener)
+	}
+}
+
+const (
+	// How long to wait at least before receiving again after failing to.
+	minReceiveRetry = 100 * time.Millisecond
+
+	// How many keys to revalidate per request.
+	maxRevalidateBatch = 1024
+)
+
+type lostLocks struct {
+	key   string
+	owner uint64
+}
+
+type versionedValue struct {
+	version uint64
+	value   []byte
+}
+
+// RemoteVersionedStore implements VersionedStore on top of a connection to a
+// metadata server. Requests are correlated with responses by tag, so many
+// requests can be in flight at once. Values that have been got or put are
+// cached along with a lease on them, so that gets for them don't need a round
+// trip until the server revokes it.
+type RemoteVersionedStore struct {
+	opts   remoteVersionedStoreOptions
+	client *client.Client
+	tags   *message.MonotoneTags
+
+	mu      sync.Mutex
+	pending map[uint16]chan message.Message
+	// Only values this client holds a lease on.
+	cache map[string]versionedValue
+	// Values cached when the connection was lost, to be revalidated once
+	// reconnected.
+	suspect map[string]versionedValue
+	stopped bool
+
+	// Called with the changes streamed by the server, nil until subscribed.
+	subscriber func(Change)
+	// The sequence number of the next change for the subscriber.
+	nextChange uint64
+
+	// Held while setting locks, and while taking them again after reconnecting,
+	// so that they are taken again as they were last set.
+	locksMu sync.Mutex
+	// The locks held through the connection, in session zero.
+	locks *LockTable
+	// The owners of the locks that could not be taken again, by key. Their next
+	// lock operation on the key fails.
+	lost map[lostLocks]bool
+
+	// Revocations and changes are handed to listeners and the subscriber from a
+	// separate goroutine, so that a slow listener can't hold up responses. A
+	// listener may well wait for a response itself, so receiving never waits
+	// for them: the queue is unbounded, but the revocations of a key not yet
+	// handed over are merged into one. Guarded by mu.
+	queue []message.Message
+	// The index in queue of the revocation of each key.
+	queued map[string]int
+	// Signaled after queueing, closed on Stop.
+	wake       chan struct{}
+	done       chan struct{}
+	catchingUp sync.WaitGroup
+}
+
+// NewRemoteVersionedStore creates a versioned store using the given client.
+// Call Start before using it.
+func NewRemoteVersionedStore(c *client.Client, opts ...RemoteVersionedStoreOption) *RemoteVersionedStore {
+	s := &RemoteVersionedStore{
+		client:  c,
+		tags:    message.NewMonotoneTags(),
+		pending: make(map[uint16]chan message.Message),
+		cache:   make(map[string]versionedValue),
+		suspect: make(map[string]versionedValue),
+		locks:   NewLockTable(),
+		lost:    make(map[lostLocks]bool),
+		queued:  make(map[string]int),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	s.opts.requestTimeout = 10 * time.Second
+	for _, o := range opts {
+		o(&s.opts)
+	}
+	return s
+}
+
+// Start connects to the metadata server and starts receiving messages from it.
+func (s *RemoteVersionedStore) Start() {
+	if err := s.client.Connect(); err != nil {
+		log.WithField("err", err).Warn("Could not connect to metadata server, will retry")
+	}
+	go s.receive()
+	go s.notify()
+}
+
+// Stop disconnects from the metadata server. The store can't be used after
+// calling Stop.
+func (s *RemoteVersionedStore) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.client.Close()
+	<-s.done
+	s.catchingUp.Wait()
+	close(s.wake)
+	s.tags.Stop()
+}
+
+// Put implements the VersionedStore interface
+func (s *RemoteVersionedStore) Put(version uint64, key []byte, value []byte) error {
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		return message.NewPutMessage(tag, string(key), string(value), version)
+	})
+	if err != nil {
+		return err
+	}
+	switch response.Kind() {
+	case message.KindPut:
+		return nil
+	case message.KindError:
+		err := errorFromMessage(key, response)
+		if errors.Is(err, ErrStalePut) {
+			s.forget(key)
+		}
+		return err
+	default:
+		return fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+// PutAll implements the TransactionalStore interface
+func (s *RemoteVersionedStore) PutAll(mutations []Mutation) error {
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		puts := make([]message.Message, len(mutations))
+		for i, m := range mutations {
+			puts[i] = message.NewPutMessage(0, string(m.Key), string(m.Value), m.Version)
+		}
+		return message.NewTxnMessage(tag, puts)
+	})
+	if err != nil {
+		return err
+	}
+	switch response.Kind() {
+	case message.KindTxn:
+		return nil
+	case message.KindError:
+		err := errorFromMessage(nil, response)
+		if errors.Is(err, ErrStalePut) {
+			// We can't tell which, so get them all again next time.
+			for _, m := range mutations {
+				s.forget(m.Key)
+			}
+		}
+		return err
+	default:
+		return fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+// Get implements the VersionedStore interface
+func (s *RemoteVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
+	s.mu.Lock()
+	cached, ok := s.cache[string(key)]
+	s.mu.Unlock()
+	if ok {
+		return cached.version, dup(cached.value), nil
+	}
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		return message.NewLeaseMessage(tag, string(key), "", 0)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	switch response.Kind() {
+	case message.KindLease:
+		return response.Version(), []byte(response.Value()), nil
+	case message.KindError:
+		return 0, nil, errorFromMessage(key, response)
+	default:
+		return 0, nil, fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+// Usage implements the UsageReporter interface, asking the metadata server.
+func (s *RemoteVersionedStore) Usage() (Usage, error) {
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		return message.NewUsageMessage(tag, message.Usage{})
+	})
+	if err != nil {
+		return Usage{}, err
+	}
+	switch response.Kind() {
+	case message.KindUsage:
+		return Usage(response.Usage()), nil
+	case message.KindError:
+		return Usage{}, errorFromMessage(nil, response)
+	default:
+		return Usage{}, fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+// GetLock implements the Locker interface, asking the metadata server.
+func (s *RemoteVersionedStore) GetLock(key []byte, l Lock) (Lock, error) {
+	if err := s.checkLost(key, l.Owner); err != nil {
+		return Lock{}, err
+	}
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		return message.NewGetLockMessage(tag, string(key), message.Lock(l))
+	})
+	if err != nil {
+		return Lock{}, err
+	}
+	switch response.Kind() {
+	case message.KindGetLock:
+		return Lock(response.Lock()), nil
+	case message.KindError:
+		return Lock{}, errorFromMessage(key, response)
+	default:
+		return Lock{}, fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+// SetLock implements the Locker interface. Locks are held by the connection to
+// the metadata server, so the server releases them all if it is lost. They are
+// taken again once reconnected: the owner of those that can't be gets
+// ErrLockLost on its next lock operation on the node.
+func (s *RemoteVersionedStore) SetLock(key []byte, l Lock) error {
+	if err := s.checkLost(key, l.Owner); err != nil {
+		return err
+	}
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if err := s.setLock(key, l); err != nil {
+		return err
+	}
+	if err := s.locks.Session(0).SetLock(key, l); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"key": fmt.Sprintf("%.10x", key),
+		}).Warn("Could not keep track of lock")
+	}
+	return nil
+}
+
+func (s *RemoteVersionedStore) setLock(key []byte, l Lock) error {
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		return message.NewSetLockMessage(tag, string(key), message.Lock(l))
+	})
+	if err != nil {
+		return err
+	}
+	switch response.Kind() {
+	case message.KindSetLock:
+		return nil
+	case message.KindError:
+		return errorFromMessage(key, response)
+	default:
+		return fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+// checkLost returns ErrLockLost, once, if the owner lost its locks on the key.
+func (s *RemoteVersionedStore) checkLost(key []byte, owner uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lost := lostLocks{key: string(key), owner: owner}
+	if !s.lost[lost] {
+		return nil
+	}
+	delete(s.lost, lost)
+	return fmt.Errorf("%.40q: %w", key, ErrLockLost)
+}
+
+// retakeLocks takes again the locks held before reconnecting. An owner that
+// can't take one of its locks on a node again loses them all, and is told so
+// on its next lock operation. Should the connection be lost again, the locks
+// are taken again after the next reconnection.
+func (s *RemoteVersionedStore) retakeLocks() {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	for key, held := range s.locks.Held(0) {
+		failed := make(map[uint64]bool)
+		for _, l := range held {
+			if failed[l.Owner] {
+				continue
+			}
+			err := s.setLock([]byte(key), l)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ErrLocked) && !errors.Is(err, ErrForbidden) {
+				log.WithField("err", err).Warn("Could not take locks again")
+				return
+			}
+			failed[l.Owner] = true
+		}
+		for owner := range failed {
+			log.WithFields(log.Fields{
+				"key":   fmt.Sprintf("%.10x", key),
+				"owner": owner,
+			}).Warn("Lost locks while disconnected")
+			all := Lock{Owner: owner, Type: Unlock, End: math.MaxUint64}
+			if err := s.setLock([]byte(key), all); err != nil {
+				log.WithField("err", err).Warn("Could not release locks partly taken again")
+			}
+			_ = s.locks.Session(0).SetLock([]byte(key), all)
+			s.mu.Lock()
+			s.lost[lostLocks{key: key, owner: owner}] = true
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Subscribe asks the metadata server to stream the changes committed from the
+// given sequence number on, returning the sequence number of the last one
+// committed so far. Each change is passed to fn, in order, from the goroutine
+// calling change listeners. After reconnecting, the store subscribes again
+// from the change following the last one passed to fn, so none is missed,
+// unless the server dropped it from its change log meanwhile. Subscribing
+// from changes already dropped fails with ErrChangesDropped.
+func (s *RemoteVersionedStore) Subscribe(from uint64, fn func(Change)) (uint64, error) {
+	s.mu.Lock()
+	s.subscriber = fn
+	s.nextChange = from
+	s.mu.Unlock()
+	return s.resubscribe()
+}
+
+func (s *RemoteVersionedStore) resubscribe() (uint64, error) {
+	s.mu.Lock()
+	from := s.nextChange
+	s.mu.Unlock()
+	response, err := s.roundTrip(func(tag uint16) message.Message {
+		return message.NewSubscribeMessage(tag, from)
+	})
+	if err != nil {
+		return 0, err
+	}
+	switch response.Kind() {
+	case message.KindSubscribe:
+		return response.Sequence(), nil
+	case message.KindError:
+		return 0, errorFromMessage(nil, response)
+	default:
+		return 0, fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+	}
+}
+
+func (s *RemoteVersionedStore) roundTrip(request func(tag uint16) message.Message) (message.Message, error) {
+	tag := s.tags.Next()
+	ch := make(chan message.Message, 1)
+	s.mu.Lock()
+	s.pending[tag] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tag)
+		s.mu.Unlock()
+	}()
+	if err := s.client.Send(request(tag)); err != nil {
+		return message.Message{}, err
+	}
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-time.After(s.opts.requestTimeout):
+		return message.Message{}, client.ErrTimeout
+	}
+}
+
+// To be run in a separate goroutine, which will exit when Stop is called.
+func (s *RemoteVersionedStore) receive() {
+	defer close(s.done)
+	for {
+		var m message.Message
+		if err := s.client.Receive(&m); err != nil {
+			if s.isStopped() {
+				return
+			}
+			log.WithField("err", err).Warn("Could not receive from metadata server")
+			// Revocations might have been missed, and the server forgets about
+			// the leases of a client once disconnected anyway.
+			s.suspectLeases()
+			time.Sleep(max(s.client.RetryIn(), minReceiveRetry))
+			if s.client.Connect() == nil {
+				s.catchingUp.Add(1)
+				go s.catchUp()
+			}
+			continue
+		}
+		if m.Tag() == 0 && m.Kind() == message.KindChange {
+			s.enqueue(m)
+			continue
+		}
+		if m.Tag() == 0 {
+			s.handleRevoke(m)
+			continue
+		}
+		// Cached before anyone is told, so that a revocation that follows can't
+		// be handled before.
+		s.cacheLeased(m)
+		s.mu.Lock()
+		ch := s.pending[m.Tag()]
+		s.mu.Unlock()
+		if ch == nil {
+			log.WithField("message", m).Debug("Dropping response nobody is waiting for")
+			continue
+		}
+		ch <- m
+	}
+}
+
+// cacheLeased caches the values responses come with a lease on.
+func (s *RemoteVersionedStore) cacheLeased(m message.Message) {
+	switch m.Kind() {
+	case message.KindLease, message.KindPut:
+		s.update([]byte(m.Key()), m.Version(), []byte(m.Value()))
+	case message.KindTxn:
+		for _, p := range m.Puts() {
+			s.update([]byte(p.Key()), p.Version(), []byte(p.Value()))
+		}
+	case message.KindRevalidate:
+		for _, latest := range m.Puts() {
+			s.mu.Lock()
+			cached, ok := s.suspect[latest.Key()]
+			delete(s.suspect, latest.Key())
+			s.mu.Unlock()
+			switch {
+			case !ok:
+				// Revalidated already.
+			case latest.Version() != 0 && latest.Version() == cached.version:
+				s.update([]byte(latest.Key()), cached.version, cached.value)
+			default:
+				s.enqueue(message.NewRevokeMessage(0, latest.Key(), latest.Version()))
+			}
+		}
+	}
+}
+
+func (s *RemoteVersionedStore) handleRevoke(m message.Message) {
+	if m.Kind() != message.KindRevoke {
+		log.WithField("message", m).Warn("Unexpected message from metadata server")
+		return
+	}
+	s.forget([]byte(m.Key()))
+	if err := s.client.Send(m); err != nil {
+		log.WithField("err", err).Warn("Could not acknowledge revocation")
+	}
+	s.enqueue(m)
+}
+
+// suspectLeases sets aside all cached values until revalidated.
+func (s *RemoteVersionedStore) suspectLeases() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, cached := range s.cache {
+		if suspect, ok := s.suspect[key]; !ok || suspect.version < cached.version {
+			s.suspect[key] = cached
+		}
+	}
+	s.cache = make(map[string]versionedValue)
+}
+
+// catchUp takes locks again, revalidates the values set aside and, if
+// subscribed to changes, subscribes again, after reconnecting.
+func (s *RemoteVersionedStore) catchUp() {
+	defer s.catchingUp.Done()
+	s.retakeLocks()
+	s.revalidate()
+	s.mu.Lock()
+	subscribed := s.subscriber != nil
+	s.mu.Unlock()
+	if !subscribed {
+		return
+	}
+	if _, err := s.resubscribe(); err != nil {
+		log.WithField("err", err).Warn("Could not subscribe to changes again")
+	}
+}
+
+// revalidate asks the metadata server which of the values set aside changed
+// while disconnected, taking leases again on the others. Should that fail,
+// they are all taken as changed.
+func (s *RemoteVersionedStore) revalidate() {
+	s.mu.Lock()
+	versions := make([]message.Message, 0, len(s.suspect))
+	for key, cached := range s.suspect {
+		versions = append(versions, message.NewPutMessage(0, key, "", cached.version))
+	}
+	s.mu.Unlock()
+	for len(versions) > 0 {
+		batch := versions[:min(len(versions), maxRevalidateBatch)]
+		versions = versions[len(batch):]
+		response, err := s.roundTrip(func(tag uint16) message.Message {
+			return message.NewRevalidateMessage(tag, batch)
+		})
+		if err == nil && response.Kind() != message.KindRevalidate {
+			err = fmt.Errorf("%v: %w", response, ErrUnexpectedResponse)
+		}
+		if err != nil {
+			log.WithField("err", err).Warn("Could not revalidate cache")
+			s.dropSuspect(batch)
+			continue
+		}
+		log.WithField("keys", len(batch)).Debug("Revalidated cache")
+	}
+}
+
+// dropSuspect forgets the given values set aside, telling listeners.
+func (s *RemoteVersionedStore) dropSuspect(versions []message.Message) {
+	for _, v := range versions {
+		s.mu.Lock()
+		_, ok := s.suspect[v.Key()]
+		delete(s.suspect, v.Key())
+		s.mu.Unlock()
+		if ok {
+			s.enqueue(message.NewRevokeMessage(0, v.Key(), 0))
+		}
+	}
+}
+
+// enqueue queues a revocation or change to be handed over by notify, merging
+// it with the revocation of the same key already queued, if any. A merged
+// revocation is of version zero if either is, else of the latest version.
+func (s *RemoteVersionedStore) enqueue(m message.Message) {
+	s.mu.Lock()
+	if m.Kind() != message.KindRevoke {
+		s.queue = append(s.queue, m)
+	} else if i, ok := s.queued[m.Key()]; ok {
+		version := max(s.queue[i].Version(), m.Version())
+		if s.queue[i].Version() == 0 || m.Version() == 0 {
+			version = 0
+		}
+		s.queue[i] = message.NewRevokeMessage(0, m.Key(), version)
+	} else {
+		s.queued[m.Key()] = len(s.queue)
+		s.queue = append(s.queue, m)
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// Woken up already.
+	}
+}
+
+// To be run in a separate goroutine, which will exit when Stop is called.
+func (s *RemoteVersionedStore) notify() {
+	for range s.wake {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue, s.queued = nil, make(map[string]int)
+		s.mu.Unlock()
+		for _, m := range queue {
+			if m.Kind() == message.KindChange {
+				s.handleChange(m)
+				continue
+			}
+			for _, listener := range s.opts.listeners {
+				listener(m)
+			}
+		}
+	}
+}
+
+// handleChange passes a streamed change to the subscriber, unless it was
+// passed already, before subscribing again.
+func (s *RemoteVersionedStore) handleChange(m message.Message) {
+	s.mu.Lock()
+	fn := s.subscriber
+	if fn == nil || m.Sequence() < s.nextChange {
+		s.mu.Unlock()
+		return
+	}
+	s.nextChange = m.Sequence() + 1
+	s.mu.Unlock()
+	mutations := make([]Mutation, len(m.Puts()))
+	for i, p := range m.Puts() {
+		mutations[i] = Mutation{Version: p.Version(), Key: []byte(p.Key()), Value: []byte(p.Value())}
+	}
+	fn(Change{Sequence: m.Sequence(), Mutations: mutations})
+}
+
+func (s *RemoteVersionedStore) update(key []byte, version uint64, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.cache[string(key)]; ok && cached.version >= version {
+		return
+	}
+	s.cache[string(key)] = versionedValue{version: version, value: dup(value)}
+}
+
+func (s *RemoteVersionedStore) forget(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.cache, string(key))
+}
+
+func (s *RemoteVersionedStore) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopped
+}
+
+// errorFromMessage turns the error messages sent by ApplyMessage back into the
+// errors that caused them, so that callers can use errors.Is.
+func errorFromMessage(key []byte, m message.Message) error {
+	switch m.Value() {
+	case ErrStalePut.Error():
+		return ErrStalePut
+	case ErrNotFound.Error():
+		return fmt.Errorf("%.40q: %w", key, ErrNotFound)
+	case ErrUsageUnknown.Error():
+		return ErrUsageUnknown
+	case ErrNoTransactions.Error():
+		return ErrNoTransactions
+	case ErrBadTransaction.Error():
+		return ErrBadTransaction
+	case ErrLocked.Error():
+		return ErrLocked
+	case ErrBadLock.Error():
+		return ErrBadLock
+	case ErrNoChangeLog.Error():
+		return ErrNoChangeLog
+	case ErrChangesDropped.Error():
+		return ErrChangesDropped
+	case ErrForbidden.Error():
+		return fmt.Errorf("%.40q: %w", key, ErrForbidden)
+	default:
+		return errors.New(m.Value())
+	}
+}
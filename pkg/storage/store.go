@@ -37,6 +37,18 @@ type Store interface {
 
 	//Get should return ErrNotFound if the key is not in the store.
 	Get(keu []byte) (value []byte, err error)
+
+	// Delete should not return an error if the key is not in the store.
+	Delete(key []byte) (err error)
+
+	// Has reports whether the key is in the store, without getting the value.
+	Has(key []byte) (ok bool, err error)
+
+	// Scan calls fn with each key starting with prefix (all keys, if prefix is
+	// empty), in no particular order. It stops at the first error returned by
+	// fn and returns it. Implementations must allow fn to modify the store,
+	// although keys put during a scan may or may not be scanned.
+	Scan(prefix []byte, fn func(key []byte) error) (err error)
 }
 
 var (
@@ -67,11 +79,16 @@ var (
 // it's alos the slowest, as it serializes all calls to the underlying Store.
 type VersionedWrapper struct {
 	sync.Mutex
+	opts     versionedWrapperOptions
 	delegate Store
 }
 
-func NewVersionedWrapper(delegate Store) *VersionedWrapper {
-	return &VersionedWrapper{delegate: delegate}
+func NewVersionedWrapper(delegate Store, opts ...VersionedWrapperOption) *VersionedWrapper {
+	s := &VersionedWrapper{delegate: delegate}
+	for _, o := range opts {
+		o(&s.opts)
+	}
+	return s
 }
 
 // Put stores the given value at the given key, provided the passed version
@@ -80,6 +97,10 @@ func NewVersionedWrapper(delegate Store) *VersionedWrapper {
 func (s *VersionedWrapper) Put(version uint64, key []byte, value []byte) error {
 	s.Lock()
 	defer s.Unlock()
+	if s.opts.changeLog {
+		// Recorded along with the change, as a transaction.
+		return s.putAll([]Mutation{{Version: version, Key: key, Value: value}})
+	}
 	curr, err := s.delegate.Get(key)
 	if err != nil && !errors.Is(err, ErrNotFound) {
 		return err
@@ -90,10 +111,7 @@ func (s *VersionedWrapper) Put(version uint64, key []byte, value []byte) error {
 			return ErrStalePut
 		}
 	}
-	val := make([]byte, 8+len(value))
-	binary.BigEndian.PutUint64(val, version)
-	copy(val[8:], value)
-	return s.delegate.Put(key, val)
+	return s.delegate.Put(key, versioned(version, value))
 }
 
 // Get retrieves the value associated with a key and its version number.
@@ -108,6 +126,14 @@ func (s *VersionedWrapper) Get(key []byte) (version uint64, value []byte, err er
 	return
 }
 
+// Usage implements the UsageReporter interface, if the delegate does.
+func (s *VersionedWrapper) Usage() (Usage, error) {
+	if r, ok := s.delegate.(UsageReporter); ok {
+		return r.Usage()
+	}
+	return Usage{}, ErrUsageUnknown
+}
+
 var (
 	// ErrInvalidStore is returned when calling NewStore() with an invalid or unspproted
 	// store type. Support stores are: memory, disk, bitcask
@@ -1,2 +1,81 @@
 package storage
 
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store {
+			return NewInMemoryStore()
+		},
+		"disk": func(t *testing.T) Store {
+			return NewDiskStore(t.TempDir())
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, newStore(t))
+		})
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	keys := []string{"a1", "a2", "b1"}
+	for _, key := range keys {
+		require.NoError(store.Put([]byte(key), []byte("value of "+key)))
+	}
+	scan := func(prefix string) []string {
+		var scanned []string
+		err := store.Scan([]byte(prefix), func(key []byte) error {
+			scanned = append(scanned, string(key))
+			return nil
+		})
+		require.NoError(err)
+		sort.Strings(scanned)
+		return scanned
+	}
+
+	t.Run("has", func(t *testing.T) {
+		ok, err := store.Has([]byte("a1"))
+		require.NoError(err)
+		assert.True(ok)
+		ok, err = store.Has([]byte("c1"))
+		require.NoError(err)
+		assert.False(ok)
+	})
+	t.Run("scan", func(t *testing.T) {
+		assert.Equal(keys, scan(""))
+		assert.Equal([]string{"a1", "a2"}, scan("a"))
+		assert.Empty(scan("c"))
+	})
+	t.Run("scan stops at first error", func(t *testing.T) {
+		stop := errors.New("stop")
+		calls := 0
+		err := store.Scan(nil, func([]byte) error {
+			calls++
+			return stop
+		})
+		assert.ErrorIs(err, stop)
+		assert.Equal(1, calls)
+	})
+	t.Run("delete while scanning", func(t *testing.T) {
+		err := store.Scan([]byte("a"), store.Delete)
+		require.NoError(err)
+		assert.Equal([]string{"b1"}, scan(""))
+		_, err = store.Get([]byte("a1"))
+		assert.ErrorIs(err, ErrNotFound)
+		ok, err := store.Has([]byte("a1"))
+		require.NoError(err)
+		assert.False(ok)
+		assert.NoError(store.Delete([]byte("a1")))
+	})
+}
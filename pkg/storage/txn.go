@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/EncrypteDL/CryptFS/pkg/bits"
+	log "github.com/sirupsen/logrus"
+)
+
+// Mutation is one of the puts of a transaction.
+type Mutation struct {
+	Version uint64
+	Key     []byte
+	Value   []byte
+}
+
+// TransactionalStore is implemented by versioned stores that can apply a number
+// of puts atomically.
+type TransactionalStore interface {
+	VersionedStore
+
+	// PutAll should apply either all the mutations or none. It should return
+	// ErrStalePut, applying none, if any of the versions is stale as for Put.
+	PutAll(mutations []Mutation) (err error)
+}
+
+var (
+	// ErrNoTransactions is returned when a transaction is sent to a store that
+	// can't apply it atomically.
+	ErrNoTransactions = errors.New("transactions not supported")
+
+	// ErrBadTransaction is returned for transactions putting the same key more
+	// than once.
+	ErrBadTransaction = errors.New("bad transaction")
+)
+
+// txnIntentKey is where VersionedWrapper records the transaction being applied,
+// so that it can be completed if the process dies halfway through. Node keys
+// never have this length.
+var txnIntentKey = []byte("\x00txn-intent")
+
+// PutAll implements the TransactionalStore interface. The mutations are
+// recorded in the delegate before being applied, and applied again by Recover
+// if the process dies before they all are.
+func (s *VersionedWrapper) PutAll(mutations []Mutation) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.putAll(mutations)
+}
+
+// Call with lock held.
+func (s *VersionedWrapper) putAll(mutations []Mutation) error {
+	previous := make([][]byte, len(mutations))
+	seen := make(map[string]bool, len(mutations))
+	for i, m := range mutations {
+		if seen[string(m.Key)] {
+			return fmt.Errorf("%.10x put twice: %w", m.Key, ErrBadTransaction)
+		}
+		seen[string(m.Key)] = true
+		curr, err := s.delegate.Get(m.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if curr != nil && m.Version < binary.BigEndian.Uint64(curr[0:8])+1 {
+			return ErrStalePut
+		}
+		previous[i] = curr
+	}
+	if s.opts.changeLog {
+		var err error
+		if mutations, previous, err = s.withChange(mutations, previous); err != nil {
+			return err
+		}
+	}
+	if err := s.delegate.Put(txnIntentKey, encodeIntent(mutations)); err != nil {
+		return fmt.Errorf("could not record transaction: %w", err)
+	}
+	for i, m := range mutations {
+		if err := s.delegate.Put(m.Key, versioned(m.Version, m.Value)); err != nil {
+			s.undo(mutations[:i], previous)
+			return err
+		}
+	}
+	if err := s.delegate.Delete(txnIntentKey); err != nil {
+		log.WithField("err", err).Warn("Could not remove applied transaction")
+	}
+	if s.opts.changeLog {
+		// The last mutation is the one of the sequence number.
+		s.dropChange(mutations[len(mutations)-1].Version)
+	}
+	return nil
+}
+
+// undo restores the values overwritten by the applied mutations, and forgets
+// the transaction. If that fails, the transaction is left to be completed by
+// Recover instead.
+// Call with lock held.
+func (s *VersionedWrapper) undo(applied []Mutation, previous [][]byte) {
+	for i, m := range applied {
+		var err error
+		if previous[i] == nil {
+			err = s.delegate.Delete(m.Key)
+		} else {
+			err = s.delegate.Put(m.Key, previous[i])
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"key": fmt.Sprintf("%.10x", m.Key),
+			}).Error("Could not undo transaction, it will be completed on restart")
+			return
+		}
+	}
+	if err := s.delegate.Delete(txnIntentKey); err != nil {
+		log.WithField("err", err).Warn("Could not remove undone transaction")
+	}
+}
+
+// Recover completes the transaction that was being applied when the process
+// last died, if any. Call it before using the store.
+func (s *VersionedWrapper) Recover() error {
+	s.Lock()
+	defer s.Unlock()
+	intent, err := s.delegate.Get(txnIntentKey)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mutations, err := decodeIntent(intent)
+	if err != nil {
+		return fmt.Errorf("could not decode transaction: %w", err)
+	}
+	for _, m := range mutations {
+		// Mutations are only put if not already applied, or superseded.
+		curr, err := s.delegate.Get(m.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if curr != nil && binary.BigEndian.Uint64(curr[0:8]) >= m.Version {
+			continue
+		}
+		if err := s.delegate.Put(m.Key, versioned(m.Version, m.Value)); err != nil {
+			return err
+		}
+	}
+	log.WithField("puts", len(mutations)).Info("Completed interrupted transaction")
+	return s.delegate.Delete(txnIntentKey)
+}
+
+func versioned(version uint64, value []byte) []byte {
+	val := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(val, version)
+	copy(val[8:], value)
+	return val
+}
+
+func encodeIntent(mutations []Mutation) []byte {
+	size := 4
+	for _, m := range mutations {
+		size += 8 + 4 + len(m.Key) + 4 + len(m.Value)
+	}
+	buf := make([]byte, size)
+	b := bits.Put32(buf, uint32(len(mutations)))
+	for _, m := range mutations {
+		b = bits.Put64(b, m.Version)
+		b = bits.Put32(b, uint32(len(m.Key)))
+		b = b[copy(b, m.Key):]
+		b = bits.Put32(b, uint32(len(m.Value)))
+		b = b[copy(b, m.Value):]
+	}
+	return buf
+}
+
+func decodeIntent(b []byte) ([]Mutation, error) {
+	if len(b) < 4 {
+		return nil, ErrBadTransaction
+	}
+	count, b := bits.Get32(b)
+	var mutations []Mutation
+	for i := uint32(0); i < count; i++ {
+		var m Mutation
+		var n uint32
+		if len(b) < 12 {
+			return nil, ErrBadTransaction
+		}
+		m.Version, b = bits.Get64(b)
+		n, b = bits.Get32(b)
+		if uint64(len(b)) < uint64(n)+4 {
+			return nil, ErrBadTransaction
+		}
+		m.Key, b = b[:n], b[n:]
+		n, b = bits.Get32(b)
+		if uint32(len(b)) < n {
+			return nil, ErrBadTransaction
+		}
+		m.Value, b = b[:n], b[n:]
+		mutations = append(mutations, m)
+	}
+	return mutations, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingKeyStore fails puts to one key.
+type failingKeyStore struct {
+	*InMemorySTore
+	key string
+}
+
+func (s *failingKeyStore) Put(key, value []byte) error {
+	if string(key) == s.key {
+		return errors.New("disk full")
+	}
+	return s.InMemorySTore.Put(key, value)
+}
+
+func TestVersionedWrapperPutAll(t *testing.T) {
+	get := func(t *testing.T, store VersionedStore, key string) (uint64, string) {
+		version, value, err := store.Get([]byte(key))
+		require.NoError(t, err)
+		return version, string(value)
+	}
+
+	t.Run("rejects stale transactions", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		require.NoError(t, store.Put(1, []byte("a"), []byte("a1")))
+		err := store.PutAll([]Mutation{
+			{Version: 1, Key: []byte("b"), Value: []byte("b1")},
+			{Version: 1, Key: []byte("a"), Value: []byte("a2")},
+		})
+		assert.ErrorIs(t, err, ErrStalePut)
+		_, _, err = store.Get([]byte("b"))
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("rejects keys put twice", func(t *testing.T) {
+		store := NewVersionedWrapper(NewInMemoryStore())
+		err := store.PutAll([]Mutation{
+			{Version: 1, Key: []byte("a"), Value: []byte("a1")},
+			{Version: 2, Key: []byte("a"), Value: []byte("a2")},
+		})
+		assert.ErrorIs(t, err, ErrBadTransaction)
+	})
+
+	t.Run("undoes puts if one fails", func(t *testing.T) {
+		delegate := &failingKeyStore{InMemorySTore: NewInMemoryStore(), key: "b"}
+		store := NewVersionedWrapper(delegate)
+		require.NoError(t, store.Put(1, []byte("a"), []byte("a1")))
+		err := store.PutAll([]Mutation{
+			{Version: 2, Key: []byte("a"), Value: []byte("a2")},
+			{Version: 1, Key: []byte("b"), Value: []byte("b1")},
+		})
+		assert.Error(t, err)
+		version, value := get(t, store, "a")
+		assert.EqualValues(t, 1, version)
+		assert.Equal(t, "a1", value)
+		ok, err := delegate.Has(txnIntentKey)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("recovers interrupted transaction", func(t *testing.T) {
+		delegate := NewInMemoryStore()
+		store := NewVersionedWrapper(delegate)
+		require.NoError(t, store.Put(1, []byte("a"), []byte("a1")))
+		require.NoError(t, store.Put(1, []byte("c"), []byte("c1")))
+		require.NoError(t, store.Put(2, []byte("c"), []byte("c2")))
+		intent := encodeIntent([]Mutation{
+			{Version: 2, Key: []byte("a"), Value: []byte("a2")},
+			{Version: 1, Key: []byte("b"), Value: []byte("b1")},
+			{Version: 2, Key: []byte("c"), Value: []byte("superseded")},
+		})
+		require.NoError(t, delegate.Put(txnIntentKey, intent))
+
+		require.NoError(t, store.Recover())
+		for key, want := range map[string]string{"a": "a2", "b": "b1", "c": "c2"} {
+			_, value := get(t, store, key)
+			assert.Equal(t, want, value, key)
+		}
+		ok, err := delegate.Has(txnIntentKey)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.NoError(t, store.Recover())
+	})
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// Usage describes the capacity and contents of a store.
+type Usage struct {
+	// Bytes of the device the store is on, and bytes still available to the
+	// store. Zero if unknown, e.g., for stores in memory.
+	Capacity  uint64
+	Available uint64
+
+	// Bytes used by values, and number of keys.
+	Used  uint64
+	Count uint64
+}
+
+// UsageReporter is implemented by stores that can report their usage.
+type UsageReporter interface {
+	Usage() (Usage, error)
+}
+
+var (
+	// ErrUsageUnknown is returned when asking for the usage of a store that
+	// can't report it.
+	ErrUsageUnknown = errors.New("usage unknown")
+)
+
+// deviceUsage sets the capacity and available bytes of the device holding the
+// given path.
+func deviceUsage(path string, u *Usage) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return fmt.Errorf("could not statfs %q: %w", path, err)
+	}
+	u.Capacity = st.Blocks * uint64(st.Bsize)
+	u.Available = st.Bavail * uint64(st.Bsize)
+	return nil
+}